@@ -0,0 +1,446 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	arcSealHeader             = "ARC-Seal"
+	arcMessageSignatureHeader = "ARC-Message-Signature"
+	arcAuthResultsHeader      = "ARC-Authentication-Results"
+	authResultsHeader         = "Authentication-Results"
+
+	arcPass = "pass"
+	arcFail = "fail"
+	arcNone = "none"
+
+	// arcMaxInstances is the longest chain RFC 8617 allows.
+	arcMaxInstances = 50
+
+	// arcLookupTimeout limits the DNS lookups of the keys of a chain.
+	arcLookupTimeout = 10 * time.Second
+
+	canonicalizationSimple = "simple"
+)
+
+// arcConfig configures ARC sealing. The key is configured like a DKIM key;
+// AuthservID names this relay in ARC-Authentication-Results and defaults to
+// the host name.
+type arcConfig struct {
+	dkimConfig
+	AuthservID string `json:"authserv_id"`
+}
+
+func (c *arcConfig) validate() error {
+	if err := c.dkimConfig.validate(); err != nil {
+		return fmt.Errorf("arc: %w", err)
+	}
+	for _, h := range c.Headers {
+		if strings.HasPrefix(strings.ToLower(h), "arc-") {
+			return fmt.Errorf("arc: header %s cannot be signed", h)
+		}
+	}
+	if strings.ContainsAny(c.AuthservID, " \t;") {
+		return fmt.Errorf("arc: authserv_id %q is invalid", c.AuthservID)
+	}
+	return nil
+}
+
+// lookupTXT resolves the DNS records holding DKIM keys.
+var lookupTXT = net.DefaultResolver.LookupTXT
+
+// arcSealer adds an ARC set to messages, recording whether the chain of sets
+// added by earlier relays was intact.
+type arcSealer struct {
+	signer     *dkimSigner
+	authservID string
+}
+
+func newARCSealer(c *arcConfig) (*arcSealer, error) {
+	key, err := loadDKIMKey(c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("arc key: %w", err)
+	}
+	dc := c.dkimConfig
+	if len(dc.Headers) == 0 {
+		dc.Headers = append(append([]string(nil), defaultDKIMHeaders...), dkimSignatureHeader)
+	}
+	signer, err := newDKIMSigner(&dc, key)
+	if err != nil {
+		return nil, fmt.Errorf("arc key: %w", err)
+	}
+	a := &arcSealer{signer: signer, authservID: c.AuthservID}
+	if a.authservID == "" {
+		a.authservID = localHostname()
+	}
+	return a, nil
+}
+
+// arcSet is the set of ARC fields added by a single relay.
+type arcSet struct {
+	results   *headerField
+	signature *headerField
+	seal      *headerField
+}
+
+// field returns the member of the set holding fields with the name, or nil
+// if the name is not that of an ARC field.
+func (s *arcSet) field(name string) **headerField {
+	switch {
+	case strings.EqualFold(name, arcAuthResultsHeader):
+		return &s.results
+	case strings.EqualFold(name, arcMessageSignatureHeader):
+		return &s.signature
+	case strings.EqualFold(name, arcSealHeader):
+		return &s.seal
+	}
+	return nil
+}
+
+// arcChain returns the ARC sets of the message ordered by instance, and
+// false if they do not form a chain.
+func arcChain(m *message) ([]*arcSet, bool) {
+	sets := make(map[int]*arcSet)
+	for i := range m.fields {
+		f := &m.fields[i]
+		if (&arcSet{}).field(f.name) == nil {
+			continue
+		}
+		n, err := strconv.Atoi(parseDKIMTags(f.value())["i"])
+		if err != nil || n < 1 || n > arcMaxInstances {
+			return nil, false
+		}
+		if sets[n] == nil {
+			sets[n] = &arcSet{}
+		}
+		slot := sets[n].field(f.name)
+		if *slot != nil {
+			return nil, false
+		}
+		*slot = f
+	}
+	chain := make([]*arcSet, len(sets))
+	for n, set := range sets {
+		if n > len(sets) || set.results == nil || set.signature == nil || set.seal == nil {
+			return nil, false
+		}
+		chain[n-1] = set
+	}
+	return chain, true
+}
+
+// validateChain returns the validation status of the chain, with the reason
+// if it failed.
+func validateChain(ctx context.Context, m *message, chain []*arcSet) (string, error) {
+	if len(chain) == 0 {
+		return arcNone, nil
+	}
+	for i, set := range chain {
+		cv := parseDKIMTags(set.seal.value())["cv"]
+		if (i == 0 && cv != arcNone) || (i > 0 && cv != arcPass) {
+			return arcFail, fmt.Errorf("ARC-Seal i=%d has cv=%s", i+1, cv)
+		}
+	}
+	if err := verifyMessageSignature(ctx, m, *chain[len(chain)-1].signature); err != nil {
+		return arcFail, fmt.Errorf("ARC-Message-Signature i=%d: %w", len(chain), err)
+	}
+	for i := range chain {
+		fields, sealField := sealFields(chain[:i+1])
+		if err := verifyFields(ctx, fields, sealField); err != nil {
+			return arcFail, fmt.Errorf("ARC-Seal i=%d: %w", i+1, err)
+		}
+	}
+	return arcPass, nil
+}
+
+// chainFields returns the canonicalized fields of the chain in the order an
+// ARC-Seal signs them.
+func chainFields(chain []*arcSet) []string {
+	var fields []string
+	for _, set := range chain {
+		fields = append(fields, canonicalHeader(*set.results), canonicalHeader(*set.signature),
+			canonicalHeader(*set.seal))
+	}
+	return fields
+}
+
+// sealFields returns the canonicalized fields the last ARC-Seal of the chain
+// signs, and that seal.
+func sealFields(chain []*arcSet) ([]string, headerField) {
+	fields := chainFields(chain)
+	return fields[:len(fields)-1], *chain[len(chain)-1].seal
+}
+
+// seal adds an ARC set with the given chain validation status to the top of
+// the header. A failed chain is not carried on, the seal then only covers
+// the new set.
+func (a *arcSealer) seal(m *message, chain []*arcSet, cv, remoteIP string, now time.Time) error {
+	n := len(m.values(arcSealHeader)) + 1
+	if n > arcMaxInstances {
+		// retrying cannot shorten the chain
+		return errors.New("550 5.7.29 ARC chain is too long to seal")
+	}
+	var fields []string
+	if cv != arcFail {
+		fields = chainFields(chain)
+	}
+	instance := "i=" + strconv.Itoa(n)
+
+	m.prepend(arcAuthResultsHeader, instance+"; "+a.authResults(cv, remoteIP))
+	signature, err := a.signer.signMessage(m, arcMessageSignatureHeader, instance, now)
+	if err != nil {
+		return err
+	}
+	m.prepend(arcMessageSignatureHeader, signature)
+	fields = append(fields, canonicalHeader(m.fields[1]), canonicalHeader(m.fields[0]))
+
+	tags := []string{
+		instance,
+		"a=" + a.signer.algorithm,
+		"t=" + strconv.FormatInt(now.Unix(), 10),
+		"cv=" + cv,
+		"d=" + a.signer.domain,
+		"s=" + a.signer.selector,
+	}
+	value := strings.Join(tags, "; ") + ";" + m.eol + "\tb="
+	sig, err := a.signer.signFields(fields, m.newField(arcSealHeader, value))
+	if err != nil {
+		return err
+	}
+	m.prepend(arcSealHeader, value+foldBase64(sig, m.eol))
+	return nil
+}
+
+// authResults returns the assessment recorded in ARC-Authentication-Results.
+// Only the results of this relay's own checks are recorded.
+func (a *arcSealer) authResults(cv, remoteIP string) string {
+	results := a.authservID + "; arc=" + cv
+	if net.ParseIP(remoteIP) != nil {
+		results += " smtp.remote-ip=" + remoteIP
+	}
+	return results
+}
+
+// claimsAuthservID returns true if an Authentication-Results value was
+// issued under this relay's authserv-id.
+func (a *arcSealer) claimsAuthservID(value string) bool {
+	id, _, _ := strings.Cut(value, ";")
+	fields := strings.Fields(id)
+	return len(fields) > 0 && strings.EqualFold(fields[0], a.authservID)
+}
+
+// parseDKIMTags parses a tag list such as the value of a DKIM-Signature.
+// Whitespace is removed from values, which only base64 values may contain.
+func parseDKIMTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(k)] = strings.Join(strings.Fields(v), "")
+	}
+	return tags
+}
+
+// signatureValue matches the b= tag of a signature field.
+var signatureValue = regexp.MustCompile(`((?:^|;)[ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+// withoutSignature returns the field with an empty b= tag, as it was signed.
+func withoutSignature(f headerField) headerField {
+	value := signatureValue.ReplaceAll(f.raw[len(f.name)+1:], []byte("$1"))
+	f.raw = append([]byte(f.name+":"), value...)
+	return f
+}
+
+// verifyMessageSignature verifies a field signing header and body, such as
+// an ARC-Message-Signature.
+func verifyMessageSignature(ctx context.Context, m *message, f headerField) error {
+	tags := parseDKIMTags(f.value())
+	// c= defaults to simple/simple, and a missing body canonicalization to
+	// simple, RFC 6376 section 3.5
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	headerCanon = cmp.Or(headerCanon, canonicalizationSimple)
+	bodyCanon = cmp.Or(bodyCanon, canonicalizationSimple)
+	body := canonicalBody(m.body)
+	if bodyCanon == canonicalizationSimple {
+		body = simpleBody(m.body)
+	}
+	if l, err := strconv.Atoi(tags["l"]); err == nil && l >= 0 && l < len(body) {
+		body = body[:l]
+	}
+	bodyHash := sha256.Sum256(body)
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+
+	var fields []string
+	used := make(map[int]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(m.fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(m.fields[i].name, strings.TrimSpace(name)) {
+				used[i] = true
+				fields = append(fields, canonicalize(m.fields[i], headerCanon))
+				break
+			}
+		}
+	}
+	return verifySignature(ctx, tags, headerDigest(fields, canonicalize(withoutSignature(f), headerCanon)))
+}
+
+// verifyFields verifies a signature over header fields with relaxed
+// canonicalization, such as an ARC-Seal.
+func verifyFields(ctx context.Context, fields []string, f headerField) error {
+	return verifySignature(ctx, parseDKIMTags(f.value()), headerDigest(fields, canonicalHeader(withoutSignature(f))))
+}
+
+// verifySignature verifies the b= tag over the digest with the key published
+// for the d= and s= tags.
+func verifySignature(ctx context.Context, tags map[string]string, digest []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	key, err := lookupDKIMKey(ctx, tags["s"], tags["d"])
+	if err != nil {
+		return err
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != dkimAlgorithmRSA {
+			break
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig)
+	case ed25519.PublicKey:
+		if tags["a"] != dkimAlgorithmEd {
+			break
+		}
+		if !ed25519.Verify(k, digest, sig) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %q does not match the key", tags["a"])
+}
+
+// lookupDKIMKey returns the public key published for the selector.
+func lookupDKIMKey(ctx context.Context, selector, domain string) (crypto.PublicKey, error) {
+	if selector == "" || domain == "" {
+		return nil, errors.New("missing selector or domain")
+	}
+	records, err := lookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) != 1 {
+		return nil, fmt.Errorf("expected one key record for %s._domainkey.%s", selector, domain)
+	}
+	tags := parseDKIMTags(records[0])
+	p, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(p) == 0 {
+		return nil, errors.New("key record has no valid key")
+	}
+	switch tags["k"] {
+	case "", dkimKeyTypeRSA:
+		if key, err := x509.ParsePKIXPublicKey(p); err == nil {
+			return key, nil
+		}
+		return x509.ParsePKCS1PublicKey(p)
+	case dkimKeyTypeEd25519:
+		if len(p) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(p), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", tags["k"])
+	}
+}
+
+// canonicalize returns the field in the given header canonicalization.
+func canonicalize(f headerField, canon string) string {
+	if canon != canonicalizationSimple {
+		return canonicalHeader(f)
+	}
+	raw := strings.ReplaceAll(string(f.raw), "\r\n", "\n")
+	return strings.ReplaceAll(strings.TrimSuffix(raw, "\n"), "\n", "\r\n")
+}
+
+// simpleBody returns the body in the simple body canonicalization, with CRLF
+// line endings.
+func simpleBody(body []byte) []byte {
+	s := strings.ReplaceAll(string(body), "\r\n", "\n")
+	s = strings.TrimRight(s, "\n") + "\n"
+	return []byte(strings.ReplaceAll(s, "\n", "\r\n"))
+}
+
+// sealARC validates the ARC chain of the message and adds an ARC set.
+func sealARC(e *mail.Envelope, sealer *arcSealer) error {
+	msg := parseMessage(e.Data.Bytes())
+	chain, ok := arcChain(msg)
+	cv, reason := arcFail, errors.New("malformed chain")
+	if ok {
+		ctx, cancel := context.WithTimeout(context.Background(), arcLookupTimeout)
+		cv, reason = validateChain(ctx, msg, chain)
+		cancel()
+	}
+	if reason != nil {
+		msgLog(e).WithError(reason).Info("ARC chain failed validation")
+	}
+	// results claiming to be ours were forged by a client or an earlier
+	// hop, RFC 8601 section 5
+	if n := msg.delFunc(authResultsHeader, sealer.claimsAuthservID); n > 0 {
+		msgLog(e).Infof("removed %d Authentication-Results fields claiming authserv-id %s", n, sealer.authservID)
+	}
+	if err := sealer.seal(msg, chain, cv, e.RemoteIP, time.Now()); err != nil {
+		return err
+	}
+	replaceData(e, msg.bytes())
+	return nil
+}
+
+// arcProcessor decorator seals messages with ARC. It runs after DKIM signing,
+// so the ARC-Message-Signature covers our DKIM-Signature too.
+var arcProcessor = func() backends.Decorator {
+	var sealer *arcSealer
+	initFunc := backends.InitializeWith(func(backendConfig backends.BackendConfig) error {
+		config, ok := backendConfig["arc"].(*arcConfig)
+		if !ok || config == nil {
+			return nil
+		}
+		var err error
+		sealer, err = newARCSealer(config)
+		return err
+	})
+	backends.Svc.AddInitializer(initFunc)
+
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail && sealer != nil {
+					if err := sealARC(e, sealer); err != nil {
+						msgLog(e).WithError(err).Error("sealing message")
+						return backends.NewResult(err.Error()), err
+					}
+				}
+				return p.Process(e, task)
+			},
+		)
+	}
+}
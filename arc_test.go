@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const arcTestMessage = "Authentication-Results: relay1.example; spf=pass smtp.mailfrom=example.com\n" +
+	"Authentication-Results: other.example; dkim=fail\n" +
+	"From: App <app@example.com>\n" +
+	"To: list@example.net\n" +
+	"Subject: weekly report\n" +
+	"\n" +
+	"All systems nominal.\n"
+
+// fakeKeyRecords serves DKIM key records for the test instead of DNS.
+func fakeKeyRecords(t *testing.T) map[string]string {
+	t.Helper()
+	records := make(map[string]string)
+	orig := lookupTXT
+	lookupTXT = func(_ context.Context, name string) ([]string, error) {
+		if r, ok := records[name]; ok {
+			return []string{r}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	t.Cleanup(func() { lookupTXT = orig })
+	return records
+}
+
+// testSealer returns a sealer for the domain and publishes its key.
+func testSealer(t *testing.T, records map[string]string, domain string, key crypto.Signer) *arcSealer {
+	t.Helper()
+	sealer, err := newARCSealer(&arcConfig{
+		dkimConfig: dkimConfig{Domain: domain, Selector: "arc", KeyFile: writeTestKey(t, key, false)},
+		AuthservID: domain,
+	})
+	require.NoError(t, err)
+	record, err := dkimTXTRecord(key.Public())
+	require.NoError(t, err)
+	records["arc._domainkey."+domain] = record
+	return sealer
+}
+
+// chainStatus validates the ARC chain of the message.
+func chainStatus(t *testing.T, data string) (string, error) {
+	t.Helper()
+	msg := parseMessage([]byte(data))
+	chain, ok := arcChain(msg)
+	require.True(t, ok)
+	return validateChain(context.Background(), msg, chain)
+}
+
+func TestSealARC(t *testing.T) {
+	setupTestLogger(t)
+	records := fakeKeyRecords(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	first := testSealer(t, records, "relay1.example", rsaKey)
+	second := testSealer(t, records, "relay2.example", edKey)
+
+	e := mail.NewEnvelope("192.0.2.1", 1)
+	e.Data.WriteString(arcTestMessage)
+	require.NoError(t, sealARC(e, first))
+	msg := parseMessage(e.Data.Bytes())
+	assert.Equal(t, []string{arcSealHeader, arcMessageSignatureHeader, arcAuthResultsHeader},
+		[]string{msg.fields[0].name, msg.fields[1].name, msg.fields[2].name})
+	assert.Equal(t, "i=1; relay1.example; arc=none smtp.remote-ip=192.0.2.1", msg.get(arcAuthResultsHeader),
+		"inbound results are not sealed")
+	assert.Equal(t, []string{"other.example; dkim=fail"}, msg.values(authResultsHeader),
+		"inbound results claiming our authserv-id are removed")
+	seal := parseDKIMTags(msg.get(arcSealHeader))
+	assert.Equal(t, "none", seal["cv"])
+	assert.Equal(t, dkimAlgorithmRSA, seal["a"])
+	status, err := chainStatus(t, e.Data.String())
+	require.NoError(t, err)
+	assert.Equal(t, arcPass, status)
+
+	// the next relay carries the chain on
+	e.RemoteIP = "unix:0:0"
+	require.NoError(t, sealARC(e, second))
+	msg = parseMessage(e.Data.Bytes())
+	seal = parseDKIMTags(msg.get(arcSealHeader))
+	assert.Equal(t, "2", seal["i"])
+	assert.Equal(t, "pass", seal["cv"])
+	assert.Equal(t, "i=2; relay2.example; arc=pass", msg.get(arcAuthResultsHeader))
+	status, err = chainStatus(t, e.Data.String())
+	require.NoError(t, err)
+	assert.Equal(t, arcPass, status)
+
+	// changing the message breaks the chain
+	tampered := strings.Replace(e.Data.String(), "nominal", "down", 1)
+	status, err = chainStatus(t, tampered)
+	assert.Error(t, err)
+	assert.Equal(t, arcFail, status)
+
+	e.Data.Reset()
+	e.Data.WriteString(tampered)
+	require.NoError(t, sealARC(e, first))
+	msg = parseMessage(e.Data.Bytes())
+	seal = parseDKIMTags(msg.get(arcSealHeader))
+	assert.Equal(t, "3", seal["i"])
+	assert.Equal(t, "fail", seal["cv"])
+
+	// a failed chain stays failed, and the seal covers only the last set
+	status, _ = chainStatus(t, e.Data.String())
+	assert.Equal(t, arcFail, status)
+	fields := []string{canonicalHeader(msg.fields[2]), canonicalHeader(msg.fields[1])}
+	assert.NoError(t, verifyFields(context.Background(), fields, msg.fields[0]))
+}
+
+func TestArcChain_Malformed(t *testing.T) {
+	set := func(i string) string {
+		return "ARC-Seal: i=" + i + "; cv=none\nARC-Message-Signature: i=" + i + "; h=from\n" +
+			"ARC-Authentication-Results: i=" + i + "; relay.example; arc=none\n"
+	}
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{name: "missing field", header: "ARC-Seal: i=1; cv=none\nARC-Authentication-Results: i=1; a; arc=none\n"},
+		{name: "duplicate", header: set("1") + "ARC-Seal: i=1; cv=none\n"},
+		{name: "gap", header: set("1") + set("3")},
+		{name: "bad instance", header: set("0")},
+		{name: "too long", header: set("51")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := arcChain(parseMessage([]byte(tt.header + "From: a@example.com\n\nbody\n")))
+			assert.False(t, ok)
+		})
+	}
+
+	chain, ok := arcChain(parseMessage([]byte(set("2") + set("1") + "\nbody\n")))
+	require.True(t, ok)
+	assert.Len(t, chain, 2)
+	assert.Equal(t, "i=1; cv=none", chain[0].seal.value())
+}
+
+func TestLookupDKIMKey(t *testing.T) {
+	records := fakeKeyRecords(t)
+	records["s._domainkey.bad.example"] = "v=DKIM1; k=rsa; p=not-base64"
+	records["s._domainkey.revoked.example"] = "v=DKIM1; p="
+	records["s._domainkey.dsa.example"] = "v=DKIM1; k=dsa; p=AAAA"
+	records["s._domainkey.short.example"] = "v=DKIM1; k=ed25519; p=AAAA"
+	for _, domain := range []string{"bad.example", "revoked.example", "dsa.example", "short.example", "none.example"} {
+		_, err := lookupDKIMKey(context.Background(), "s", domain)
+		assert.Error(t, err, domain)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	records["s._domainkey.ok.example"], err = dkimTXTRecord(key.Public())
+	require.NoError(t, err)
+	pub, err := lookupDKIMKey(context.Background(), "s", "ok.example")
+	require.NoError(t, err)
+	assert.Equal(t, key.Public(), pub)
+}
+
+func TestSimpleCanonicalization(t *testing.T) {
+	msg := parseMessage([]byte("Subject:  Hello\n  World \n\nbody  \n\n\n"))
+	assert.Equal(t, "Subject:  Hello\r\n  World ", canonicalize(msg.fields[0], canonicalizationSimple))
+	assert.Equal(t, "subject:Hello World", canonicalize(msg.fields[0], "relaxed"))
+	assert.Equal(t, "body  \r\n", string(simpleBody(msg.body)))
+	assert.Equal(t, "\r\n", string(simpleBody(nil)))
+}
+
+func TestVerifyMessageSignature_DefaultCanonicalization(t *testing.T) {
+	records := fakeKeyRecords(t)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	records["arc._domainkey.relay1.example"], err = dkimTXTRecord(key.Public())
+	require.NoError(t, err)
+
+	// without c=, header and body are signed with simple canonicalization
+	msg := parseMessage([]byte("From: App <app@example.com>\r\nSubject:  spaced  out \r\n\r\nbody  \r\n\r\n"))
+	bodyHash := sha256.Sum256(simpleBody(msg.body))
+	value := "i=1; a=" + dkimAlgorithmEd + "; d=relay1.example; s=arc; h=From:Subject; bh=" +
+		base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+	fields := []string{
+		canonicalize(msg.fields[0], canonicalizationSimple),
+		canonicalize(msg.fields[1], canonicalizationSimple),
+	}
+	digest := headerDigest(fields, canonicalize(msg.newField(arcMessageSignatureHeader, value), canonicalizationSimple))
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest))
+	f := msg.newField(arcMessageSignatureHeader, value+sig)
+	assert.NoError(t, verifyMessageSignature(context.Background(), msg, f))
+}
+
+func TestWithoutSignature(t *testing.T) {
+	f := parseMessage([]byte("ARC-Seal: i=1; bh=abc=; b=sig\n\tmore==;\n\tcv=none\n\n")).fields[0]
+	assert.Equal(t, "ARC-Seal: i=1; bh=abc=; b=;\n\tcv=none\n", string(withoutSignature(f).raw))
+}
+
+func TestARCConfig_Validate(t *testing.T) {
+	valid := arcConfig{dkimConfig: dkimConfig{Domain: "example.com", Selector: "arc", KeyFile: "/etc/arc.pem"}}
+	require.NoError(t, valid.validate())
+
+	bad := valid
+	bad.Headers = []string{"From", "ARC-Seal"}
+	assert.Error(t, bad.validate())
+	bad = valid
+	bad.AuthservID = "relay example"
+	assert.Error(t, bad.validate())
+	bad = valid
+	bad.Selector = ""
+	assert.Error(t, bad.validate())
+}
+
+func TestArcSealer_TooLong(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := newDKIMSigner(&dkimConfig{Domain: "example.com", Selector: "arc"}, key)
+	require.NoError(t, err)
+	sealer := &arcSealer{signer: signer, authservID: "example.com"}
+
+	msg := parseMessage([]byte(strings.Repeat("ARC-Seal: i=1\n", arcMaxInstances) + "\nbody\n"))
+	assert.EqualError(t, sealer.seal(msg, nil, arcFail, "192.0.2.1", time.Now()),
+		"550 5.7.29 ARC chain is too long to seal", "the message is rejected for good")
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	archiveFormatMaildir = "maildir"
+	archiveFormatMbox    = "mbox"
+
+	// archiveDateLayout organizes the archive in a folder per day.
+	archiveDateLayout = "2006/01/02"
+
+	mboxExt = ".mbox"
+	gzipExt = ".gz"
+
+	// archivePruneInterval is how often archived days past the retention
+	// period are removed.
+	archivePruneInterval = time.Hour
+)
+
+// archiveConfig keeps a copy of every relayed message in a Maildir or mbox
+// below Path, in a folder per day. Days older than RetentionDays are removed,
+// none if 0. Compress gzips the archived messages.
+type archiveConfig struct {
+	Path          string `json:"path"`
+	Format        string `json:"format"`
+	RetentionDays int    `json:"retention_days"`
+	Compress      bool   `json:"compress"`
+}
+
+func (c *archiveConfig) validate() error {
+	if !filepath.IsAbs(c.Path) {
+		return errors.New("archive: path must be absolute")
+	}
+	switch c.Format {
+	case "", archiveFormatMaildir, archiveFormatMbox:
+	default:
+		return fmt.Errorf("archive: unknown format %q", c.Format)
+	}
+	if c.RetentionDays < 0 {
+		return errors.New("archive: retention_days must not be negative")
+	}
+	return nil
+}
+
+// archiver writes messages to the archive.
+type archiver struct {
+	config *archiveConfig
+	w      *mailboxWriter
+}
+
+func newArchiver(c *archiveConfig) *archiver {
+	return &archiver{config: c, w: newMailboxWriter(c.Compress)}
+}
+
+// archive writes the message to the folder of the day and returns the path
+// of the Maildir file or mbox written.
+func (a *archiver) archive(e *mail.Envelope, now time.Time) (string, error) {
+	data := archivedMessage(e, now)
+	dir := filepath.Join(a.config.Path, filepath.FromSlash(now.Format(archiveDateLayout)))
+	if a.config.Format == archiveFormatMbox {
+		path := dir + mboxExt
+		if a.config.Compress {
+			path += gzipExt
+		}
+		return path, a.w.appendMbox(path, e.MailFrom.String(), data, now)
+	}
+	return a.w.deliverMaildir(dir, data, now)
+}
+
+// archivedMessage returns the message with LF line endings and the envelope
+// recorded in header fields.
+func archivedMessage(e *mail.Envelope, now time.Time) []byte {
+	msg := parseMessage(bytes.ReplaceAll(e.Data.Bytes(), []byte("\r\n"), []byte("\n")))
+	msg.eol = "\n"
+	fields := []headerField{
+		msg.newField("X-Mailrelay-Relay-ID", e.QueuedId),
+		msg.newField("X-Mailrelay-Client", e.RemoteIP+" ("+e.Helo+")"),
+		msg.newField("X-Mailrelay-Envelope-From", "<"+e.MailFrom.String()+">"),
+	}
+	for _, rcpt := range e.RcptTo {
+		fields = append(fields, msg.newField("X-Mailrelay-Envelope-To", "<"+rcpt.String()+">"))
+	}
+	fields = append(fields, msg.newField("X-Mailrelay-Archived", now.Format(time.RFC1123Z)))
+	msg.fields = append(fields, msg.fields...)
+	return msg.bytes()
+}
+
+// prune removes the days that are past the retention period and returns how
+// many it removed. Year and month folders left empty are removed too.
+func (a *archiver) prune(now time.Time) (int, error) {
+	if a.config.RetentionDays == 0 {
+		return 0, nil
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	cutoff := today.AddDate(0, 0, -a.config.RetentionDays)
+	months, err := filepath.Glob(filepath.Join(a.config.Path, "[0-9][0-9][0-9][0-9]", "[0-9][0-9]"))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	var errs []error
+	for _, month := range months {
+		n, err := pruneMonth(month, cutoff)
+		removed += n
+		if err == nil {
+			err = removeEmpty(month)
+		}
+		if err == nil {
+			err = removeEmpty(filepath.Dir(month))
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// pruneMonth removes the days of a month folder before cutoff.
+func pruneMonth(month string, cutoff time.Time) (int, error) {
+	entries, err := os.ReadDir(month)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		day, ok := archivedDay(month, entry.Name(), cutoff.Location())
+		if !ok || !day.Before(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(month, entry.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// removeEmpty removes dir if it is empty.
+func removeEmpty(dir string) error {
+	entries, err := os.ReadDir(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil
+	case err != nil:
+		return err
+	case len(entries) > 0:
+		return nil
+	}
+	return os.Remove(dir)
+}
+
+// archivedDay returns the day of an archive folder or mbox file.
+func archivedDay(month, name string, loc *time.Location) (time.Time, bool) {
+	day := strings.TrimSuffix(strings.TrimSuffix(name, gzipExt), mboxExt)
+	if _, err := strconv.Atoi(day); err != nil {
+		return time.Time{}, false
+	}
+	date := filepath.ToSlash(filepath.Join(filepath.Base(filepath.Dir(month)), filepath.Base(month), day))
+	t, err := time.ParseInLocation(archiveDateLayout, date, loc)
+	return t, err == nil
+}
+
+// startPruning prunes the archive periodically. It returns a function that
+// stops pruning.
+func (a *archiver) startPruning(interval time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				removed, err := a.prune(time.Now())
+				if err != nil {
+					Logger.WithError(err).Error("pruning archive")
+				}
+				if removed > 0 {
+					Logger.Infof("pruned %d days from archive", removed)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// archiveProcessor decorator keeps a copy of each message before it is
+// relayed. Messages that cannot be archived are not relayed, so that nothing
+// leaves the relay without a copy.
+var archiveProcessor = func() backends.Decorator {
+	var a *archiver
+	stop := func() {}
+	initFunc := backends.InitializeWith(func(backendConfig backends.BackendConfig) error {
+		stop()
+		a = nil
+		if c, ok := backendConfig["archive"].(*archiveConfig); ok && c != nil {
+			a = newArchiver(c)
+			stop = a.startPruning(archivePruneInterval)
+		}
+		return nil
+	})
+	backends.Svc.AddInitializer(initFunc)
+	backends.Svc.AddShutdowner(backends.ShutdownWith(func() error {
+		stop()
+		stop = func() {}
+		return nil
+	}))
+
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task != backends.TaskSaveMail || a == nil {
+					return p.Process(e, task)
+				}
+				path, err := a.archive(e, time.Now())
+				if err != nil {
+					msgLog(e).WithError(err).Error("archiving message")
+					err = errors.New("451 4.3.0 Could not archive message, try again later")
+					return backends.NewResult(err.Error()), err
+				}
+				msgLog(e).Debugf("archived to %s", path)
+				return p.Process(e, task)
+			},
+		)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jpillora/ipfilter"
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func archiveTestEnvelope(body string) *mail.Envelope {
+	e := mail.NewEnvelope("192.0.2.10", 1)
+	e.QueuedId = "0123456789ABCDEF"
+	e.Helo = "printer.lan"
+	e.MailFrom = mail.Address{User: "scanner", Host: "example.com"}
+	e.RcptTo = []mail.Address{{User: "a", Host: "example.com"}, {User: "b", Host: "example.com"}}
+	e.Data.WriteString("Subject: scan\r\n\r\n" + body)
+	return e
+}
+
+func readArchived(t *testing.T, path string, compressed bool) string {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var r io.Reader = f
+	if compressed {
+		zr, err := gzip.NewReader(f)
+		require.NoError(t, err)
+		r = zr
+	}
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestArchive_Maildir(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		a := newArchiver(&archiveConfig{Path: dir, Compress: compress})
+		now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+		path, err := a.archive(archiveTestEnvelope("page 1\r\n"), now)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, "2024", "03", "01", "new"), filepath.Dir(path))
+		for _, sub := range []string{"tmp", "cur"} {
+			entries, err := os.ReadDir(filepath.Join(dir, "2024", "03", "01", sub))
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+		}
+		assert.Equal(t, "X-Mailrelay-Relay-ID: 0123456789ABCDEF\n"+
+			"X-Mailrelay-Client: 192.0.2.10 (printer.lan)\n"+
+			"X-Mailrelay-Envelope-From: <scanner@example.com>\n"+
+			"X-Mailrelay-Envelope-To: <a@example.com>\n"+
+			"X-Mailrelay-Envelope-To: <b@example.com>\n"+
+			"X-Mailrelay-Archived: Fri, 01 Mar 2024 12:00:00 +0000\n"+
+			"Subject: scan\n\npage 1\n", readArchived(t, path, compress))
+
+		other, err := a.archive(archiveTestEnvelope("page 2\r\n"), now)
+		require.NoError(t, err)
+		assert.NotEqual(t, path, other, "each message gets its own file")
+	}
+}
+
+func TestArchive_Mbox(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		a := newArchiver(&archiveConfig{Path: dir, Format: archiveFormatMbox, Compress: compress})
+		now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+		path, err := a.archive(archiveTestEnvelope("From here\r\n>From there\r\nno newline"), now)
+		require.NoError(t, err)
+		bounce := archiveTestEnvelope("bounce\r\n")
+		bounce.MailFrom = mail.Address{}
+		second, err := a.archive(bounce, now.Add(time.Minute))
+		require.NoError(t, err)
+
+		expected := filepath.Join(dir, "2024", "03", "01.mbox")
+		if compress {
+			expected += gzipExt
+		}
+		assert.Equal(t, expected, path)
+		assert.Equal(t, path, second, "messages of a day share the mbox")
+		mbox := readArchived(t, path, compress)
+		assert.Contains(t, mbox, "From scanner@example.com Fri Mar  1 12:00:00 2024\nX-Mailrelay-Relay-ID:")
+		assert.Contains(t, mbox, "Subject: scan\n\n>From here\n>>From there\nno newline\n\n"+
+			"From MAILER-DAEMON Fri Mar  1 12:01:00 2024\n")
+		assert.Contains(t, mbox, "X-Mailrelay-Envelope-From: <>\n")
+		assert.Regexp(t, "bounce\n\n$", mbox)
+	}
+}
+
+func TestArchive_Prune(t *testing.T) {
+	dir := t.TempDir()
+	a := newArchiver(&archiveConfig{Path: dir, RetentionDays: 30})
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	for _, day := range []time.Time{
+		now.AddDate(0, 0, -90), // 2023/12/02
+		now.AddDate(0, 0, -31), // 2024/01/30
+		now.AddDate(0, 0, -30), // 2024/01/31
+		now,
+	} {
+		_, err := a.archive(archiveTestEnvelope("body\r\n"), day)
+		require.NoError(t, err)
+	}
+	mbox := newArchiver(&archiveConfig{Path: dir, Format: archiveFormatMbox})
+	_, err := mbox.archive(archiveTestEnvelope("body\r\n"), now.AddDate(0, 0, -40))
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "2024", "01", "notes"), mailboxDirMode))
+
+	removed, err := a.prune(now)
+	require.NoError(t, err)
+	assert.Equal(t, 3, removed)
+	assert.NoDirExists(t, filepath.Join(dir, "2023"), "empty folders are removed")
+	assert.NoDirExists(t, filepath.Join(dir, "2024", "01", "30"))
+	assert.NoFileExists(t, filepath.Join(dir, "2024", "01", "21.mbox"))
+	assert.DirExists(t, filepath.Join(dir, "2024", "01", "31"))
+	assert.DirExists(t, filepath.Join(dir, "2024", "01", "notes"), "other files are left alone")
+	assert.DirExists(t, filepath.Join(dir, "2024", "03", "01"))
+
+	removed, err = newArchiver(&archiveConfig{Path: dir}).prune(now.AddDate(10, 0, 0))
+	require.NoError(t, err)
+	assert.Zero(t, removed, "archives are kept forever without retention_days")
+}
+
+func TestArchive_Failure(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, mailboxFileMode))
+	_, err := newArchiver(&archiveConfig{Path: file}).archive(archiveTestEnvelope("body\r\n"), time.Now())
+	assert.Error(t, err)
+}
+
+func TestArchiveConfig_Validate(t *testing.T) {
+	require.NoError(t, (&archiveConfig{Path: "/var/lib/mailrelay/archive"}).validate())
+	require.NoError(t, (&archiveConfig{Path: "/archive", Format: archiveFormatMbox, RetentionDays: 365}).validate())
+	assert.Error(t, (&archiveConfig{Path: "archive"}).validate())
+	assert.Error(t, (&archiveConfig{Path: "/archive", Format: "pst"}).validate())
+	assert.Error(t, (&archiveConfig{Path: "/archive", RetentionDays: -1}).validate())
+}
+
+func TestArchive_DisallowedSender(t *testing.T) {
+	setupTestLogger(t)
+	AllowedSendersFilter = ipfilter.New(ipfilter.Options{AllowedIPs: []string{"192.0.2.0/24"}, BlockByDefault: true})
+	defer func() { AllowedSendersFilter = ipfilter.New(ipfilter.Options{}) }()
+
+	appConfig := &mailRelayConfig{}
+	configDefaults(appConfig)
+	appConfig.SMTPServer = "127.0.0.1"
+	appConfig.Archive = &archiveConfig{Path: t.TempDir()}
+	require.NoError(t, validateConfig(appConfig))
+
+	sub := &sendmailSubmission{
+		sender:     "scanner@example.com",
+		recipients: []string{"a@example.com"},
+		data:       []byte("Subject: scan\n\nbody\n"),
+	}
+	err := submitDirect(appConfig, sub)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "554 5.7.1")
+	entries, err := os.ReadDir(appConfig.Archive.Path)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "messages that may not be relayed are not archived")
+}
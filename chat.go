@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	deliverySlack      = "slack"
+	deliveryTeams      = "teams"
+	deliveryMattermost = "mattermost"
+
+	// maxChatText limits the length of chat messages in characters.
+	maxChatText = 4000
+
+	adaptiveCardType    = "application/vnd.microsoft.card.adaptive"
+	adaptiveCardVersion = "1.4"
+)
+
+// defaultChatTemplates render the subject in bold followed by the text body.
+var defaultChatTemplates = map[string]string{
+	deliverySlack:      "*{{.Subject}}*\n{{.Text}}",
+	deliveryTeams:      "**{{.Subject}}**\n\n{{.Text}}",
+	deliveryMattermost: "**{{.Subject}}**\n{{.Text}}",
+}
+
+// slackEscaper escapes the characters that Slack reserves for links and
+// mentions.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackMessage is the payload of Slack and Mattermost incoming webhooks.
+type slackMessage struct {
+	Text     string `json:"text"`
+	Channel  string `json:"channel,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+// teamsMessage is the payload of Teams incoming webhooks and workflows, a
+// message with an Adaptive Card.
+type teamsMessage struct {
+	Type        string            `json:"type"`
+	Attachments []teamsAttachment `json:"attachments"`
+}
+
+type teamsAttachment struct {
+	ContentType string    `json:"contentType"`
+	Content     teamsCard `json:"content"`
+}
+
+type teamsCard struct {
+	Schema  string           `json:"$schema"`
+	Type    string           `json:"type"`
+	Version string           `json:"version"`
+	Body    []teamsTextBlock `json:"body"`
+}
+
+type teamsTextBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+	Wrap bool   `json:"wrap"`
+}
+
+// validateChat validates the settings of chat deliveries.
+func (c *deliveryConfig) validateChat() error {
+	if err := c.validateWebhook(); err != nil {
+		return err
+	}
+	tmpl, err := c.chatTemplate()
+	if err == nil {
+		// catch references to fields that do not exist
+		err = tmpl.Execute(io.Discard, &webhookPayload{messageContent: &messageContent{}})
+	}
+	if err != nil {
+		return fmt.Errorf("%s delivery: %w", c.Type, err)
+	}
+	return nil
+}
+
+// chatTemplate returns the template rendering chat messages.
+func (c *deliveryConfig) chatTemplate() (*template.Template, error) {
+	text := c.Template
+	if text == "" {
+		text = defaultChatTemplates[c.Type]
+	}
+	return template.New(c.Type).Parse(text)
+}
+
+// renderChat renders the chat message for the message. The template is
+// executed with the webhook payload; for Slack, the subject and text body are
+// escaped.
+func (d *localDelivery) renderChat(e *mail.Envelope, now time.Time) (string, error) {
+	tmpl, err := d.config.chatTemplate()
+	if err != nil {
+		return "", err
+	}
+	p := newWebhookPayload(e, d.rcpts, false, now)
+	if d.config.Type == deliverySlack {
+		p.Subject = slackEscaper.Replace(p.Subject)
+		p.Text = slackEscaper.Replace(p.Text)
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, p); err != nil {
+		return "", err
+	}
+	text := []rune(strings.TrimSpace(buf.String()))
+	if len(text) > maxChatText {
+		text = append(text[:maxChatText-1], '…')
+	}
+	return string(text), nil
+}
+
+// postChat posts the message to a chat webhook.
+func (d *localDelivery) postChat(e *mail.Envelope, now time.Time) error {
+	text, err := d.renderChat(e, now)
+	if err != nil {
+		return err
+	}
+	var payload any = slackMessage{Text: text, Channel: d.config.Channel, Username: d.config.Username}
+	if d.config.Type == deliveryTeams {
+		payload = teamsMessage{
+			Type: "message",
+			Attachments: []teamsAttachment{{
+				ContentType: adaptiveCardType,
+				Content: teamsCard{
+					Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+					Type:    "AdaptiveCard",
+					Version: adaptiveCardVersion,
+					Body:    []teamsTextBlock{{Type: "TextBlock", Text: text, Wrap: true}},
+				},
+			}},
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return d.postJSON(e, body)
+}
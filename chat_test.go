@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func chatTestMessage() []byte {
+	return []byte("Subject: UPS <ups1> on battery\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nOn battery since 10:02 & load 80%\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>On battery</p>\r\n--b--\r\n")
+}
+
+func TestChatDelivery(t *testing.T) {
+	setupTestLogger(t)
+	tests := []struct {
+		config   *deliveryConfig
+		expected string
+	}{
+		{
+			config:   &deliveryConfig{Type: deliverySlack},
+			expected: `{"text":"*UPS &lt;ups1&gt; on battery*\nOn battery since 10:02 &amp; load 80%"}`,
+		},
+		{
+			config: &deliveryConfig{Type: deliveryMattermost, Channel: "ops", Username: "mailrelay",
+				Template: "{{.Subject}} ({{.From}} via {{.Client.IP}})"},
+			expected: `{"text":"UPS <ups1> on battery (scanner@lan via 10.0.5.20)",` +
+				`"channel":"ops","username":"mailrelay"}`,
+		},
+		{
+			config: &deliveryConfig{Type: deliveryTeams},
+			expected: `{"type":"message","attachments":[{"contentType":"application/vnd.microsoft.card.adaptive",` +
+				`"content":{"$schema":"http://adaptivecards.io/schemas/adaptive-card.json","type":"AdaptiveCard",` +
+				`"version":"1.4","body":[{"type":"TextBlock","text":"**UPS <ups1> on battery**\n\n` +
+				`On battery since 10:02 & load 80%","wrap":true}]}}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.config.Type, func(t *testing.T) {
+			srv, requests, bodies := startWebhook(t)
+			tt.config.URL = srv.URL
+			e := deliverTestEnvelope("ups@events.lan")
+			e.Data.Reset()
+			e.Data.Write(chatTestMessage())
+
+			relay, err := deliverLocally(e, webhookRoutes(tt.config), newMailboxWriter(false), newDestinationStatus(),
+				time.Now())
+			require.NoError(t, err)
+			assert.Empty(t, relay)
+			require.Len(t, *requests, 1)
+			assert.Equal(t, "application/json", (*requests)[0].Header.Get("Content-Type"))
+			assert.JSONEq(t, tt.expected, string((*bodies)[0]))
+		})
+	}
+}
+
+func TestChatDelivery_Truncated(t *testing.T) {
+	e := deliverTestEnvelope("ups@events.lan")
+	e.Data.Reset()
+	e.Data.WriteString("Subject: log\r\n\r\n" + strings.Repeat("ü", 2*maxChatText))
+	d := &localDelivery{config: &deliveryConfig{Type: deliveryMattermost, Template: "{{.Text}}"}}
+
+	text, err := d.renderChat(e, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, maxChatText, len([]rune(text)))
+	assert.True(t, strings.HasSuffix(text, "ü…"))
+}
+
+func TestChatDelivery_Routing(t *testing.T) {
+	setupTestLogger(t)
+	ops, opsRequests, opsBodies := startWebhook(t)
+	facilities, facilitiesRequests, _ := startWebhook(t)
+	routes := []*routeConfig{
+		{Name: "ops", Senders: []string{"ups@*"}, Recipients: []string{"*@chat.lan"},
+			Delivery: &deliveryConfig{Type: deliverySlack, URL: ops.URL}},
+		{Name: "facilities", Recipients: []string{"*@chat.lan"},
+			Delivery: &deliveryConfig{Type: deliverySlack, URL: facilities.URL}},
+	}
+	e := deliverTestEnvelope("alerts@chat.lan", "oncall@chat.lan")
+	e.MailFrom.User = "ups"
+
+	_, err := deliverLocally(e, routes, newMailboxWriter(false), newDestinationStatus(), time.Now())
+	require.NoError(t, err)
+	require.Len(t, *opsRequests, 1, "recipients of a channel get a single post")
+	assert.Empty(t, *facilitiesRequests)
+	var msg slackMessage
+	require.NoError(t, json.Unmarshal((*opsBodies)[0], &msg))
+	assert.Equal(t, "*scan*\nFrom the scanner", msg.Text)
+
+	e.MailFrom.User = "hvac"
+	_, err = deliverLocally(e, routes, newMailboxWriter(false), newDestinationStatus(), time.Now())
+	require.NoError(t, err)
+	assert.Len(t, *facilitiesRequests, 1)
+}
+
+func TestDeliveryConfig_ValidateChat(t *testing.T) {
+	url := "https://hooks.slack.com/services/T0/B0/X"
+	assert.NoError(t, (&deliveryConfig{Type: deliverySlack, URL: url}).validate())
+	assert.NoError(t, (&deliveryConfig{Type: deliveryTeams, URL: url, Template: "{{.Subject}}: {{.To}}"}).validate())
+	assert.Error(t, (&deliveryConfig{Type: deliveryMattermost}).validate())
+	assert.Error(t, (&deliveryConfig{Type: deliverySlack, URL: url, Template: "{{.Subject"}).validate())
+	assert.Error(t, (&deliveryConfig{Type: deliverySlack, URL: url, Template: "{{.Body}}"}).validate())
+}
@@ -27,17 +27,18 @@ func sendMail(e *mail.Envelope, config *relayConfig) error {
 	msg.Write(e.Data.Bytes())
 	msg.WriteString("\r\n")
 
-	Logger.Infof("starting email send -- from:%s, starttls:%t", e.MailFrom.String(), config.STARTTLS)
-	Logger.Infof("Client Remote IP: %s", e.RemoteIP)
+	msgLog(e).Infof("starting email send -- from:%s, starttls:%t", e.MailFrom.String(), config.STARTTLS)
+	msgLog(e).Infof("Client Remote IP: %s", e.RemoteIP)
 
 	var err error
 	var conn net.Conn
 	var client *smtp.Client
 	var writer io.WriteCloser
 
-	if AllowedSendersFilter.Blocked(e.RemoteIP) {
-		Logger.Info("Remote IP of " + e.RemoteIP + " not allowed to send email.")
-		return errors.New("Remote IP of " + e.RemoteIP + " not allowed to send email.")
+	if !senderAllowed(e) {
+		err := senderNotAllowed(e)
+		msgLog(e).Info(err.Error())
+		return err
 	}
 
 	tlsconfig := &tls.Config{
@@ -69,7 +70,10 @@ func sendMail(e *mail.Envelope, config *relayConfig) error {
 		}
 	}(&shouldCloseClient)
 
-	if err = handshake(client, config, tlsconfig); err != nil {
+	if err = handshake(client, config, tlsconfig); err == nil && config.XForward {
+		err = sendXForward(client, e)
+	}
+	if err != nil {
 		return err
 	}
 
@@ -98,7 +102,7 @@ func sendMail(e *mail.Envelope, config *relayConfig) error {
 	// We only need to close client if some other error prevented us
 	// from getting to `client.Quit`
 	shouldCloseClient = false
-	Logger.Info("email sent with no errors.")
+	msgLog(e).Info("email sent with no errors.")
 	return nil
 }
 
@@ -153,6 +157,25 @@ func isQuitError(err error) bool {
 	return true
 }
 
+// relayError returns the reply for a failure to relay a message. Replies of
+// the upstream server are passed on as temporary or permanent failures
+// according to their class, and network errors are temporary failures.
+func relayError(err error) error {
+	var reply *textproto.Error
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &reply) && reply.Code/100 == 4:
+		return fmt.Errorf("451 4.4.0 Upstream server replied: %d %s", reply.Code, reply.Msg)
+	case errors.As(err, &reply) && reply.Code/100 == 5:
+		return fmt.Errorf("554 5.0.0 Upstream server replied: %d %s", reply.Code, reply.Msg)
+	case errors.As(err, &netErr):
+		return errors.New("451 4.4.1 Could not reach upstream server, try again later")
+	}
+	return err
+}
+
 // getTo returns the array of email addresses in the envelope.
 func getTo(e *mail.Envelope) []string {
 	if len(e.RcptTo) == 0 {
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"net"
 	"net/textproto"
+	"syscall"
 	"testing"
 
 	"github.com/phires/go-guerrilla/mail"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -103,3 +106,39 @@ func TestIsQuitError(t *testing.T) {
 		})
 	}
 }
+
+func TestRelayError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{
+			name:     "temporary reply",
+			err:      errors.Wrap(&textproto.Error{Code: 452, Msg: "4.2.2 Mailbox full"}, "rcpt error"),
+			expected: "451 4.4.0 Upstream server replied: 452 4.2.2 Mailbox full",
+		},
+		{
+			name:     "permanent reply",
+			err:      errors.Wrap(&textproto.Error{Code: 550, Msg: "5.1.1 No such user"}, "rcpt error"),
+			expected: "554 5.0.0 Upstream server replied: 550 5.1.1 No such user",
+		},
+		{
+			name:     "network error",
+			err:      errors.Wrap(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, "dial error"),
+			expected: "451 4.4.1 Could not reach upstream server, try again later",
+		},
+		{
+			name:     "rejected sender",
+			err:      senderNotAllowed(mail.NewEnvelope("192.0.2.1", 1)),
+			expected: "554 5.7.1 Remote IP of 192.0.2.1 not allowed to send email",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.EqualError(t, relayError(tt.err), tt.expected)
+		})
+	}
+	assert.NoError(t, relayError(nil))
+}
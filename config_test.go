@@ -95,3 +95,83 @@ func TestLoadConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadConfig_Rewriting(t *testing.T) {
+	cfg, err := loadConfig("testdata/rewrite.json")
+	require.NoError(t, err)
+
+	require.NotNil(t, cfg.RewriteFrom)
+	assert.Equal(t, "username@fastmail.com", cfg.RewriteFrom.Address)
+	assert.True(t, cfg.RewriteFrom.KeepName)
+	assert.Equal(t, "scanner@fastmail.com", cfg.RewriteFrom.Sources["192.168.1.50"].Address)
+
+	require.Len(t, cfg.Routes, 1)
+	assert.Equal(t, "alerts", cfg.Routes[0].Name)
+	assert.Equal(t, []string{"*@ops.example.com"}, cfg.Routes[0].Recipients)
+	assert.Equal(t, "alerts@fastmail.com", cfg.Routes[0].RewriteFrom.Address)
+}
+
+func TestValidateConfig_Rewriting(t *testing.T) {
+	cfg := mailRelayConfig{}
+	configDefaults(&cfg)
+	cfg.SMTPServer = "smtp.test.com"
+
+	cfg.RewriteFrom = &fromRewriteConfig{Address: "not-an-address"}
+	assert.Error(t, validateConfig(&cfg))
+
+	cfg.RewriteFrom = nil
+	cfg.Routes = []*routeConfig{{Name: "bad", Sources: []string{"300.1.1.1"}}}
+	assert.Error(t, validateConfig(&cfg))
+}
+
+func TestValidateConfig_UnixSocket(t *testing.T) {
+	cfg := mailRelayConfig{}
+	configDefaults(&cfg)
+	cfg.SMTPServer = "smtp.test.com"
+
+	cfg.LocalListenPort = 0
+	assert.Error(t, validateConfig(&cfg), "port 0 needs a unix socket")
+
+	cfg.UnixSocket = &unixSocketConfig{Path: "/run/mailrelay.sock"}
+	assert.NoError(t, validateConfig(&cfg))
+
+	cfg.UnixSocket.Mode = "0999"
+	assert.Error(t, validateConfig(&cfg))
+}
+
+func TestValidateConfig_Privileges(t *testing.T) {
+	cfg := mailRelayConfig{}
+	configDefaults(&cfg)
+	cfg.SMTPServer = "smtp.test.com"
+
+	cfg.Group = "mail"
+	assert.Error(t, validateConfig(&cfg), "group requires user")
+
+	cfg.User = "mailrelay"
+	assert.NoError(t, validateConfig(&cfg))
+
+	cfg.Chroot = "/var/lib/mailrelay"
+	cfg.Routes = []*routeConfig{{Name: "alerts", Recipients: []string{"*@alerts.lan"},
+		Delivery: &deliveryConfig{Type: deliveryWebhook, URL: "https://hooks.example.com/alerts"}}}
+	assert.NoError(t, validateConfig(&cfg))
+
+	cfg.RecipientMap = "/etc/mailrelay/recipients"
+	cfg.Archive = &archiveConfig{Path: "/var/lib/mailrelay/archive"}
+	cfg.UnixSocket = &unixSocketConfig{Path: "/run/mailrelay.sock"}
+	cfg.Routes = append(cfg.Routes, &routeConfig{Name: "mailboxes", Recipients: []string{"*@lan"},
+		Delivery: &deliveryConfig{Type: deliveryMaildir, Path: "/var/mail/{user}"}})
+	assert.EqualError(t, validateConfig(&cfg), "chroot cannot be combined with recipient_map, archive, "+
+		"unix_socket, maildir delivery of route \"mailboxes\"")
+}
+
+func TestValidateConfig_Transport(t *testing.T) {
+	cfg := mailRelayConfig{}
+	configDefaults(&cfg)
+	assert.Error(t, validateConfig(&cfg), "smtp_server or transport is required")
+
+	cfg.Transport = &transportConfig{Type: transportGraph, TenantID: "contoso", ClientID: "app", RefreshToken: "token"}
+	assert.NoError(t, validateConfig(&cfg))
+
+	cfg.Transport.ClientID = ""
+	assert.Error(t, validateConfig(&cfg))
+}
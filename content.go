@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	mediaTypeText = "text/plain"
+	mediaTypeHTML = "text/html"
+)
+
+// messageContent is the content of a message for consumers that do not read
+// MIME: decoded header fields, the text and HTML bodies and the attachments.
+type messageContent struct {
+	Subject     string               `json:"subject"`
+	Headers     []contentHeader      `json:"headers"`
+	Text        string               `json:"text"`
+	HTML        string               `json:"html"`
+	Attachments []*contentAttachment `json:"attachments"`
+}
+
+type contentHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type contentAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	Content     []byte `json:"content,omitempty"`
+}
+
+// headerDecoder decodes RFC 2047 encoded words in any charset of the WHATWG
+// Encoding Standard.
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := lookupCharset(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// parseContent returns the content of message data. The first text and HTML
+// parts that are not attachments make up the bodies, all other parts are
+// attachments. Text is converted to UTF-8 with LF line endings.
+func parseContent(data []byte) *messageContent {
+	msg := parseMessage(data)
+	c := &messageContent{Headers: []contentHeader{}, Attachments: []*contentAttachment{}}
+	for _, f := range msg.fields {
+		c.Headers = append(c.Headers, contentHeader{Name: f.name, Value: decodeHeaderValue(f.value())})
+	}
+	c.Subject = decodeHeaderValue(msg.get("Subject"))
+	c.addEntity(msg, 0)
+	return c
+}
+
+// addEntity adds the content of a message or a body part.
+func (c *messageContent) addEntity(msg *message, depth int) {
+	mediaType, params := mediaTypeText, map[string]string{}
+	if ct := msg.get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(ct); err != nil {
+			mediaType = "application/octet-stream"
+		}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < maxMIMEDepth {
+		for _, seg := range splitMultipart(msg.body, params["boundary"]) {
+			if seg.part {
+				c.addEntity(parseMessage(seg.data), depth+1)
+			}
+		}
+		return
+	}
+
+	body, err := decodeTransferEncoding(msg.body, strings.ToLower(msg.get("Content-Transfer-Encoding")))
+	if err != nil {
+		body = msg.body
+	}
+	disposition, dparams, _ := mime.ParseMediaType(msg.get("Content-Disposition"))
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	inline := disposition != "attachment" && filename == ""
+	switch {
+	case inline && mediaType == mediaTypeText && c.Text == "":
+		c.Text = decodeBody(body, params["charset"])
+	case inline && mediaType == mediaTypeHTML && c.HTML == "":
+		c.HTML = decodeBody(body, params["charset"])
+	default:
+		c.Attachments = append(c.Attachments, &contentAttachment{
+			Filename:    decodeHeaderValue(filename),
+			ContentType: mediaType,
+			Size:        len(body),
+			Content:     body,
+		})
+	}
+}
+
+// decodeBody returns a text body as UTF-8 with LF line endings.
+func decodeBody(body []byte, label string) string {
+	t := &transcoder{fallback: defaultFallbackCharset}
+	text, err := toUTF8(body, t.charset(body, label))
+	if err != nil {
+		text = decodeText(body)
+	}
+	return strings.ReplaceAll(text, "\r\n", "\n")
+}
+
+// decodeHeaderValue decodes the encoded words and raw 8-bit text of a header
+// field value.
+func decodeHeaderValue(v string) string {
+	if !utf8.ValidString(v) {
+		v = decodeText([]byte(v))
+	}
+	if s, err := headerDecoder.DecodeHeader(v); err == nil {
+		return s
+	}
+	return v
+}
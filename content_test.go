@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseContent(t *testing.T) {
+	data := "Subject: =?iso-8859-1?q?UPS_auf_Batterie_=E4?=\r\n" +
+		"From: ups@lan\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Gr=FC=DFe\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<p>Grüße</p>\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain; name=log.txt\r\n" +
+		"\r\n" +
+		"log line\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"JVBERi0=\r\n" +
+		"--outer--\r\n"
+
+	c := parseContent([]byte(data))
+	assert.Equal(t, "UPS auf Batterie ä", c.Subject)
+	assert.Equal(t, []contentHeader{
+		{Name: "Subject", Value: "UPS auf Batterie ä"},
+		{Name: "From", Value: "ups@lan"},
+		{Name: "Content-Type", Value: "multipart/mixed; boundary=outer"},
+	}, c.Headers)
+	assert.Equal(t, "Grüße\n", c.Text)
+	assert.Equal(t, "<p>Grüße</p>\n", c.HTML)
+	require.Len(t, c.Attachments, 2)
+	assert.Equal(t, &contentAttachment{Filename: "log.txt", ContentType: "text/plain", Size: 10,
+		Content: []byte("log line\r\n")}, c.Attachments[0])
+	assert.Equal(t, &contentAttachment{Filename: "report.pdf", ContentType: "application/pdf", Size: 5,
+		Content: []byte("%PDF-")}, c.Attachments[1])
+}
+
+func TestParseContent_Plain(t *testing.T) {
+	c := parseContent([]byte("Subject: Caf\xe9\n\nStromausfall \xfcberbr\xfcckt\n"))
+	assert.Equal(t, "Café", c.Subject)
+	assert.Equal(t, "Stromausfall überbrückt\n", c.Text)
+	assert.Empty(t, c.HTML)
+	assert.Empty(t, c.Attachments)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	deliveryMaildir = "maildir"
+	deliveryMbox    = "mbox"
+	deliveryPipe    = "pipe"
+	deliveryWebhook = "webhook"
+
+	defaultPipeTimeout = time.Minute
+
+	// pipeWaitDelay is how long to wait for the output of a killed command
+	// to close, which its children may hold open.
+	pipeWaitDelay = time.Second
+
+	// exTempFail is the sysexits.h exit status for temporary failures.
+	exTempFail = 75
+
+	// maxPipeOutput limits the command output logged for failed deliveries.
+	maxPipeOutput = 512
+)
+
+// errLocalDelivery is returned for local delivery failures that may succeed
+// later.
+var errLocalDelivery = errors.New("451 4.3.0 Local delivery failed, try again later")
+
+var (
+	// templateField matches the placeholders of delivery paths and commands.
+	templateField = regexp.MustCompile(`\{[^}]*\}`)
+
+	templateFields = map[string]bool{"{user}": true, "{domain}": true, "{rcpt}": true}
+
+	// unsafePathRune matches characters not kept in placeholder values.
+	unsafePathRune = regexp.MustCompile(`[^a-z0-9._+=@-]`)
+)
+
+// deliveryConfig delivers a route's recipients locally instead of relaying
+// them, or in addition to relaying them if Relay is set. Maildir and mbox
+// deliveries write to Path, pipe deliveries run Command with the message on
+// stdin, webhook deliveries post the message as JSON to URL and chat
+// deliveries post it rendered with Template to a chat webhook. Path and
+// Command may contain the placeholders {user}, {domain} and {rcpt}, which are
+// replaced with the recipient's local part, domain and address.
+type deliveryConfig struct {
+	Type        string   `json:"type"`
+	Path        string   `json:"path"`
+	Command     []string `json:"command"`
+	URL         string   `json:"url"`
+	Secret      string   `json:"secret"`
+	Attachments bool     `json:"attachments"`
+	Attempts    int      `json:"attempts"`
+	Template    string   `json:"template"`
+	Channel     string   `json:"channel"`
+	Username    string   `json:"username"`
+	TimeoutSecs int      `json:"timeout_secs"`
+	Relay       bool     `json:"relay"`
+}
+
+func (c *deliveryConfig) validate() error {
+	var templates []string
+	switch c.Type {
+	case deliveryMaildir, deliveryMbox:
+		if !filepath.IsAbs(c.Path) {
+			return fmt.Errorf("%s delivery: path must be absolute", c.Type)
+		}
+		templates = []string{c.Path}
+	case deliveryPipe:
+		if len(c.Command) == 0 || !filepath.IsAbs(c.Command[0]) {
+			return errors.New("pipe delivery: command must start with an absolute path")
+		}
+		templates = c.Command
+	case deliveryWebhook:
+		if err := c.validateWebhook(); err != nil {
+			return err
+		}
+	case deliverySlack, deliveryTeams, deliveryMattermost:
+		if err := c.validateChat(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown delivery type %q", c.Type)
+	}
+	if c.TimeoutSecs < 0 {
+		return fmt.Errorf("%s delivery: timeout_secs must not be negative", c.Type)
+	}
+	for _, t := range templates {
+		for _, field := range templateField.FindAllString(t, -1) {
+			if !templateFields[field] {
+				return fmt.Errorf("%s delivery: unknown placeholder %s", c.Type, field)
+			}
+		}
+	}
+	return nil
+}
+
+// timeout returns the configured timeout, or def if none is.
+func (c *deliveryConfig) timeout(def time.Duration) time.Duration {
+	if c.TimeoutSecs > 0 {
+		return time.Duration(c.TimeoutSecs) * time.Second
+	}
+	return def
+}
+
+// expand replaces the placeholders in template. Values are lowercased and
+// characters that are unsafe in paths replaced with '_'.
+func expand(template string, rcpt mail.Address) string {
+	safe := func(s string) string {
+		s = unsafePathRune.ReplaceAllString(strings.ToLower(s), "_")
+		if strings.HasPrefix(s, ".") {
+			s = "_" + s[1:]
+		}
+		return s
+	}
+	return strings.NewReplacer(
+		"{user}", safe(rcpt.User),
+		"{domain}", safe(rcpt.Host),
+		"{rcpt}", safe(rcpt.String()),
+	).Replace(template)
+}
+
+// localDelivery is a delivery of a message to one or more recipients that
+// share the same mailbox or command.
+type localDelivery struct {
+	config *deliveryConfig
+	target []string
+	rcpts  []mail.Address
+}
+
+// planDeliveries groups the recipients that routes deliver locally by mailbox,
+// command or URL, and returns them along with the recipients to relay.
+func planDeliveries(routes []*routeConfig, e *mail.Envelope) ([]*localDelivery, []mail.Address) {
+	var deliveries []*localDelivery
+	var relay []mail.Address
+	for _, rcpt := range e.RcptTo {
+		route := recipientRoute(routes, e, rcpt)
+		if route == nil || route.Delivery == nil {
+			relay = append(relay, rcpt)
+			continue
+		}
+		c := route.Delivery
+		if c.Relay {
+			relay = append(relay, rcpt)
+		}
+		target := c.target(rcpt)
+		i := 0
+		for i < len(deliveries) && (deliveries[i].config != c || !slices.Equal(deliveries[i].target, target)) {
+			i++
+		}
+		if i == len(deliveries) {
+			deliveries = append(deliveries, &localDelivery{config: c, target: target})
+		}
+		deliveries[i].rcpts = append(deliveries[i].rcpts, rcpt)
+	}
+	return deliveries, relay
+}
+
+// target returns the mailbox, command or webhook the recipient is delivered
+// to.
+func (c *deliveryConfig) target(rcpt mail.Address) []string {
+	switch c.Type {
+	case deliveryPipe:
+		target := make([]string, len(c.Command))
+		for i, arg := range c.Command {
+			target[i] = expand(arg, rcpt)
+		}
+		return target
+	case deliveryWebhook, deliverySlack, deliveryTeams, deliveryMattermost:
+		return []string{c.URL}
+	default:
+		return []string{expand(c.Path, rcpt)}
+	}
+}
+
+// deliver delivers the message locally.
+func (d *localDelivery) deliver(e *mail.Envelope, w *mailboxWriter, now time.Time) error {
+	switch d.config.Type {
+	case deliveryMaildir:
+		_, err := w.deliverMaildir(d.target[0], deliveredMessage(e, d.rcpts), now)
+		return err
+	case deliveryMbox:
+		return w.appendMbox(d.target[0], e.MailFrom.String(), deliveredMessage(e, d.rcpts), now)
+	case deliveryWebhook:
+		return d.postWebhook(e, now)
+	case deliverySlack, deliveryTeams, deliveryMattermost:
+		return d.postChat(e, now)
+	default:
+		return d.pipe(e, deliveredMessage(e, d.rcpts))
+	}
+}
+
+// deliveredMessage returns the message with LF line endings and the
+// Return-Path and Delivered-To fields of a final delivery.
+func deliveredMessage(e *mail.Envelope, rcpts []mail.Address) []byte {
+	msg := parseMessage(bytes.ReplaceAll(e.Data.Bytes(), []byte("\r\n"), []byte("\n")))
+	msg.eol = "\n"
+	fields := []headerField{msg.newField("Return-Path", "<"+e.MailFrom.String()+">")}
+	for _, rcpt := range rcpts {
+		fields = append(fields, msg.newField("Delivered-To", rcpt.String()))
+	}
+	msg.fields = append(fields, msg.fields...)
+	return msg.bytes()
+}
+
+// pipe runs the delivery command with the message on stdin and the envelope
+// in environment variables. Exit status 75 (EX_TEMPFAIL), timeouts and
+// commands that cannot be started are temporary failures, other non-zero
+// exit statuses permanent ones.
+func (d *localDelivery) pipe(e *mail.Envelope, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.config.timeout(defaultPipeTimeout))
+	defer cancel()
+
+	rcpts := make([]string, len(d.rcpts))
+	for i, rcpt := range d.rcpts {
+		rcpts[i] = rcpt.String()
+	}
+	cmd := exec.CommandContext(ctx, d.target[0], d.target[1:]...) //nolint:gosec // the command is configured
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.WaitDelay = pipeWaitDelay
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"MAILRELAY_SENDER=" + e.MailFrom.String(),
+		"MAILRELAY_RECIPIENTS=" + strings.Join(rcpts, " "),
+		"MAILRELAY_CLIENT_IP=" + e.RemoteIP,
+		"MAILRELAY_HELO=" + e.Helo,
+		"MAILRELAY_RELAY_ID=" + e.QueuedId,
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	out := strings.TrimSpace(output.String())
+	if len(out) > maxPipeOutput {
+		out = out[:maxPipeOutput]
+	}
+	msgLog(e).WithError(err).Errorf("delivery command %s failed: %s", d.target[0], out)
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		return errors.New("451 4.3.0 Local delivery timed out")
+	case errors.As(err, &exitErr) && exitErr.ExitCode() > 0 && exitErr.ExitCode() != exTempFail:
+		return fmt.Errorf("554 5.3.0 Local delivery failed (exit status %d)", exitErr.ExitCode())
+	default:
+		return errLocalDelivery
+	}
+}
+
+// deliverLocally delivers the message to the recipients that routes deliver
+// locally, and returns the recipients to relay. Deliveries made are recorded
+// in status, so that when the client retries the message after a failure
+// they are not made again. Shutdown waits for them like for relays.
+func deliverLocally(e *mail.Envelope, routes []*routeConfig, w *mailboxWriter, status *destinationStatus,
+	now time.Time,
+) ([]mail.Address, error) {
+	deliveries, relay := planDeliveries(routes, e)
+	if len(deliveries) > 0 {
+		deliveriesInFlight.Add(1)
+		defer deliveriesInFlight.Add(-1)
+	}
+	key := destinationKey(e)
+	for _, d := range deliveries {
+		name := d.config.Type + " " + strings.Join(d.target, " ")
+		if status.delivered(key, name, now) {
+			msgLog(e).Infof("already delivered to %s %s", d.config.Type, d.target[0])
+			continue
+		}
+		if err := d.deliver(e, w, now); err != nil {
+			if !hasReplyCode(err.Error()) {
+				msgLog(e).WithError(err).Errorf("%s delivery to %s failed", d.config.Type, d.target[0])
+				err = errLocalDelivery
+			}
+			return nil, err
+		}
+		status.update(key, []string{name}, false, now)
+		msgLog(e).Infof("delivered to %s %s for %d recipients", d.config.Type, d.target[0], len(d.rcpts))
+	}
+	return relay, nil
+}
+
+// deliverProcessor decorator delivers the recipients of routes with a
+// delivery locally and passes the others, and those of deliveries that also
+// relay, on to be relayed. Messages without recipients to relay end here.
+// The local deliveries of a message are remembered until it is relayed or
+// rejected for good.
+var deliverProcessor = func() backends.Decorator {
+	var routes []*routeConfig
+	w := newMailboxWriter(false)
+	status := newDestinationStatus()
+	initFunc := backends.InitializeWith(func(backendConfig backends.BackendConfig) error {
+		if r, ok := backendConfig["routes"].([]*routeConfig); ok {
+			routes = r
+		}
+		return nil
+	})
+	backends.Svc.AddInitializer(initFunc)
+
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				// messages from senders that may not relay are rejected by
+				// the peer and relay processors
+				if task != backends.TaskSaveMail || !senderAllowed(e) {
+					return p.Process(e, task)
+				}
+				relay, err := deliverLocally(e, routes, w, status, time.Now())
+				if err != nil {
+					return backends.NewResult(err.Error()), err
+				}
+				key := destinationKey(e)
+				if len(relay) == 0 {
+					status.update(key, nil, true, time.Now())
+					return backends.BackendResultOK, nil
+				}
+				rcpts := e.RcptTo
+				e.RcptTo = relay
+				result, err := p.Process(e, task)
+				e.RcptTo = rcpts
+				status.update(key, nil, err == nil || !isTemporary(err), time.Now())
+				return result, err
+			},
+		)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func deliverTestEnvelope(rcpts ...string) *mail.Envelope {
+	e := mail.NewEnvelope("10.0.5.20", 1)
+	e.QueuedId = "0123456789ABCDEF"
+	e.Helo = "printer.lan"
+	e.MailFrom = mail.Address{User: "scanner", Host: "lan"}
+	for _, r := range rcpts {
+		user, host, _ := strings.Cut(r, "@")
+		e.RcptTo = append(e.RcptTo, mail.Address{User: user, Host: host})
+	}
+	e.Data.WriteString("Subject: scan\r\n\r\nFrom the scanner\r\n")
+	return e
+}
+
+// maildirMessages returns the messages delivered to a Maildir.
+func maildirMessages(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	require.NoError(t, err)
+	var messages []string
+	for _, entry := range entries {
+		b, err := os.ReadFile(filepath.Join(dir, "new", entry.Name()))
+		require.NoError(t, err)
+		messages = append(messages, string(b))
+	}
+	return messages
+}
+
+func TestDeliverLocally(t *testing.T) {
+	setupTestLogger(t)
+	dir := t.TempDir()
+	routes := []*routeConfig{
+		{Name: "mailboxes", Recipients: []string{"*@lan"},
+			Delivery: &deliveryConfig{Type: deliveryMaildir, Path: filepath.Join(dir, "{domain}", "{user}")}},
+		{Name: "shared", Recipients: []string{"*@shared.lan"},
+			Delivery: &deliveryConfig{Type: deliveryMbox, Path: filepath.Join(dir, "shared.mbox")}},
+	}
+	e := deliverTestEnvelope("Ops@lan", "dev@lan", "a@shared.lan", "b@shared.lan", "x@example.com")
+
+	relay, err := deliverLocally(e, routes, newMailboxWriter(false), newDestinationStatus(), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, []mail.Address{{User: "x", Host: "example.com"}}, relay)
+
+	ops := maildirMessages(t, filepath.Join(dir, "lan", "ops"))
+	require.Len(t, ops, 1)
+	assert.Equal(t, "Return-Path: <scanner@lan>\nDelivered-To: Ops@lan\nSubject: scan\n\nFrom the scanner\n", ops[0])
+	assert.Len(t, maildirMessages(t, filepath.Join(dir, "lan", "dev")), 1)
+
+	mbox, err := os.ReadFile(filepath.Join(dir, "shared.mbox"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(mbox), "\nSubject: scan\n"), "recipients sharing a mailbox get one copy")
+	assert.Contains(t, string(mbox), "Delivered-To: a@shared.lan\nDelivered-To: b@shared.lan\n")
+	assert.Contains(t, string(mbox), "\n>From the scanner\n")
+}
+
+func TestDeliverLocally_Retry(t *testing.T) {
+	setupTestLogger(t)
+	dir := t.TempDir()
+	blocked := filepath.Join(dir, "blocked")
+	require.NoError(t, os.WriteFile(blocked, nil, mailboxFileMode))
+	routes := []*routeConfig{
+		{Name: "mailboxes", Recipients: []string{"*@lan"},
+			Delivery: &deliveryConfig{Type: deliveryMaildir, Path: filepath.Join(dir, "{user}")}},
+		{Name: "shared", Recipients: []string{"*@shared.lan"},
+			Delivery: &deliveryConfig{Type: deliveryMbox, Path: filepath.Join(blocked, "shared.mbox")}},
+	}
+	status := newDestinationStatus()
+
+	_, err := deliverLocally(deliverTestEnvelope("ops@lan", "a@shared.lan"), routes, newMailboxWriter(false), status,
+		time.Now())
+	require.Error(t, err)
+	assert.Len(t, maildirMessages(t, filepath.Join(dir, "ops")), 1)
+
+	// the retry only makes the delivery that failed
+	require.NoError(t, os.Remove(blocked))
+	_, err = deliverLocally(deliverTestEnvelope("ops@lan", "a@shared.lan"), routes, newMailboxWriter(false), status,
+		time.Now())
+	require.NoError(t, err)
+	assert.Len(t, maildirMessages(t, filepath.Join(dir, "ops")), 1)
+	assert.FileExists(t, filepath.Join(blocked, "shared.mbox"))
+}
+
+func TestDeliverLocally_Failure(t *testing.T) {
+	setupTestLogger(t)
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, mailboxFileMode))
+	routes := []*routeConfig{{Delivery: &deliveryConfig{Type: deliveryMaildir, Path: filepath.Join(file, "{user}")}}}
+
+	_, err := deliverLocally(deliverTestEnvelope("ops@lan"), routes, newMailboxWriter(false), newDestinationStatus(),
+		time.Now())
+	assert.Equal(t, errLocalDelivery, err)
+}
+
+func TestExpand(t *testing.T) {
+	rcpt := mail.Address{User: "../Ops Team", Host: "LAN"}
+	assert.Equal(t, "/var/mail/lan/_._ops_team", expand("/var/mail/{domain}/{user}", rcpt))
+	assert.Equal(t, "--for=_._ops_team@lan", expand("--for={rcpt}", rcpt))
+}
+
+func TestPipeDelivery(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires /bin/sh")
+	}
+	setupTestLogger(t)
+	out := filepath.Join(t.TempDir(), "out")
+	script := `cat > ` + out + `; env | grep ^MAILRELAY_ | sort >> ` + out + `; exit "$1"`
+	deliver := func(status string, timeout int) error {
+		routes := []*routeConfig{{Delivery: &deliveryConfig{Type: deliveryPipe, TimeoutSecs: timeout,
+			Command: []string{"/bin/sh", "-c", script, "sh", status}}}}
+		_, err := deliverLocally(deliverTestEnvelope("ops@lan", "dev@lan"), routes, newMailboxWriter(false),
+			newDestinationStatus(), time.Now())
+		return err
+	}
+
+	require.NoError(t, deliver("0", 0))
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "Return-Path: <scanner@lan>\nDelivered-To: ops@lan\nDelivered-To: dev@lan\n"+
+		"Subject: scan\n\nFrom the scanner\n"+
+		"MAILRELAY_CLIENT_IP=10.0.5.20\nMAILRELAY_HELO=printer.lan\nMAILRELAY_RECIPIENTS=ops@lan dev@lan\n"+
+		"MAILRELAY_RELAY_ID=0123456789ABCDEF\nMAILRELAY_SENDER=scanner@lan\n", string(b))
+
+	assert.Equal(t, errLocalDelivery, deliver("75", 0))
+	err = deliver("1", 0)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "554 "), err.Error())
+
+	script = "sleep 5"
+	err = deliver("0", 1)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out")
+}
+
+func TestDeliveryConfig_Validate(t *testing.T) {
+	valid := []*deliveryConfig{
+		{Type: deliveryMaildir, Path: "/var/mail/{domain}/{user}/Maildir"},
+		{Type: deliveryMbox, Path: "/var/mail/{user}"},
+		{Type: deliveryPipe, Command: []string{"/usr/bin/procmail", "-d", "{user}"}, TimeoutSecs: 30},
+	}
+	for _, c := range valid {
+		assert.NoError(t, c.validate())
+	}
+	invalid := []*deliveryConfig{
+		{Type: "smtp"},
+		{Type: deliveryMaildir, Path: "Maildir"},
+		{Type: deliveryMbox, Path: "/var/mail/{recipient}"},
+		{Type: deliveryPipe},
+		{Type: deliveryPipe, Command: []string{"procmail"}},
+		{Type: deliveryPipe, Command: []string{"/usr/bin/procmail"}, TimeoutSecs: -1},
+	}
+	for _, c := range invalid {
+		assert.Error(t, c.validate())
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// destinationStatusTTL is how long the destinations that accepted a message
+// are remembered while others still fail. It covers the retries of the
+// first hours; an identical message sent after that, such as a periodic
+// alert without Date and Message-ID, is a new message for every destination.
+const destinationStatusTTL = 12 * time.Hour
+
+// destinationConfig is one of the upstreams a route relays its messages to,
+// either an SMTP server, configured like the global one, or an API transport.
+type destinationConfig struct {
+	Name string `json:"name"`
+	relayConfig
+	Transport *transportConfig `json:"transport"`
+	// BestEffort destinations are tried, but their failures do not fail the
+	// message.
+	BestEffort bool `json:"best_effort"`
+}
+
+func (c *destinationConfig) validate() error {
+	if c.Name == "" {
+		return errors.New("destination name is required")
+	}
+	if (c.Server == "") == (c.Transport == nil) {
+		return fmt.Errorf("destination %q: either smtp_server or transport is required", c.Name)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("destination %q: smtp_port must be between 1 and 65535", c.Name)
+	}
+	if c.Transport != nil {
+		if err := c.Transport.validate(); err != nil {
+			return fmt.Errorf("destination %q: %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// validateDestinations checks that destination names are unique and that
+// at least one destination must accept the message.
+func validateDestinations(destinations []*destinationConfig) error {
+	names := map[string]bool{}
+	required := false
+	for _, d := range destinations {
+		if err := d.validate(); err != nil {
+			return err
+		}
+		if names[d.Name] {
+			return fmt.Errorf("duplicate destination %q", d.Name)
+		}
+		names[d.Name] = true
+		required = required || !d.BestEffort
+	}
+	if len(destinations) > 0 && !required {
+		return errors.New("at least one destination must not be best_effort")
+	}
+	return nil
+}
+
+// destination relays messages to one of a route's destinations.
+type destination struct {
+	name       string
+	bestEffort bool
+	send       func(e *mail.Envelope) error
+}
+
+func newDestination(c *destinationConfig) (*destination, error) {
+	d := &destination{name: c.Name, bestEffort: c.BestEffort}
+	if c.Transport != nil {
+		api, err := newTransport(c.Transport)
+		if err != nil {
+			return nil, fmt.Errorf("destination %q: %w", c.Name, err)
+		}
+		d.send = func(e *mail.Envelope) error { return sendAPI(e, api) }
+		return d, nil
+	}
+	config := c.relayConfig
+	if config.Port == 0 {
+		config.Port = DefaultSMTPPort
+	}
+	d.send = func(e *mail.Envelope) error { return relayError(sendMail(e, &config)) }
+	return d, nil
+}
+
+// newRouteDestinations returns the destinations of the routes that have them.
+func newRouteDestinations(routes []*routeConfig) (map[*routeConfig][]*destination, error) {
+	destinations := map[*routeConfig][]*destination{}
+	for _, r := range routes {
+		for _, c := range r.Destinations {
+			d, err := newDestination(c)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", r.Name, err)
+			}
+			destinations[r] = append(destinations[r], d)
+		}
+	}
+	return destinations, nil
+}
+
+// destinationStatus remembers which destinations accepted a message that
+// others did not, so that when the client retries it the message is only
+// relayed to the destinations that failed. Local delivery keeps track of its
+// targets the same way.
+type destinationStatus struct {
+	mu       sync.Mutex
+	messages map[string]*destinationRecord
+}
+
+type destinationRecord struct {
+	destinations map[string]bool
+	expires      time.Time
+}
+
+func newDestinationStatus() *destinationStatus {
+	return &destinationStatus{messages: map[string]*destinationRecord{}}
+}
+
+// delivered returns true if the message with the key was accepted by the
+// destination.
+func (s *destinationStatus) delivered(key, name string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.messages[key]
+	return ok && now.Before(m.expires) && m.destinations[name]
+}
+
+// update records the destinations that accepted the message with the key,
+// or forgets the message once it will not be retried.
+func (s *destinationStatus) update(key string, accepted []string, done bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, m := range s.messages {
+		if !now.Before(m.expires) {
+			delete(s.messages, k)
+		}
+	}
+	if done {
+		delete(s.messages, key)
+		return
+	}
+	if len(accepted) == 0 {
+		return
+	}
+	m, ok := s.messages[key]
+	if !ok {
+		m = &destinationRecord{destinations: map[string]bool{}}
+		s.messages[key] = m
+	}
+	m.expires = now.Add(destinationStatusTTL)
+	for _, name := range accepted {
+		m.destinations[name] = true
+	}
+}
+
+// receivedMessageKey is the envelope value identifying the message as the
+// client sent it.
+const receivedMessageKey = "mailrelay_received_message"
+
+// receivedMessage identifies a message as the client sent it.
+type receivedMessage struct {
+	messageID string
+	date      string
+	digest    [sha256.Size]byte
+}
+
+func newReceivedMessage(data []byte) *receivedMessage {
+	msg := parseMessage(data)
+	return &receivedMessage{messageID: msg.get("Message-ID"), date: msg.get("Date"), digest: sha256.Sum256(data)}
+}
+
+// recordReceivedMessage records the message as the client sent it, before
+// processors add fields such as Received or a generated Message-ID that
+// differ between attempts.
+func recordReceivedMessage(e *mail.Envelope) {
+	e.Values[receivedMessageKey] = newReceivedMessage(e.Data.Bytes())
+}
+
+// destinationKey identifies a message across retries by its envelope, its
+// Message-ID and Date if it has them, and the message as the client sent it.
+func destinationKey(e *mail.Envelope) string {
+	r, ok := e.Values[receivedMessageKey].(*receivedMessage)
+	if !ok {
+		r = newReceivedMessage(e.Data.Bytes())
+	}
+	h := sha256.New()
+	for _, f := range []string{e.MailFrom.String(), strings.Join(getTo(e), ","), r.messageID, r.date} {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+	h.Write(r.digest[:])
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isTemporary returns true if the error is a temporary failure the client
+// retries.
+func isTemporary(err error) bool {
+	return strings.HasPrefix(err.Error(), "4")
+}
+
+// relayTarget is a destination with the recipients relayed to it.
+type relayTarget struct {
+	dest *destination
+	// name identifies the destination in the status, qualified by route
+	name  string
+	rcpts []mail.Address
+}
+
+// planRelay groups the recipients by the route chosen for each of them, the
+// way local delivery does, and returns the destinations to relay them to.
+// Recipients whose route has no destinations are relayed upstream.
+func planRelay(e *mail.Envelope, routes []*routeConfig, destinations map[*routeConfig][]*destination,
+	upstream *destination,
+) []*relayTarget {
+	var order []*routeConfig
+	groups := map[*routeConfig][]mail.Address{}
+	for _, rcpt := range e.RcptTo {
+		r := recipientRoute(routes, e, rcpt)
+		if len(destinations[r]) == 0 {
+			r = nil
+		}
+		if _, ok := groups[r]; !ok {
+			order = append(order, r)
+		}
+		groups[r] = append(groups[r], rcpt)
+	}
+	var targets []*relayTarget
+	for _, r := range order {
+		if r == nil {
+			targets = append(targets, &relayTarget{dest: upstream, name: upstream.name, rcpts: groups[r]})
+			continue
+		}
+		for _, d := range destinations[r] {
+			targets = append(targets, &relayTarget{dest: d, name: r.Name + "/" + d.name, rcpts: groups[r]})
+		}
+	}
+	return targets
+}
+
+// relayToDestinations relays the message to each target that has not
+// accepted it yet. It fails if a destination that is not best effort fails,
+// permanently if any of them rejected the message.
+func relayToDestinations(e *mail.Envelope, targets []*relayTarget, status *destinationStatus, now time.Time) error {
+	key := destinationKey(e)
+	rcpts := e.RcptTo
+	defer func() { e.RcptTo = rcpts }()
+	var accepted []string
+	var temporary, permanent error
+	for _, t := range targets {
+		if status.delivered(key, t.name, now) {
+			msgLog(e).Infof("already relayed to destination %s", t.name)
+			continue
+		}
+		e.RcptTo = t.rcpts
+		err := t.dest.send(e)
+		switch {
+		case err == nil:
+			msgLog(e).Infof("relayed to destination %s for %d recipients", t.name, len(t.rcpts))
+			accepted = append(accepted, t.name)
+		case t.dest.bestEffort:
+			msgLog(e).WithError(err).Warnf("relaying to best effort destination %s failed", t.name)
+		default:
+			msgLog(e).WithError(err).Errorf("relaying to destination %s failed", t.name)
+			if isTemporary(err) {
+				temporary = cmp.Or(temporary, err)
+			} else {
+				permanent = cmp.Or(permanent, err)
+			}
+		}
+	}
+	if permanent != nil {
+		status.update(key, accepted, true, now)
+		return permanent
+	}
+	status.update(key, accepted, temporary == nil, now)
+	return temporary
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpillora/ipfilter"
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDestination is a destination replying with errs in turn, and then
+// accepting messages.
+func fakeDestination(name string, bestEffort bool, sent *[]string, errs ...error) *destination {
+	return &destination{name: name, bestEffort: bestEffort, send: func(*mail.Envelope) error {
+		*sent = append(*sent, name)
+		if len(errs) == 0 {
+			return nil
+		}
+		err := errs[0]
+		errs = errs[1:]
+		return err
+	}}
+}
+
+// routeTargets returns the targets relaying the recipients of
+// transportTestEnvelope to the destinations.
+func routeTargets(destinations []*destination) []*relayTarget {
+	var targets []*relayTarget
+	for _, d := range destinations {
+		targets = append(targets, &relayTarget{dest: d, name: d.name, rcpts: transportTestEnvelope().RcptTo})
+	}
+	return targets
+}
+
+func TestRelayToDestinations(t *testing.T) {
+	setupTestLogger(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	temporary := errors.New("451 4.4.1 Could not reach upstream server, try again later")
+	var sent []string
+	destinations := []*destination{
+		fakeDestination("provider", false, &sent),
+		fakeDestination("archive", false, &sent, temporary, temporary),
+	}
+	status := newDestinationStatus()
+
+	err := relayToDestinations(transportTestEnvelope(), routeTargets(destinations), status, now)
+	assert.Equal(t, temporary, err)
+	err = relayToDestinations(transportTestEnvelope(), routeTargets(destinations), status, now.Add(time.Minute))
+	assert.Equal(t, temporary, err)
+	require.NoError(t, relayToDestinations(transportTestEnvelope(), routeTargets(destinations), status, now.Add(time.Hour)))
+	assert.Equal(t, []string{"provider", "archive", "archive", "archive"}, sent,
+		"retries only go to the failed destination")
+	assert.Empty(t, status.messages, "complete messages are forgotten")
+
+	// another message is relayed to both
+	e := transportTestEnvelope()
+	e.Data.WriteString("more\r\n")
+	sent = nil
+	require.NoError(t, relayToDestinations(e, routeTargets(destinations), status, now.Add(time.Hour)))
+	assert.Equal(t, []string{"provider", "archive"}, sent)
+}
+
+func TestRelayToDestinations_BestEffort(t *testing.T) {
+	setupTestLogger(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var sent []string
+	destinations := []*destination{
+		fakeDestination("provider", false, &sent),
+		fakeDestination("archive", true, &sent, errors.New("451 4.4.1 Could not reach upstream server")),
+	}
+	status := newDestinationStatus()
+	require.NoError(t, relayToDestinations(transportTestEnvelope(), routeTargets(destinations), status, now))
+	assert.Equal(t, []string{"provider", "archive"}, sent)
+	assert.Empty(t, status.messages)
+}
+
+func TestRelayToDestinations_Rejected(t *testing.T) {
+	setupTestLogger(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	temporary := errors.New("451 4.4.2 Amazon SES failed (status 503), try again later")
+	permanent := errors.New("554 5.0.0 Upstream server replied: 550 mailbox unavailable")
+	var sent []string
+	destinations := []*destination{
+		fakeDestination("provider", false, &sent, temporary),
+		fakeDestination("archive", false, &sent, permanent),
+	}
+	status := newDestinationStatus()
+	assert.Equal(t, permanent, relayToDestinations(transportTestEnvelope(), routeTargets(destinations), status, now))
+	assert.Empty(t, status.messages, "rejected messages are not retried")
+}
+
+func TestPlanRelay(t *testing.T) {
+	var sent []string
+	alerts := &routeConfig{Name: "alerts", Recipients: []string{"ops@example.com"}}
+	audit := &routeConfig{Name: "audit", Recipients: []string{"audit@example.com"}}
+	local := &routeConfig{Name: "local", Recipients: []string{"*@example.com"}}
+	destinations := map[*routeConfig][]*destination{
+		alerts: {fakeDestination("provider", false, &sent), fakeDestination("archive", true, &sent)},
+		audit:  {fakeDestination("provider", false, &sent)},
+	}
+	upstream := fakeDestination("upstream", false, &sent)
+	e := transportTestEnvelope()
+	e.RcptTo = append(e.RcptTo, mail.Address{User: "dev", Host: "example.com"},
+		mail.Address{User: "oncall", Host: "example.org"})
+
+	targets := planRelay(e, []*routeConfig{alerts, audit, local}, destinations, upstream)
+	var planned []string
+	for _, target := range targets {
+		var rcpts []string
+		for _, rcpt := range target.rcpts {
+			rcpts = append(rcpts, rcpt.String())
+		}
+		planned = append(planned, target.name+": "+strings.Join(rcpts, ","))
+	}
+	assert.Equal(t, []string{
+		"alerts/provider: ops@example.com",
+		"alerts/archive: ops@example.com",
+		"audit/provider: audit@example.com",
+		"upstream: dev@example.com,oncall@example.org",
+	}, planned, "recipients of routes without destinations are relayed upstream")
+	assert.Empty(t, sent)
+}
+
+func TestRelayToDestinations_SplitRecipients(t *testing.T) {
+	setupTestLogger(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	temporary := errors.New("451 4.4.1 Could not reach upstream server, try again later")
+	var sent []string
+	recipients := map[string][]string{}
+	record := func(d *destination) *destination {
+		send := d.send
+		d.send = func(e *mail.Envelope) error {
+			recipients[d.name] = append(recipients[d.name], getTo(e)...)
+			return send(e)
+		}
+		return d
+	}
+	alerts := &routeConfig{Name: "alerts", Recipients: []string{"ops@example.com"}}
+	routes := []*routeConfig{alerts}
+	destinations := map[*routeConfig][]*destination{
+		alerts: {record(fakeDestination("provider", false, &sent, temporary))},
+	}
+	upstream := record(fakeDestination("upstream", false, &sent))
+	status := newDestinationStatus()
+
+	e := transportTestEnvelope()
+	assert.Equal(t, temporary, relayToDestinations(e, planRelay(e, routes, destinations, upstream), status, now))
+	assert.Equal(t, transportTestEnvelope().RcptTo, e.RcptTo, "the envelope is restored")
+	e = transportTestEnvelope()
+	require.NoError(t, relayToDestinations(e, planRelay(e, routes, destinations, upstream), status,
+		now.Add(time.Minute)))
+	assert.Equal(t, []string{"provider", "upstream", "provider"}, sent,
+		"retries do not relay to upstream again")
+	assert.Equal(t, map[string][]string{
+		"provider": {"ops@example.com", "ops@example.com"},
+		"upstream": {"audit@example.com"},
+	}, recipients)
+}
+
+func TestDestinationStatus_Expires(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := newDestinationStatus()
+	s.update("key", []string{"provider"}, false, now)
+	assert.True(t, s.delivered("key", "provider", now.Add(time.Hour)))
+	assert.False(t, s.delivered("key", "archive", now.Add(time.Hour)))
+	assert.False(t, s.delivered("key", "provider", now.Add(destinationStatusTTL)))
+	s.update("other", nil, false, now.Add(destinationStatusTTL))
+	assert.Empty(t, s.messages)
+}
+
+func TestDestinationKey(t *testing.T) {
+	received := func() *mail.Envelope {
+		e := transportTestEnvelope()
+		recordReceivedMessage(e)
+		return e
+	}
+	key := destinationKey(received())
+
+	// fields added while processing, such as a generated Message-ID, differ
+	// between attempts
+	e := received()
+	replaceData(e, append([]byte("Received: from client\r\nMessage-ID: <1@relay>\r\n"), e.Data.Bytes()...))
+	assert.Equal(t, key, destinationKey(e), "fields added by the relay are ignored")
+
+	e = received()
+	e.RcptTo = e.RcptTo[:1]
+	assert.NotEqual(t, key, destinationKey(e))
+
+	e = transportTestEnvelope()
+	e.Data.WriteString("more\r\n")
+	recordReceivedMessage(e)
+	assert.NotEqual(t, key, destinationKey(e))
+
+	dated := func(id, date string) string {
+		e := transportTestEnvelope()
+		replaceData(e, append([]byte("Message-ID: <"+id+"@nas>\r\nDate: "+date+"\r\n"), e.Data.Bytes()...))
+		recordReceivedMessage(e)
+		return destinationKey(e)
+	}
+	monday := "Mon, 6 May 2024 02:00:00 +0000"
+	assert.Equal(t, dated("1", monday), dated("1", monday))
+	assert.NotEqual(t, dated("1", monday), dated("2", monday))
+	assert.NotEqual(t, dated("1", monday), dated("1", "Tue, 7 May 2024 02:00:00 +0000"))
+}
+
+func TestRelayToDestinations_AfterRetryWindow(t *testing.T) {
+	setupTestLogger(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	temporary := errors.New("451 4.4.1 Could not reach upstream server, try again later")
+	var sent []string
+	destinations := []*destination{
+		fakeDestination("provider", false, &sent),
+		fakeDestination("archive", false, &sent, temporary),
+	}
+	status := newDestinationStatus()
+	assert.Equal(t, temporary, relayToDestinations(transportTestEnvelope(), routeTargets(destinations), status, now))
+
+	// the same alert, without Date and Message-ID, sent again the next day
+	later := now.Add(destinationStatusTTL + time.Minute)
+	require.NoError(t, relayToDestinations(transportTestEnvelope(), routeTargets(destinations), status, later))
+	assert.Equal(t, []string{"provider", "archive", "provider", "archive"}, sent,
+		"identical messages after the retry window are relayed again")
+}
+
+func TestDestinationConfig(t *testing.T) {
+	var r routeConfig
+	require.NoError(t, json.Unmarshal([]byte(`{"name": "alerts", "destinations": [
+		{"name": "provider", "transport": {"type": "sendgrid", "api_key": "key"}},
+		{"name": "archive", "smtp_server": "archive.lan", "smtp_port": 25, "smtp_starttls": true,
+			"best_effort": true}
+	]}`), &r))
+	require.Len(t, r.Destinations, 2)
+	assert.Equal(t, transportSendGrid, r.Destinations[0].Transport.Type)
+	assert.Equal(t, "archive.lan", r.Destinations[1].Server)
+	assert.Equal(t, 25, r.Destinations[1].Port)
+	assert.True(t, r.Destinations[1].STARTTLS)
+	assert.True(t, r.Destinations[1].BestEffort)
+	assert.NoError(t, r.validate())
+
+	invalid := [][]*destinationConfig{
+		{{relayConfig: relayConfig{Server: "archive.lan"}}},
+		{{Name: "archive"}},
+		{{Name: "archive", relayConfig: relayConfig{Server: "archive.lan"}, Transport: &transportConfig{
+			Type: transportSendGrid, APIKey: "key"}}},
+		{{Name: "archive", relayConfig: relayConfig{Server: "archive.lan", Port: 70000}}},
+		{{Name: "provider", Transport: &transportConfig{Type: transportSendGrid}}},
+		{
+			{Name: "archive", relayConfig: relayConfig{Server: "archive.lan"}},
+			{Name: "archive", relayConfig: relayConfig{Server: "backup.lan"}},
+		},
+		{{Name: "archive", relayConfig: relayConfig{Server: "archive.lan"}, BestEffort: true}},
+	}
+	for _, d := range invalid {
+		assert.Error(t, (&routeConfig{Name: "alerts", Destinations: d}).validate())
+	}
+}
+
+func TestSubmitDirect_Destinations(t *testing.T) {
+	setupTestLogger(t)
+	provider := startFakeAPI(t)
+	archive := startFakeAPI(t, http.StatusServiceUnavailable)
+	AllowedSendersFilter = ipfilter.New(ipfilter.Options{})
+
+	appConfig := &mailRelayConfig{}
+	configDefaults(appConfig)
+	appConfig.SMTPServer = "127.0.0.1"
+	appConfig.Routes = []*routeConfig{{
+		Name:       "alerts",
+		Recipients: []string{"ops@example.com"},
+		Destinations: []*destinationConfig{
+			{Name: "provider", Transport: &transportConfig{Type: transportSendGrid, BaseURL: provider.URL,
+				APIKey: "key"}},
+			{Name: "archive", Transport: &transportConfig{Type: transportMailgun, BaseURL: archive.URL,
+				APIKey: "key", Domain: "archive.lan"}, BestEffort: true},
+		},
+	}}
+	require.NoError(t, validateConfig(appConfig))
+
+	sub := &sendmailSubmission{
+		sender:     "backup@example.com",
+		recipients: []string{"ops@example.com"},
+		data:       []byte("From: backup@example.com\nTo: ops@example.com\nSubject: nightly\n\nbody\n"),
+	}
+	require.NoError(t, submitDirect(appConfig, sub), "the best effort destination may fail")
+	assert.Len(t, provider.requests, 1)
+	assert.Len(t, archive.requests, 1)
+}
+
+func TestSubmitDirect_DestinationsMixedRecipients(t *testing.T) {
+	setupTestLogger(t)
+	upstream := startFakeAPI(t)
+	provider := startFakeAPI(t)
+	AllowedSendersFilter = ipfilter.New(ipfilter.Options{})
+
+	appConfig := &mailRelayConfig{}
+	configDefaults(appConfig)
+	appConfig.Transport = &transportConfig{Type: transportMailgun, BaseURL: upstream.URL, APIKey: "key",
+		Domain: "example.com"}
+	appConfig.Routes = []*routeConfig{{
+		Name:       "alerts",
+		Recipients: []string{"ops@example.com"},
+		Destinations: []*destinationConfig{
+			{Name: "provider", Transport: &transportConfig{Type: transportMailgun, BaseURL: provider.URL,
+				APIKey: "key", Domain: "alerts.example.com"}},
+		},
+	}}
+	require.NoError(t, validateConfig(appConfig))
+
+	sub := &sendmailSubmission{
+		sender:     "backup@example.com",
+		recipients: []string{"ops@example.com", "dev@example.com"},
+		data:       []byte("From: backup@example.com\nTo: ops@example.com, dev@example.com\nSubject: nightly\n\nbody\n"),
+	}
+	require.NoError(t, submitDirect(appConfig, sub))
+	require.Len(t, provider.bodies, 1)
+	require.Len(t, upstream.bodies, 1)
+	assert.Contains(t, string(provider.bodies[0]), "\r\n\r\nops@example.com\r\n")
+	assert.NotContains(t, string(provider.bodies[0]), "\r\n\r\ndev@example.com\r\n")
+	assert.Contains(t, string(upstream.bodies[0]), "\r\n\r\ndev@example.com\r\n")
+	assert.NotContains(t, string(upstream.bodies[0]), "\r\n\r\nops@example.com\r\n")
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	netmail "net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	dkimSignatureHeader = "DKIM-Signature"
+	dkimAlgorithmRSA    = "rsa-sha256"
+	dkimAlgorithmEd     = "ed25519-sha256"
+
+	// dkimMinRSABits is the smallest RSA key RFC 8301 allows for signing.
+	dkimMinRSABits = 1024
+
+	// dkimFoldWidth is the length of the lines the signature is folded into.
+	dkimFoldWidth = 72
+)
+
+// defaultDKIMHeaders are the header fields signed unless configured
+// otherwise.
+var defaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// dkimConfig configures DKIM signing for mail from a single sender domain.
+type dkimConfig struct {
+	Domain   string   `json:"domain"`
+	Selector string   `json:"selector"`
+	KeyFile  string   `json:"key_file"`
+	Headers  []string `json:"headers"`
+}
+
+func (c *dkimConfig) validate() error {
+	if c.Domain == "" || strings.ContainsAny(c.Domain, " \t;@") {
+		return fmt.Errorf("domain %q is invalid", c.Domain)
+	}
+	if c.Selector == "" || strings.ContainsAny(c.Selector, " \t;@") {
+		return fmt.Errorf("selector %q for %s is invalid", c.Selector, c.Domain)
+	}
+	if c.KeyFile == "" {
+		return fmt.Errorf("key_file for %s is required", c.Domain)
+	}
+	if len(c.Headers) == 0 {
+		return nil
+	}
+	from := false
+	for _, h := range c.Headers {
+		if !validHeaderName(h) {
+			return fmt.Errorf("header %q for %s is invalid", h, c.Domain)
+		}
+		from = from || strings.EqualFold(h, "From")
+	}
+	if !from {
+		return fmt.Errorf("headers for %s must include From", c.Domain)
+	}
+	return nil
+}
+
+// validateDKIMConfigs validates the DKIM configuration without loading keys,
+// which may only be readable by the server.
+func validateDKIMConfigs(configs []*dkimConfig) error {
+	domains := make(map[string]bool)
+	for _, c := range configs {
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("dkim: %w", err)
+		}
+		domain := strings.ToLower(c.Domain)
+		if domains[domain] {
+			return fmt.Errorf("dkim domain %s is configured more than once", c.Domain)
+		}
+		domains[domain] = true
+	}
+	return nil
+}
+
+// dkimSigner signs messages for a single domain.
+type dkimSigner struct {
+	domain    string
+	selector  string
+	headers   []string
+	key       crypto.Signer
+	algorithm string
+	hash      crypto.Hash
+}
+
+// newDKIMSigners loads the keys of the configured domains and returns the
+// signers by lower case domain.
+func newDKIMSigners(configs []*dkimConfig) (map[string]*dkimSigner, error) {
+	signers := make(map[string]*dkimSigner, len(configs))
+	for _, c := range configs {
+		key, err := loadDKIMKey(c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("dkim key for %s: %w", c.Domain, err)
+		}
+		s, err := newDKIMSigner(c, key)
+		if err != nil {
+			return nil, fmt.Errorf("dkim key for %s: %w", c.Domain, err)
+		}
+		signers[s.domain] = s
+	}
+	return signers, nil
+}
+
+func newDKIMSigner(c *dkimConfig, key crypto.Signer) (*dkimSigner, error) {
+	s := &dkimSigner{
+		domain:   strings.ToLower(c.Domain),
+		selector: c.Selector,
+		headers:  c.Headers,
+		key:      key,
+	}
+	if len(s.headers) == 0 {
+		s.headers = defaultDKIMHeaders
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < dkimMinRSABits {
+			return nil, fmt.Errorf("RSA keys must have at least %d bits", dkimMinRSABits)
+		}
+		s.algorithm, s.hash = dkimAlgorithmRSA, crypto.SHA256
+	case ed25519.PrivateKey:
+		// RFC 8463 signs the SHA-256 digest with PureEdDSA
+		s.algorithm, s.hash = dkimAlgorithmEd, crypto.Hash(0)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return s, nil
+}
+
+// loadDKIMKey reads a PEM encoded PKCS#8 RSA or Ed25519 key, or a PKCS#1 RSA
+// key.
+func loadDKIMKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// sign adds a DKIM-Signature field to the top of the header. Both header and
+// body use relaxed canonicalization, which survives the line ending
+// conversion and re-folding done on the way upstream.
+func (s *dkimSigner) sign(m *message, now time.Time) error {
+	value, err := s.signMessage(m, dkimSignatureHeader, "v=1", now)
+	if err != nil {
+		return err
+	}
+	m.prepend(dkimSignatureHeader, value)
+	return nil
+}
+
+// signMessage returns the value of a field signing header and body, such as
+// DKIM-Signature. Its tags start with first.
+func (s *dkimSigner) signMessage(m *message, name, first string, now time.Time) (string, error) {
+	names, fields := selectHeaders(m, s.headers)
+	bodyHash := sha256.Sum256(canonicalBody(m.body))
+	tags := []string{
+		first,
+		"a=" + s.algorithm,
+		"c=relaxed/relaxed",
+		"d=" + s.domain,
+		"s=" + s.selector,
+		"t=" + strconv.FormatInt(now.Unix(), 10),
+		"h=" + strings.Join(names, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	}
+	value := strings.Join(tags, ";"+m.eol+"\t")
+	sig, err := s.signFields(fields, m.newField(name, value))
+	if err != nil {
+		return "", err
+	}
+	return value + foldBase64(sig, m.eol), nil
+}
+
+// signFields signs the canonicalized header fields followed by the signature
+// field itself, whose b= tag is still empty.
+func (s *dkimSigner) signFields(fields []string, sigField headerField) ([]byte, error) {
+	digest := headerDigest(fields, canonicalHeader(sigField))
+	sig, err := s.key.Sign(rand.Reader, digest, s.hash)
+	if err != nil {
+		return nil, fmt.Errorf("dkim signing: %w", err)
+	}
+	return sig, nil
+}
+
+// headerDigest returns the hash of the canonicalized header fields followed
+// by the canonicalized signature field, which has no line ending.
+func headerDigest(fields []string, sigField string) []byte {
+	h := sha256.New()
+	for _, f := range fields {
+		h.Write([]byte(f + "\r\n"))
+	}
+	h.Write([]byte(sigField))
+	return h.Sum(nil)
+}
+
+// selectHeaders returns the names for the h= tag and the canonicalized fields
+// to sign. Fields that occur more than once are all signed, from the bottom
+// up; fields the message lacks are left out.
+func selectHeaders(m *message, names []string) ([]string, []string) {
+	var signed, fields []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		for i := len(m.fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(m.fields[i].name, name) {
+				signed = append(signed, name)
+				fields = append(fields, canonicalHeader(m.fields[i]))
+			}
+		}
+	}
+	return signed, fields
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// canonicalHeader returns the field in the relaxed header canonicalization
+// of RFC 6376 section 3.4.2, without the trailing CRLF.
+func canonicalHeader(f headerField) string {
+	v := f.raw[len(f.name)+1:]
+	v = bytes.ReplaceAll(v, []byte("\r"), nil)
+	v = bytes.ReplaceAll(v, []byte("\n"), nil)
+	value := strings.Join(strings.FieldsFunc(string(v), isWSP), " ")
+	return strings.ToLower(strings.TrimRight(f.name, " \t")) + ":" + value
+}
+
+// canonicalBody returns the body in the relaxed body canonicalization of RFC
+// 6376 section 3.4.4, with CRLF line endings.
+func canonicalBody(body []byte) []byte {
+	var buf bytes.Buffer
+	blank := 0
+	lines := bytes.Split(body, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines {
+		line = collapseWSP(bytes.TrimSuffix(line, []byte("\r")))
+		if len(line) == 0 {
+			// empty lines at the end of the body are ignored
+			blank++
+			continue
+		}
+		for ; blank > 0; blank-- {
+			buf.WriteString("\r\n")
+		}
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// collapseWSP reduces runs of whitespace to a single space and removes
+// trailing whitespace.
+func collapseWSP(line []byte) []byte {
+	out := make([]byte, 0, len(line))
+	space := false
+	for _, c := range line {
+		if c == ' ' || c == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			out = append(out, ' ')
+			space = false
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// foldBase64 encodes data as base64 folded into continuation lines.
+func foldBase64(data []byte, eol string) string {
+	s := base64.StdEncoding.EncodeToString(data)
+	var sb strings.Builder
+	for len(s) > dkimFoldWidth {
+		sb.WriteString(s[:dkimFoldWidth] + eol + "\t")
+		s = s[dkimFoldWidth:]
+	}
+	sb.WriteString(s)
+	return sb.String()
+}
+
+// fromDomain returns the lower case domain of the From header.
+func fromDomain(m *message) string {
+	from, err := netmail.ParseAddress(m.get("From"))
+	if err != nil {
+		return ""
+	}
+	at := strings.LastIndexByte(from.Address, '@')
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(from.Address[at+1:])
+}
+
+// signDKIM signs the message with the key of its From domain, if one is
+// configured.
+func signDKIM(e *mail.Envelope, signers map[string]*dkimSigner) error {
+	msg := parseMessage(e.Data.Bytes())
+	domain := fromDomain(msg)
+	s, ok := signers[domain]
+	if !ok {
+		msgLog(e).Debugf("no DKIM key for sender domain %q, not signing", domain)
+		return nil
+	}
+	if err := s.sign(msg, time.Now()); err != nil {
+		return err
+	}
+	replaceData(e, msg.bytes())
+	return nil
+}
+
+// dkimProcessor decorator signs messages with DKIM. It runs after all
+// processors that change the message, so the signature covers the message
+// as it is relayed.
+var dkimProcessor = func() backends.Decorator {
+	var signers map[string]*dkimSigner
+	initFunc := backends.InitializeWith(func(backendConfig backends.BackendConfig) error {
+		configs, ok := backendConfig["dkim"].([]*dkimConfig)
+		if !ok {
+			return nil
+		}
+		var err error
+		signers, err = newDKIMSigners(configs)
+		return err
+	})
+	backends.Svc.AddInitializer(initFunc)
+
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail && len(signers) > 0 {
+					if err := signDKIM(e, signers); err != nil {
+						msgLog(e).WithError(err).Error("signing message")
+						return backends.NewResult(err.Error()), err
+					}
+				}
+				return p.Process(e, task)
+			},
+		)
+	}
+}
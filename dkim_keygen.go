@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// dkimKeygenCommand is the sub-command that generates DKIM keys.
+	dkimKeygenCommand = "dkim-keygen"
+
+	dkimKeyTypeRSA     = "rsa"
+	dkimKeyTypeEd25519 = "ed25519"
+	dkimDefaultRSABits = 2048
+
+	// dnsTXTStringLength is the longest string a TXT record may hold; longer
+	// records are split into several strings.
+	dnsTXTStringLength = 255
+)
+
+// dkimKeygenOptions holds the parsed dkim-keygen command line.
+type dkimKeygenOptions struct {
+	domain   string
+	selector string
+	keyType  string
+	bits     int
+	out      string
+}
+
+func parseDKIMKeygenArgs(args []string, output io.Writer) (*dkimKeygenOptions, error) {
+	opts := &dkimKeygenOptions{}
+	fs := flag.NewFlagSet(dkimKeygenCommand, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(&opts.domain, "domain", "", "the signing domain")
+	fs.StringVar(&opts.selector, "selector", "", "the selector the key is published under")
+	fs.StringVar(&opts.keyType, "type", dkimKeyTypeRSA, "the key type, rsa or ed25519")
+	fs.IntVar(&opts.bits, "bits", dkimDefaultRSABits, "the size of RSA keys")
+	fs.StringVar(&opts.out, "out", "", "the file to write the private key to")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if opts.domain == "" || opts.selector == "" || opts.out == "" {
+		return nil, errors.New("dkim-keygen requires -domain, -selector and -out")
+	}
+	if opts.keyType == dkimKeyTypeRSA && opts.bits < dkimMinRSABits {
+		return nil, fmt.Errorf("RSA keys must have at least %d bits", dkimMinRSABits)
+	}
+	return opts, nil
+}
+
+// runDKIMKeygen generates a DKIM key, writes it to a new file and prints the
+// DNS TXT record that publishes it.
+func runDKIMKeygen(args []string, output io.Writer) error {
+	opts, err := parseDKIMKeygenArgs(args, output)
+	if err != nil {
+		return err
+	}
+	key, err := generateDKIMKey(opts.keyType, opts.bits)
+	if err != nil {
+		return err
+	}
+	record, err := dkimTXTRecord(key.Public())
+	if err != nil {
+		return err
+	}
+	if err := writeDKIMKey(opts.out, key); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "%s._domainkey.%s. IN TXT %s\n", opts.selector, opts.domain, quoteTXT(record))
+	return nil
+}
+
+func generateDKIMKey(keyType string, bits int) (crypto.Signer, error) {
+	switch keyType {
+	case dkimKeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, bits)
+	case dkimKeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("key type must be %q or %q", dkimKeyTypeRSA, dkimKeyTypeEd25519)
+	}
+}
+
+// writeDKIMKey writes the key as PKCS#8 PEM to a new file only the owner can
+// read. Existing files are never overwritten.
+func writeDKIMKey(path string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// dkimTXTRecord returns the DKIM key record for the public key. RSA keys are
+// published as SubjectPublicKeyInfo, Ed25519 keys as the bare key as RFC 8463
+// requires.
+func dkimTXTRecord(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(k), nil
+	default:
+		return "", fmt.Errorf("unsupported key type %T", pub)
+	}
+}
+
+// quoteTXT quotes the record as one or more TXT strings.
+func quoteTXT(record string) string {
+	var parts []string
+	for len(record) > dnsTXTStringLength {
+		parts = append(parts, `"`+record[:dnsTXTStringLength]+`"`)
+		record = record[dnsTXTStringLength:]
+	}
+	parts = append(parts, `"`+record+`"`)
+	return strings.Join(parts, " ")
+}
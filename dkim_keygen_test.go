@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// txtRecordPattern matches the record printed by dkim-keygen.
+var txtRecordPattern = regexp.MustCompile(`^mail\._domainkey\.example\.com\. IN TXT ((?:"[^"]*" ?)+)\n$`)
+
+// txtValue joins the strings of a printed TXT record.
+func txtValue(t *testing.T, output string) string {
+	t.Helper()
+	m := txtRecordPattern.FindStringSubmatch(output)
+	require.NotNil(t, m, output)
+	var sb strings.Builder
+	for _, s := range regexp.MustCompile(`"([^"]*)"`).FindAllStringSubmatch(m[1], -1) {
+		require.LessOrEqual(t, len(s[1]), dnsTXTStringLength)
+		sb.WriteString(s[1])
+	}
+	return sb.String()
+}
+
+func TestRunDKIMKeygen(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		keyType string
+	}{
+		{name: "rsa", args: []string{"-bits", "1024"}, keyType: "rsa"},
+		{name: "ed25519", args: []string{"-type", "ed25519"}, keyType: "ed25519"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mail.pem")
+			var out bytes.Buffer
+			args := append([]string{"-domain", "example.com", "-selector", "mail", "-out", path}, tt.args...)
+			require.NoError(t, runDKIMKeygen(args, &out))
+
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			if runtime.GOOS != "windows" {
+				assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+			}
+			key, err := loadDKIMKey(path)
+			require.NoError(t, err)
+			_, err = newDKIMSigner(&dkimConfig{Domain: "example.com", Selector: "mail"}, key)
+			require.NoError(t, err)
+
+			record := txtValue(t, out.String())
+			require.True(t, strings.HasPrefix(record, "v=DKIM1; k="+tt.keyType+"; p="), record)
+			p, err := base64.StdEncoding.DecodeString(strings.SplitN(record, "p=", 2)[1])
+			require.NoError(t, err)
+			switch k := key.Public().(type) {
+			case *rsa.PublicKey:
+				pub, err := x509.ParsePKIXPublicKey(p)
+				require.NoError(t, err)
+				assert.True(t, k.Equal(pub))
+			case ed25519.PublicKey:
+				assert.Equal(t, []byte(k), p)
+			}
+
+			// existing keys are never overwritten
+			assert.Error(t, runDKIMKeygen(args, &out))
+		})
+	}
+}
+
+func TestRunDKIMKeygen_Errors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.pem")
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "missing domain", args: []string{"-selector", "mail", "-out", path}},
+		{name: "missing out", args: []string{"-domain", "example.com", "-selector", "mail"}},
+		{name: "small key", args: []string{"-domain", "example.com", "-selector", "mail", "-out", path, "-bits", "512"}},
+		{name: "bad type", args: []string{"-domain", "example.com", "-selector", "mail", "-out", path, "-type", "dsa"}},
+		{name: "bad flag", args: []string{"-nope"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Error(t, runDKIMKeygen(tt.args, &bytes.Buffer{}))
+		})
+	}
+	assert.NoFileExists(t, path)
+}
+
+func TestQuoteTXT(t *testing.T) {
+	assert.Equal(t, `"short"`, quoteTXT("short"))
+	long := strings.Repeat("a", dnsTXTStringLength) + "b"
+	assert.Equal(t, `"`+strings.Repeat("a", dnsTXTStringLength)+`" "b"`, quoteTXT(long))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dkimTestMessage = "From: App <app@Example.com>\n" +
+	"To: ops@example.net\n" +
+	"Subject: disk\n  almost full\n" +
+	"X-Mailer: cron\n" +
+	"\n" +
+	"Disk  usage at 95%  \n\n\n"
+
+// verifyDKIM checks the topmost DKIM-Signature of data with the public key.
+func verifyDKIM(t *testing.T, data []byte, pub crypto.PublicKey) map[string]string {
+	t.Helper()
+	msg := parseMessage(data)
+	require.True(t, strings.EqualFold(msg.fields[0].name, dkimSignatureHeader))
+	tags := parseDKIMTags(msg.fields[0].value())
+
+	bodyHash := sha256.Sum256(canonicalBody(msg.body))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(bodyHash[:]), tags["bh"])
+
+	// the signature covers the listed fields and itself without the b= value
+	sigField := msg.fields[0]
+	msg.fields = msg.fields[1:]
+	_, fields := selectHeaders(msg, strings.Split(tags["h"], ":"))
+	b := bytes.LastIndex(sigField.raw, []byte("\tb=")) + len("\tb=")
+	sigField.raw = append(sigField.raw[:b:b], msg.eol...)
+	h := sha256.New()
+	for _, f := range fields {
+		h.Write([]byte(f + "\r\n"))
+	}
+	h.Write([]byte(canonicalHeader(sigField)))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	require.NoError(t, err)
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		assert.NoError(t, rsa.VerifyPKCS1v15(k, crypto.SHA256, h.Sum(nil), sig))
+	case ed25519.PublicKey:
+		assert.True(t, ed25519.Verify(k, h.Sum(nil), sig))
+	}
+	return tags
+}
+
+// writeTestKey writes the key to a PEM file and returns its path.
+func writeTestKey(t *testing.T, key crypto.Signer, pkcs1 bool) string {
+	t.Helper()
+	block := &pem.Block{Type: "PRIVATE KEY"}
+	if pkcs1 {
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key.(*rsa.PrivateKey))}
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		require.NoError(t, err)
+		block.Bytes = der
+	}
+	path := filepath.Join(t.TempDir(), "dkim.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0o600))
+	return path
+}
+
+func TestSignDKIM(t *testing.T) {
+	setupTestLogger(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		key       crypto.Signer
+		pkcs1     bool
+		algorithm string
+	}{
+		{name: "rsa pkcs8", key: rsaKey, algorithm: dkimAlgorithmRSA},
+		{name: "rsa pkcs1", key: rsaKey, pkcs1: true, algorithm: dkimAlgorithmRSA},
+		{name: "ed25519", key: edKey, algorithm: dkimAlgorithmEd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signers, err := newDKIMSigners([]*dkimConfig{
+				{Domain: "example.com", Selector: "mail", KeyFile: writeTestKey(t, tt.key, tt.pkcs1)},
+			})
+			require.NoError(t, err)
+
+			e := mail.NewEnvelope("127.0.0.1", 1)
+			e.Data.WriteString(dkimTestMessage)
+			require.NoError(t, signDKIM(e, signers))
+			require.True(t, strings.HasSuffix(e.Data.String(), "\n\n"+"Disk  usage at 95%  \n\n\n"))
+
+			tags := verifyDKIM(t, e.Data.Bytes(), tt.key.Public())
+			assert.Equal(t, tt.algorithm, tags["a"])
+			assert.Equal(t, "relaxed/relaxed", tags["c"])
+			assert.Equal(t, "example.com", tags["d"])
+			assert.Equal(t, "mail", tags["s"])
+			assert.Equal(t, "from:subject:to", tags["h"])
+		})
+	}
+}
+
+func TestSignDKIM_UnknownDomain(t *testing.T) {
+	setupTestLogger(t)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := newDKIMSigner(&dkimConfig{Domain: "example.org", Selector: "mail"}, key)
+	require.NoError(t, err)
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString(dkimTestMessage)
+	require.NoError(t, signDKIM(e, map[string]*dkimSigner{"example.org": signer}))
+	assert.Equal(t, dkimTestMessage, e.Data.String())
+}
+
+func TestDKIMSigner_Headers(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := newDKIMSigner(&dkimConfig{
+		Domain: "example.com", Selector: "mail", Headers: []string{"From", "X-Mailer", "Received", "from"},
+	}, key)
+	require.NoError(t, err)
+
+	msg := parseMessage([]byte("Received: b\r\n" + strings.ReplaceAll(dkimTestMessage, "\n", "\r\n") +
+		"Received: a\r\n"))
+	require.NoError(t, signer.sign(msg, time.Unix(1700000000, 0)))
+	tags := verifyDKIM(t, msg.bytes(), key.Public())
+	assert.Equal(t, "from:x-mailer:received", tags["h"], "every occurrence is signed once")
+	assert.Equal(t, "1700000000", tags["t"])
+	assert.Contains(t, string(msg.fields[0].raw), "\r\n\t")
+}
+
+func TestCanonicalization(t *testing.T) {
+	msg := parseMessage([]byte("SUBJECT:  Hello \t World\r\n  again  \r\n\r\n"))
+	assert.Equal(t, "subject:Hello World again", canonicalHeader(msg.fields[0]))
+
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{body: "", expected: ""},
+		{body: "\n\n", expected: ""},
+		{body: "a  b \t\n", expected: "a b\r\n"},
+		{body: " \tindented\r\n\r\n\r\nend", expected: " indented\r\n\r\n\r\nend\r\n"},
+		{body: "line\n \n\t\n", expected: "line\r\n"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, string(canonicalBody([]byte(tt.body))), "%q", tt.body)
+	}
+}
+
+func TestLoadDKIMKey_Errors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "key.txt")
+	require.NoError(t, os.WriteFile(notPEM, []byte("not a key"), 0o600))
+	_, err := loadDKIMKey(notPEM)
+	assert.Error(t, err)
+
+	_, err = loadDKIMKey(filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+
+	small, err := rsa.GenerateKey(rand.Reader, 512)
+	require.NoError(t, err)
+	_, err = newDKIMSigners([]*dkimConfig{{Domain: "example.com", Selector: "s", KeyFile: writeTestKey(t, small, false)}})
+	assert.Error(t, err, "RSA keys below 1024 bits are rejected")
+}
+
+func TestValidateDKIMConfigs(t *testing.T) {
+	valid := dkimConfig{Domain: "example.com", Selector: "mail", KeyFile: "/etc/dkim.pem"}
+	require.NoError(t, validateDKIMConfigs([]*dkimConfig{&valid}))
+
+	tests := []struct {
+		name   string
+		modify func(c *dkimConfig)
+	}{
+		{name: "missing domain", modify: func(c *dkimConfig) { c.Domain = "" }},
+		{name: "bad selector", modify: func(c *dkimConfig) { c.Selector = "a;b" }},
+		{name: "missing key file", modify: func(c *dkimConfig) { c.KeyFile = "" }},
+		{name: "bad header", modify: func(c *dkimConfig) { c.Headers = []string{"From", "X A"} }},
+		{name: "from not signed", modify: func(c *dkimConfig) { c.Headers = []string{"Subject"} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.modify(&c)
+			assert.Error(t, validateDKIMConfigs([]*dkimConfig{&c}))
+		})
+	}
+
+	dup := valid
+	dup.Domain = "EXAMPLE.com"
+	assert.Error(t, validateDKIMConfigs([]*dkimConfig{&valid, &dup}))
+}
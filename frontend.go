@@ -0,0 +1,660 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	// peerTokenPrefix marks the address the frontend passes to the SMTP
+	// server in place of the client's address.
+	peerTokenPrefix = "mailrelay-peer-"
+	peerTokenBytes  = 16
+
+	// backendHandshakeTimeout limits the exchange with the SMTP server
+	// before a client connection is proxied.
+	backendHandshakeTimeout = 30 * time.Second
+
+	// peerValueKey is the envelope value holding the client's peerInfo.
+	peerValueKey = "mailrelay_peer"
+
+	// shutdownReply ends client sessions when mailrelay shuts down.
+	shutdownReply = "421 4.3.2 Service shutting down, closing transmission channel\r\n"
+
+	// maxCommandLine is the longest command line accepted, the 1000 octets
+	// RFC 5321 allows for text lines with a small margin.
+	maxCommandLine = 1024
+	// maxDataLine is the longest line of message data accepted. Lines
+	// longer than RFC 5322 allows are common, and folded by normalize.
+	maxDataLine = 1 << 20
+	// lineTooLongReply ends client sessions that exceed the line limits.
+	lineTooLongReply = "500 5.5.2 Line too long\r\n"
+)
+
+var (
+	errShuttingDown = errors.New("shutting down")
+	errLineTooLong  = errors.New("line too long")
+)
+
+// peerInfo describes the client of a frontend connection.
+type peerInfo struct {
+	// addr is the client's IP address, or "unix:<uid>:<gid>" for Unix socket peers
+	addr string
+	// helo is the client's HELO name as reported by a relay with XCLIENT or
+	// XFORWARD, replacing the relay's own
+	helo string
+	// via is the relay that reported addr with XFORWARD. XFORWARD is
+	// informational, so allowed_senders applies to the relay.
+	via string
+	// trusted peers are exempt from the allowed_senders filter
+	trusted bool
+}
+
+// peerRegistry maps the tokens the frontend hands to the SMTP server to the
+// clients they stand for.
+type peerRegistry struct {
+	mu    sync.Mutex
+	peers map[string]*peerInfo
+}
+
+func newPeerRegistry() *peerRegistry {
+	return &peerRegistry{peers: make(map[string]*peerInfo)}
+}
+
+func (r *peerRegistry) register(p *peerInfo) (string, error) {
+	b := make([]byte, peerTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := peerTokenPrefix + hex.EncodeToString(b)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers[token] = p
+	return token, nil
+}
+
+// update replaces the peer registered for token. Registered peers are shared
+// with the processors and never modified in place.
+func (r *peerRegistry) update(token string, p *peerInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.peers[token]; ok {
+		r.peers[token] = p
+	}
+}
+
+func (r *peerRegistry) unregister(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.peers, token)
+}
+
+func (r *peerRegistry) lookup(token string) (*peerInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.peers[token]
+	return p, ok
+}
+
+// frontend accepts client connections and proxies them to the SMTP server on
+// a loopback address. This covers listeners the SMTP server cannot handle
+// itself, such as Unix sockets, and lets mailrelay finish the sessions in
+// progress when it shuts down. The client is identified to the server with
+// XCLIENT, using a token that the peer processor resolves back to the client.
+type frontend struct {
+	backendAddr string
+	peers       *peerRegistry
+	timeout     time.Duration
+	maxSize     int64
+
+	wg        sync.WaitGroup
+	listeners []*frontendListener
+
+	// conns holds the client connections, with their session once it is
+	// established. drained is closed once a shutdown has seen them all end.
+	mu       sync.Mutex
+	conns    map[net.Conn]*proxySession
+	draining atomic.Bool
+	drained  chan struct{}
+}
+
+// frontendListener is a listener served by the frontend.
+type frontendListener struct {
+	net.Listener
+	// lmtp listeners speak LMTP to their clients
+	lmtp bool
+	// unixSocket is the configuration of a Unix socket listener
+	unixSocket *unixSocketConfig
+	// proxy enables the PROXY protocol for trusted proxies
+	proxy *proxyProtocolConfig
+	// xclient lets trusted relays identify their clients
+	xclient *xclientConfig
+	// lenient accepts broken commands from some clients
+	lenient *lenientConfig
+}
+
+func newFrontend(backendAddr string, peers *peerRegistry, timeout time.Duration, maxSize int64) *frontend {
+	return &frontend{
+		backendAddr: backendAddr,
+		peers:       peers,
+		timeout:     timeout,
+		maxSize:     maxSize,
+		conns:       make(map[net.Conn]*proxySession),
+	}
+}
+
+// serve accepts connections on l until it is closed.
+func (f *frontend) serve(l *frontendListener) {
+	f.mu.Lock()
+	f.listeners = append(f.listeners, l)
+	f.mu.Unlock()
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					Logger.WithError(err).Errorf("accepting connection on %s", l.Addr())
+				}
+				return
+			}
+			if !f.track(conn) {
+				go rejectShuttingDown(conn)
+				continue
+			}
+			go f.handle(l, conn)
+		}
+	}()
+}
+
+// track registers a client connection. It returns false once the frontend
+// is shutting down.
+func (f *frontend) track(conn net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.draining.Load() {
+		return false
+	}
+	f.conns[conn] = nil
+	return true
+}
+
+// attach records the session of a client connection.
+func (f *frontend) attach(conn net.Conn, s *proxySession) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s.draining = &f.draining
+	f.conns[conn] = s
+}
+
+func (f *frontend) untrack(conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.conns, conn)
+	if f.drained != nil && len(f.conns) == 0 {
+		close(f.drained)
+		f.drained = nil
+	}
+}
+
+// shutdown stops serving new sessions and waits until deadline for those in
+// progress to end. Idle clients are sent a 421 reply right away, clients in
+// a mail transaction once it is complete. Connections still open at the
+// deadline are closed, and their number is returned.
+func (f *frontend) shutdown(deadline time.Time) int {
+	drained := make(chan struct{})
+	f.mu.Lock()
+	f.draining.Store(true)
+	if len(f.conns) == 0 {
+		close(drained)
+	} else {
+		f.drained = drained
+		Logger.Infof("waiting for %d sessions to end", len(f.conns))
+	}
+	for _, s := range f.conns {
+		if s != nil {
+			s.interrupt()
+		}
+	}
+	f.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	abandoned := 0
+	select {
+	case <-drained:
+	case <-timer.C:
+		f.mu.Lock()
+		abandoned = len(f.conns)
+		for conn, s := range f.conns {
+			conn.Close()
+			if s != nil {
+				s.backend.Close()
+			}
+		}
+		f.mu.Unlock()
+	}
+
+	f.mu.Lock()
+	closeListeners(f.listeners)
+	f.mu.Unlock()
+	f.wg.Wait()
+	return abandoned
+}
+
+// rejectShuttingDown turns away a client that connects during a shutdown.
+func rejectShuttingDown(conn net.Conn) {
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(time.Now().Add(backendHandshakeTimeout)); err != nil {
+		return
+	}
+	_, _ = io.WriteString(conn, shutdownReply)
+}
+
+// handle proxies a client connection to the SMTP server.
+func (f *frontend) handle(l *frontendListener, conn net.Conn) {
+	// identify may wrap conn, so keep the accepted connection
+	accepted := conn
+	defer f.untrack(accepted)
+	defer accepted.Close()
+
+	peer, conn, err := l.identify(conn)
+	if err != nil {
+		Logger.WithError(err).Warnf("rejecting connection on %s", conn.LocalAddr())
+		fmt.Fprintf(conn, "554 5.7.1 %s\r\n", err)
+		return
+	}
+
+	token, err := f.peers.register(peer)
+	if err != nil {
+		Logger.WithError(err).Error("registering peer")
+		fmt.Fprint(conn, "421 4.3.0 Service not available\r\n")
+		return
+	}
+	defer f.peers.unregister(token)
+
+	backend, greeting, err := f.dialBackend(token)
+	if err != nil {
+		Logger.WithError(err).Error("connecting to SMTP server")
+		fmt.Fprint(conn, "421 4.3.0 Service not available\r\n")
+		return
+	}
+	defer backend.Close()
+
+	Logger.Debugf("proxying connection from %s", peer.addr)
+	if _, err := io.WriteString(conn, greeting); err != nil {
+		return
+	}
+	if l.lmtp {
+		s := newLMTPSession(conn, backend, f.timeout, f.maxSize)
+		f.attach(accepted, s.proxySession)
+		s.run()
+		return
+	}
+	relay := l.xclient != nil && l.xclient.trusted(peer.addr)
+	s := newSMTPSession(conn, backend, f.timeout, f.peers, token, greeting, relay)
+	s.lenient = l.lenient != nil && l.lenient.applies(l.name(), peer.addr)
+	f.attach(accepted, s.proxySession)
+	s.run()
+}
+
+// name returns the name of the listener in the configuration.
+func (l *frontendListener) name() string {
+	if l.unixSocket != nil {
+		return listenerUnixSocket
+	}
+	return listenerSMTP
+}
+
+// identify returns the peer of a client connection, or an error if the
+// client may not connect. Connections from trusted proxies are returned
+// wrapped, with the PROXY header consumed.
+func (l *frontendListener) identify(conn net.Conn) (*peerInfo, net.Conn, error) {
+	if l.unixSocket != nil {
+		uid, gid, err := peerCredentials(conn)
+		if err != nil && l.unixSocket.hasPeerRules() {
+			return nil, conn, fmt.Errorf("cannot determine peer credentials: %w", err)
+		}
+		if err != nil {
+			return &peerInfo{addr: "unix", trusted: true}, conn, nil
+		}
+		if !l.unixSocket.allowed(uid, gid) {
+			return nil, conn, fmt.Errorf("uid %d gid %d not allowed", uid, gid)
+		}
+		return &peerInfo{addr: fmt.Sprintf("unix:%d:%d", uid, gid), trusted: true}, conn, nil
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, conn, err
+	}
+	if l.proxy == nil || !l.proxy.trusted(host) {
+		return &peerInfo{addr: host}, conn, nil
+	}
+
+	addr, wrapped, err := readProxyHeader(conn)
+	if err != nil {
+		return nil, conn, err
+	}
+	if !addr.IsValid() {
+		// the proxy's own connection, e.g. a health check
+		return &peerInfo{addr: host}, wrapped, nil
+	}
+	Logger.Debugf("connection from %s via proxy %s", addr, host)
+	return &peerInfo{addr: addr.String()}, wrapped, nil
+}
+
+// dialBackend connects to the SMTP server and identifies the client with
+// XCLIENT. It returns the server's greeting, which is sent to the client.
+func (f *frontend) dialBackend(token string) (net.Conn, string, error) {
+	backend, err := net.DialTimeout("tcp", f.backendAddr, backendHandshakeTimeout)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := backend.SetDeadline(time.Now().Add(backendHandshakeTimeout)); err != nil {
+		backend.Close()
+		return nil, "", err
+	}
+
+	r := bufio.NewReader(backend)
+	greeting, err := readReply(r)
+	if err == nil {
+		_, err = fmt.Fprintf(backend, "XCLIENT ADDR=%s\r\n", token)
+	}
+	var reply string
+	if err == nil {
+		reply, err = readReply(r)
+	}
+	if err == nil && !strings.HasPrefix(reply, "2") {
+		err = fmt.Errorf("XCLIENT rejected: %s", strings.TrimSpace(reply))
+	}
+	if err == nil {
+		err = backend.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		backend.Close()
+		return nil, "", err
+	}
+	// nothing else was sent, so the reader holds no buffered data
+	return backend, greeting, nil
+}
+
+// readReply reads a possibly multi-line SMTP reply.
+func readReply(r *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(line)
+		// "250-" continues a reply, "250 " ends it
+		if len(line) < 4 || line[3] != '-' {
+			return sb.String(), nil
+		}
+	}
+}
+
+// proxySession relays a client session to the SMTP server one command at a
+// time.
+type proxySession struct {
+	client  net.Conn
+	cr      *bufio.Reader
+	backend net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+
+	// a shutdown lets the client finish its mail transaction, but ends the
+	// session otherwise
+	mu          sync.Mutex
+	transaction bool
+	draining    *atomic.Bool
+}
+
+func newProxySession(client, backend net.Conn, timeout time.Duration) *proxySession {
+	return &proxySession{
+		client:  client,
+		cr:      bufio.NewReader(client),
+		backend: backend,
+		br:      bufio.NewReader(backend),
+		timeout: timeout,
+	}
+}
+
+// run passes client commands to handle until it returns true or fails.
+func (s *proxySession) run(handle func(line string) (bool, error)) {
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			if errors.Is(err, errLineTooLong) {
+				s.reply(lineTooLongReply)
+			} else if s.shuttingDown() && !s.inTransaction() {
+				s.reply(shutdownReply)
+			}
+			return
+		}
+		quit, err := handle(line)
+		if errors.Is(err, errLineTooLong) {
+			s.reply(lineTooLongReply)
+			return
+		}
+		if err != nil {
+			Logger.WithError(err).Error("session with SMTP server failed")
+			s.reply("421 4.3.0 Service not available, closing transmission channel\r\n")
+			return
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// readLine reads a command line.
+func (s *proxySession) readLine() (string, error) {
+	return s.readLimited(maxCommandLine)
+}
+
+// readDataLine reads a line of message data.
+func (s *proxySession) readDataLine() (string, error) {
+	return s.readLimited(maxDataLine)
+}
+
+// readLimited reads a line of at most limit octets including the line
+// ending, failing with errLineTooLong for longer lines.
+func (s *proxySession) readLimited(limit int) (string, error) {
+	s.mu.Lock()
+	if s.shuttingDown() && !s.transaction {
+		s.mu.Unlock()
+		return "", errShuttingDown
+	}
+	err := s.client.SetReadDeadline(time.Now().Add(s.timeout))
+	s.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	var line []byte
+	for {
+		chunk, err := s.cr.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return string(line), err
+		}
+	}
+}
+
+func (s *proxySession) shuttingDown() bool {
+	return s.draining != nil && s.draining.Load()
+}
+
+func (s *proxySession) inTransaction() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.transaction
+}
+
+// setTransaction records whether the client is in a mail transaction.
+func (s *proxySession) setTransaction(transaction bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transaction = transaction
+}
+
+// interrupt wakes an idle session waiting for the client, so it can end.
+func (s *proxySession) interrupt() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.transaction {
+		_ = s.client.SetReadDeadline(time.Now())
+	}
+}
+
+func (s *proxySession) reply(r string) {
+	_, _ = io.WriteString(s.client, r)
+}
+
+// send sends data to the SMTP server without waiting for a reply.
+func (s *proxySession) send(data string) error {
+	if err := s.backend.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(s.backend, data)
+	return err
+}
+
+// command sends a command to the SMTP server and returns its reply.
+func (s *proxySession) command(line string) (string, error) {
+	if err := s.send(line); err != nil {
+		return "", err
+	}
+	r, err := readReply(s.br)
+	if err != nil {
+		return "", err
+	}
+	// processor errors are not always formatted as SMTP replies, but
+	// clients need a reply code
+	if !hasReplyCode(r) {
+		r = "451 4.3.0 " + r
+	}
+	return r, nil
+}
+
+// forward sends a command to the SMTP server and its reply to the client.
+func (s *proxySession) forward(line string) error {
+	r, err := s.command(line)
+	if err != nil {
+		return err
+	}
+	s.reply(r)
+	return nil
+}
+
+// commandVerb returns the upper-cased verb of a command line.
+func commandVerb(line string) string {
+	if fields := strings.Fields(line); len(fields) > 0 {
+		return strings.ToUpper(fields[0])
+	}
+	return ""
+}
+
+func hasReplyCode(r string) bool {
+	if len(r) < 4 {
+		return false
+	}
+	for i := 0; i < 3; i++ {
+		if r[i] < '0' || r[i] > '9' {
+			return false
+		}
+	}
+	return r[3] == ' ' || r[3] == '-'
+}
+
+// isPositive returns true for a 2xx reply.
+func isPositive(reply string) bool {
+	return strings.HasPrefix(reply, "2")
+}
+
+// peerProcessor decorator replaces the frontend's peer token with the
+// client's address while the message is processed. Messages that did not
+// arrive through the frontend are rejected, since the SMTP server then only
+// listens on loopback for the frontend. Messages from clients that may not
+// relay are rejected here, before anything archives or signs them.
+var peerProcessor = func() backends.Decorator {
+	var peers *peerRegistry
+	initFunc := backends.InitializeWith(func(backendConfig backends.BackendConfig) error {
+		if r, ok := backendConfig["peers"].(*peerRegistry); ok {
+			peers = r
+		}
+		return nil
+	})
+	backends.Svc.AddInitializer(initFunc)
+
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task != backends.TaskSaveMail {
+					return p.Process(e, task)
+				}
+				if peers != nil {
+					token := e.RemoteIP
+					peer, ok := peers.lookup(token)
+					if !ok {
+						err := errors.New("554 5.7.1 Connection did not arrive through a mailrelay listener")
+						Logger.WithError(err).Warnf("rejecting message from %s", e.RemoteIP)
+						return backends.NewResult(err.Error()), err
+					}
+					// the envelope outlives the message, so restore the token
+					// and HELO for the session's next message
+					helo := e.Helo
+					e.RemoteIP = peer.addr
+					if peer.helo != "" {
+						e.Helo = peer.helo
+					}
+					defer func() { e.RemoteIP, e.Helo = token, helo }()
+					e.Values[peerValueKey] = peer
+				}
+				if !senderAllowed(e) {
+					err := senderNotAllowed(e)
+					msgLog(e).Info(err.Error())
+					return backends.NewResult(err.Error()), err
+				}
+				return p.Process(e, task)
+			},
+		)
+	}
+}
+
+// senderAllowed returns true if the client that sent the message may relay
+// mail. Trusted peers, such as Unix socket clients, bypass allowed_senders.
+func senderAllowed(e *mail.Envelope) bool {
+	peer, ok := e.Values[peerValueKey].(*peerInfo)
+	if ok && peer.trusted {
+		return true
+	}
+	if ok && peer.via != "" {
+		return !AllowedSendersFilter.Blocked(peer.via)
+	}
+	return !AllowedSendersFilter.Blocked(e.RemoteIP)
+}
+
+// senderNotAllowed returns the rejection of a client that may not relay
+// mail. It is permanent, as retrying does not change the client's address.
+func senderNotAllowed(e *mail.Envelope) error {
+	return fmt.Errorf("554 5.7.1 Remote IP of %s not allowed to send email", e.RemoteIP)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpillora/ipfilter"
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBackend accepts a single connection, checks the frontend's XCLIENT
+// handshake and then replies to each command by echoing it.
+func fakeBackend(t *testing.T) (string, chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	tokens := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220-test.local ESMTP\r\n220 ready\r\n")
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tokens <- strings.TrimSpace(strings.TrimPrefix(line, "XCLIENT ADDR="))
+		fmt.Fprint(conn, "250 2.1.0 OK\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fmt.Fprint(conn, "250 echo "+line)
+		}
+	}()
+	return l.Addr().String(), tokens
+}
+
+func listenTestSocket(t *testing.T, cfg *unixSocketConfig) net.Listener {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets are not tested on windows")
+	}
+	// keep the path short, socket paths are limited to about 100 bytes
+	dir, err := os.MkdirTemp("", "mr")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	cfg.Path = filepath.Join(dir, "smtp.sock")
+
+	l, err := cfg.listen()
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestFrontend_UnixSocket(t *testing.T) {
+	setupTestLogger(t)
+	backendAddr, tokens := fakeBackend(t)
+
+	cfg := &unixSocketConfig{Mode: "0600"}
+	l := listenTestSocket(t, cfg)
+	fe := newFrontend(backendAddr, newPeerRegistry(), time.Minute, DefaultMaxEmailSize)
+	fe.serve(&frontendListener{Listener: l, unixSocket: cfg})
+
+	info, err := os.Stat(cfg.Path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	conn, err := net.Dial("unix", cfg.Path)
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	greeting, err := readReply(r)
+	require.NoError(t, err)
+	assert.Equal(t, "220-test.local ESMTP\r\n220 ready\r\n", greeting)
+
+	token := <-tokens
+	assert.True(t, strings.HasPrefix(token, peerTokenPrefix))
+	peer, ok := fe.peers.lookup(token)
+	require.True(t, ok)
+	assert.True(t, peer.trusted)
+	if runtime.GOOS == "linux" {
+		assert.Equal(t, fmt.Sprintf("unix:%d:%d", os.Getuid(), os.Getgid()), peer.addr)
+	}
+
+	fmt.Fprint(conn, "EHLO client\r\n")
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "250 echo EHLO client\r\n", line)
+}
+
+func TestFrontend_UnixSocketPeerRules(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on linux")
+	}
+	setupTestLogger(t)
+
+	cfg := &unixSocketConfig{AllowedUIDs: []int{os.Getuid() + 1}}
+	l := listenTestSocket(t, cfg)
+	fe := newFrontend("127.0.0.1:1", newPeerRegistry(), time.Minute, DefaultMaxEmailSize)
+	fe.serve(&frontendListener{Listener: l, unixSocket: cfg})
+
+	conn, err := net.Dial("unix", cfg.Path)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	reply, err := readReply(bufio.NewReader(conn))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(reply, "554 5.7.1 uid"), reply)
+}
+
+func TestUnixSocketConfig(t *testing.T) {
+	cfg := &unixSocketConfig{Path: "/run/mailrelay.sock"}
+	require.NoError(t, cfg.validate())
+	mode, err := cfg.mode()
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(defaultSocketMode), mode)
+	assert.True(t, cfg.allowed(1000, 1000))
+
+	cfg.AllowedUIDs = []int{0}
+	cfg.AllowedGIDs = []int{8}
+	assert.True(t, cfg.allowed(0, 1000))
+	assert.True(t, cfg.allowed(1000, 8))
+	assert.False(t, cfg.allowed(1000, 1000))
+
+	assert.Error(t, (&unixSocketConfig{}).validate())
+	assert.Error(t, (&unixSocketConfig{Path: "/x", Mode: "rw"}).validate())
+	assert.Error(t, (&unixSocketConfig{Path: "/x", Mode: "1777"}).validate())
+}
+
+func TestSenderAllowed(t *testing.T) {
+	AllowedSendersFilter = ipfilter.New(ipfilter.Options{
+		AllowedIPs:     []string{"192.168.1.0/24"},
+		BlockByDefault: true,
+	})
+	defer func() { AllowedSendersFilter = ipfilter.New(ipfilter.Options{}) }()
+
+	e := mail.NewEnvelope("10.0.0.1", 1)
+	assert.False(t, senderAllowed(e))
+
+	e.RemoteIP = "192.168.1.5"
+	assert.True(t, senderAllowed(e))
+
+	e.RemoteIP = "unix:1000:1000"
+	assert.False(t, senderAllowed(e))
+	e.Values[peerValueKey] = &peerInfo{addr: e.RemoteIP, trusted: true}
+	assert.True(t, senderAllowed(e))
+
+	// clients reported with XFORWARD are vouched for by the relay
+	e.RemoteIP = "10.0.0.1"
+	e.Values[peerValueKey] = &peerInfo{addr: e.RemoteIP, via: "192.168.1.5"}
+	assert.True(t, senderAllowed(e))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	defaultGmailBaseURL  = "https://gmail.googleapis.com"
+	defaultGmailTokenURL = "https://oauth2.googleapis.com/token"
+	gmailScope           = "https://www.googleapis.com/auth/gmail.send"
+	gmailMe              = "me"
+)
+
+// validateGmail validates the settings of the Gmail API transport. A refresh
+// token sends as its user; a service account sends as User through
+// domain-wide delegation.
+func (c *transportConfig) validateGmail() error {
+	switch {
+	case c.RefreshToken != "" && c.ServiceAccountFile != "":
+		return errors.New("gmail transport: use either refresh_token or service_account_file")
+	case c.RefreshToken != "" && (c.ClientID == "" || c.ClientSecret == ""):
+		return errors.New("gmail transport: client_id and client_secret are required with refresh_token")
+	case c.ServiceAccountFile != "" && c.User == "":
+		return errors.New("gmail transport: user is required with service_account_file")
+	case c.RefreshToken == "" && c.ServiceAccountFile == "":
+		return errors.New("gmail transport: refresh_token or service_account_file is required")
+	}
+	return nil
+}
+
+// gmailTransport relays messages with the Gmail API messages.send
+// endpoint, uploading the message as is.
+type gmailTransport struct {
+	api *apiClient
+	url string
+}
+
+func newGmailTransport(c *transportConfig, client *http.Client) (*gmailTransport, error) {
+	var key *serviceAccountKey
+	tokenURL := c.TokenURL
+	if c.ServiceAccountFile != "" {
+		var err error
+		if key, err = loadServiceAccountKey(c.ServiceAccountFile); err != nil {
+			return nil, err
+		}
+		if tokenURL == "" {
+			tokenURL = key.TokenURI
+		}
+	}
+	if tokenURL == "" {
+		tokenURL = defaultGmailTokenURL
+	}
+	var auth authorizer = newTokenSource(client, tokenURL, c.ClientID, c.ClientSecret, c.RefreshToken, gmailScope)
+	if key != nil {
+		auth = newServiceAccountTokenSource(client, tokenURL, key, gmailScope, c.User)
+	}
+	user := c.User
+	if user == "" {
+		user = gmailMe
+	}
+	return &gmailTransport{
+		api: &apiClient{name: "Gmail API", client: client, auth: auth},
+		url: c.baseURL() + "/upload/gmail/v1/users/" + url.PathEscape(user) +
+			"/messages/send?uploadType=media",
+	}, nil
+}
+
+func (t *gmailTransport) name() string {
+	return t.api.name
+}
+
+func (t *gmailTransport) send(e *mail.Envelope) error {
+	data := submittedMessage(e)
+	return t.api.do(e, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "message/rfc822")
+		return req, nil
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGmailTransport(t *testing.T) {
+	setupTestLogger(t)
+	api := startFakeAPI(t)
+	tr, err := newTransport(&transportConfig{Type: transportGmail, BaseURL: api.URL, TokenURL: api.URL + "/token",
+		ClientID: "app", ClientSecret: "secret", RefreshToken: "refresh"})
+	require.NoError(t, err)
+	assert.Equal(t, "Gmail API", tr.name())
+
+	require.NoError(t, tr.send(transportTestEnvelope()))
+	require.Len(t, api.requests, 1)
+	req := api.requests[0]
+	assert.Equal(t, "/upload/gmail/v1/users/me/messages/send", req.URL.Path)
+	assert.Equal(t, "media", req.URL.Query().Get("uploadType"))
+	assert.Equal(t, "Bearer token-1", req.Header.Get("Authorization"))
+	assert.Equal(t, "message/rfc822", req.Header.Get("Content-Type"))
+	assert.Equal(t, "From: backup@example.com\r\nTo: Ops <ops@example.com>\r\nSubject: nightly\r\n"+
+		"Bcc: audit@example.com\r\n\r\nbody\r\n", string(api.bodies[0]))
+
+	e := transportTestEnvelope()
+	e.RcptTo = e.RcptTo[1:]
+	require.NoError(t, tr.send(e))
+	assert.Equal(t, "From: backup@example.com\r\nSubject: nightly\r\nBcc: audit@example.com\r\n\r\nbody\r\n",
+		string(api.bodies[1]), "ops is not a recipient of this transaction")
+}
+
+func TestGmailTransport_ServiceAccount(t *testing.T) {
+	setupTestLogger(t)
+	api := startFakeAPI(t, http.StatusServiceUnavailable)
+	key, _ := writeServiceAccountKey(t, api.URL+"/token")
+	tr, err := newTransport(&transportConfig{Type: transportGmail, BaseURL: api.URL, ServiceAccountFile: key,
+		User: "relay@example.com"})
+	require.NoError(t, err)
+
+	err = tr.send(transportTestEnvelope())
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "451 "), err.Error())
+	require.NoError(t, tr.send(transportTestEnvelope()))
+	assert.Equal(t, 1, api.tokens, "the key file's token_uri is used")
+	assert.Equal(t, "/upload/gmail/v1/users/relay@example.com/messages/send", api.requests[1].URL.Path)
+
+	_, err = newTransport(&transportConfig{Type: transportGmail, ServiceAccountFile: filepath.Join(t.TempDir(), "x"),
+		User: "relay@example.com"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	defaultGraphBaseURL  = "https://graph.microsoft.com"
+	defaultGraphTokenURL = "https://login.microsoftonline.com/%s/oauth2/v2.0/token"
+	graphScope           = "https://graph.microsoft.com/.default"
+	graphMe              = "me"
+
+	graphFileAttachment = "#microsoft.graph.fileAttachment"
+	// graphNoFilename names attachments without a file name, which Graph
+	// requires.
+	graphNoFilename = "attachment"
+)
+
+// validateGraph validates the settings of the Microsoft Graph transport.
+// Client credentials send as User; a refresh token sends as its user unless
+// User is set.
+func (c *transportConfig) validateGraph() error {
+	switch {
+	case c.ClientID == "":
+		return errors.New("graph transport: client_id is required")
+	case c.RefreshToken == "" && c.ClientSecret == "":
+		return errors.New("graph transport: client_secret or refresh_token is required")
+	case c.RefreshToken == "" && c.User == "":
+		return errors.New("graph transport: user is required with client credentials")
+	case c.TenantID == "" && c.TokenURL == "":
+		return errors.New("graph transport: tenant_id is required")
+	}
+	return nil
+}
+
+// graphTransport relays messages with the Microsoft Graph sendMail
+// endpoint. The message is converted to JSON, as only that form takes the
+// recipients apart from the header: the From and Reply-To fields, the
+// subject, the HTML or else the text body and attachments are passed on.
+type graphTransport struct {
+	api *apiClient
+	url string
+}
+
+func newGraphTransport(c *transportConfig, client *http.Client) *graphTransport {
+	tokenURL := c.TokenURL
+	if tokenURL == "" {
+		tokenURL = fmt.Sprintf(defaultGraphTokenURL, url.PathEscape(c.TenantID))
+	}
+	user := graphMe
+	if c.User != "" {
+		user = "users/" + url.PathEscape(c.User)
+	}
+	return &graphTransport{
+		api: &apiClient{
+			name:   "Microsoft Graph",
+			client: client,
+			auth:   newTokenSource(client, tokenURL, c.ClientID, c.ClientSecret, c.RefreshToken, graphScope),
+		},
+		url: c.baseURL() + "/v1.0/" + user + "/sendMail",
+	}
+}
+
+func (t *graphTransport) name() string {
+	return t.api.name
+}
+
+type graphSendMail struct {
+	Message graphMessage `json:"message"`
+}
+
+type graphMessage struct {
+	Subject       string            `json:"subject"`
+	Body          graphBody         `json:"body"`
+	From          *graphRecipient   `json:"from,omitempty"`
+	ReplyTo       []graphRecipient  `json:"replyTo,omitempty"`
+	ToRecipients  []graphRecipient  `json:"toRecipients"`
+	CcRecipients  []graphRecipient  `json:"ccRecipients,omitempty"`
+	BccRecipients []graphRecipient  `json:"bccRecipients,omitempty"`
+	Attachments   []graphAttachment `json:"attachments,omitempty"`
+}
+
+type graphBody struct {
+	ContentType string `json:"contentType"`
+	Content     string `json:"content"`
+}
+
+type graphRecipient struct {
+	EmailAddress graphEmailAddress `json:"emailAddress"`
+}
+
+type graphEmailAddress struct {
+	Address string `json:"address"`
+	Name    string `json:"name,omitempty"`
+}
+
+type graphAttachment struct {
+	Type         string `json:"@odata.type"`
+	Name         string `json:"name"`
+	ContentType  string `json:"contentType"`
+	ContentBytes []byte `json:"contentBytes"`
+}
+
+// graphRecipients converts addresses to Graph recipients.
+func graphRecipients(addrs []*netmail.Address) []graphRecipient {
+	var rcpts []graphRecipient
+	for _, a := range addrs {
+		rcpts = append(rcpts, graphRecipient{EmailAddress: graphEmailAddress{Address: a.Address, Name: a.Name}})
+	}
+	return rcpts
+}
+
+// newGraphMessage converts the message to a sendMail request, delivered to
+// the envelope recipients only.
+func newGraphMessage(e *mail.Envelope) *graphSendMail {
+	msg := parseMessage(e.Data.Bytes())
+	c := parseContent(e.Data.Bytes())
+	r := envelopeRecipients(e, msg)
+	m := graphMessage{
+		Subject:       c.Subject,
+		Body:          graphBody{ContentType: "text", Content: c.Text},
+		ReplyTo:       graphRecipients(headerAddresses(msg, "Reply-To")),
+		ToRecipients:  graphRecipients(r.to),
+		CcRecipients:  graphRecipients(r.cc),
+		BccRecipients: graphRecipients(r.bcc),
+	}
+	if from := graphRecipients(headerAddresses(msg, "From")); len(from) > 0 {
+		m.From = &from[0]
+	}
+	if m.ToRecipients == nil {
+		m.ToRecipients = []graphRecipient{}
+	}
+	if c.HTML != "" {
+		m.Body = graphBody{ContentType: "html", Content: c.HTML}
+	}
+	for _, a := range c.Attachments {
+		m.Attachments = append(m.Attachments, graphAttachment{
+			Type:         graphFileAttachment,
+			Name:         cmp.Or(a.Filename, graphNoFilename),
+			ContentType:  a.ContentType,
+			ContentBytes: a.Content,
+		})
+	}
+	return &graphSendMail{Message: m}
+}
+
+func (t *graphTransport) send(e *mail.Envelope) error {
+	body, err := json.Marshal(newGraphMessage(e))
+	if err != nil {
+		return err
+	}
+	return t.api.do(e, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+}
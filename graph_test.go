@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphTransport(t *testing.T) {
+	setupTestLogger(t)
+	api := startFakeAPI(t)
+	tr, err := newTransport(&transportConfig{Type: transportGraph, BaseURL: api.URL + "/", TokenURL: api.URL + "/token",
+		ClientID: "app", ClientSecret: "secret", User: "relay@contoso.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "Microsoft Graph", tr.name())
+
+	require.NoError(t, tr.send(transportTestEnvelope()))
+	require.Len(t, api.requests, 1)
+	req := api.requests[0]
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "/v1.0/users/relay@contoso.com/sendMail", req.URL.Path)
+	assert.Equal(t, "Bearer token-1", req.Header.Get("Authorization"))
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"message": {
+		"subject": "nightly",
+		"body": {"contentType": "text", "content": "body\n"},
+		"from": {"emailAddress": {"address": "backup@example.com"}},
+		"toRecipients": [{"emailAddress": {"address": "ops@example.com", "name": "Ops"}}],
+		"bccRecipients": [{"emailAddress": {"address": "audit@example.com"}}]
+	}}`, string(api.bodies[0]))
+
+	require.NoError(t, tr.send(transportTestEnvelope()))
+	assert.Equal(t, 1, api.tokens, "the access token is reused")
+}
+
+func TestNewGraphMessage(t *testing.T) {
+	e := transportTestEnvelope()
+	e.RcptTo = e.RcptTo[1:]
+	e.Data.Reset()
+	e.Data.WriteString("From: Backup <backup@example.com>\r\nReply-To: admin@example.com\r\n" +
+		"To: Ops <ops@example.com>\r\nCc: Audit <audit@example.com>\r\nSubject: nightly\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>done</p>\r\n" +
+		"--b\r\nContent-Type: text/csv; name=sizes.csv\r\n\r\nsize,10\r\n--b--\r\n")
+
+	m := newGraphMessage(e).Message
+	assert.Empty(t, m.ToRecipients, "header recipients outside the envelope get no copy")
+	assert.Equal(t, []graphRecipient{{EmailAddress: graphEmailAddress{Address: "audit@example.com", Name: "Audit"}}},
+		m.CcRecipients)
+	assert.Empty(t, m.BccRecipients)
+	assert.Equal(t, &graphRecipient{EmailAddress: graphEmailAddress{Address: "backup@example.com", Name: "Backup"}},
+		m.From)
+	assert.Equal(t, []graphRecipient{{EmailAddress: graphEmailAddress{Address: "admin@example.com"}}}, m.ReplyTo)
+	assert.Equal(t, graphBody{ContentType: "html", Content: "<p>done</p>\n"}, m.Body)
+	assert.Equal(t, []graphAttachment{{Type: graphFileAttachment, Name: "sizes.csv", ContentType: "text/csv",
+		ContentBytes: []byte("size,10\r\n")}}, m.Attachments)
+}
+
+func TestGraphTransport_Errors(t *testing.T) {
+	setupTestLogger(t)
+	api := startFakeAPI(t, http.StatusTooManyRequests, http.StatusBadRequest)
+	tr, err := newTransport(&transportConfig{Type: transportGraph, BaseURL: api.URL, TokenURL: api.URL + "/token",
+		ClientID: "app", RefreshToken: "refresh"})
+	require.NoError(t, err)
+
+	err = tr.send(transportTestEnvelope())
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "451 "), err.Error())
+	err = tr.send(transportTestEnvelope())
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "554 "), err.Error())
+	assert.Equal(t, "/v1.0/me/sendMail", api.requests[0].URL.Path, "refresh tokens send as their user")
+}
+
+func TestGraphTransport_DefaultURLs(t *testing.T) {
+	tr := newGraphTransport(&transportConfig{Type: transportGraph, TenantID: "contoso", ClientID: "app",
+		ClientSecret: "secret", User: "relay@contoso.com"}, http.DefaultClient)
+	assert.Equal(t, "https://graph.microsoft.com/v1.0/users/relay@contoso.com/sendMail", tr.url)
+	ts, ok := tr.api.auth.(*tokenSource)
+	require.True(t, ok)
+	assert.Equal(t, "https://login.microsoftonline.com/contoso/oauth2/v2.0/token", ts.tokenURL)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	headerActionAdd    = "add"
+	headerActionSet    = "set"
+	headerActionRemove = "remove"
+)
+
+// headerRuleConfig is a single header manipulation rule. Rules are applied in
+// the order they are configured.
+//
+// Value is a Go template that may reference the fields of headerTemplateData,
+// e.g. "{{.RemoteIP}}". Match is an optional regular expression that limits
+// remove to fields whose value matches.
+type headerRuleConfig struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Match  string `json:"match"`
+}
+
+// headerTemplateData holds the values available to header rule templates.
+type headerTemplateData struct {
+	RemoteIP  string
+	Helo      string
+	MailFrom  string
+	RcptTo    string
+	QueueID   string
+	Hostname  string
+	Timestamp string
+	TLS       bool
+}
+
+type headerRule struct {
+	action string
+	name   string
+	value  *template.Template
+	match  *regexp.Regexp
+}
+
+// compileHeaderRules validates and compiles header rules.
+func compileHeaderRules(configs []headerRuleConfig) ([]*headerRule, error) {
+	rules := make([]*headerRule, 0, len(configs))
+	for i, c := range configs {
+		r, err := c.compile()
+		if err != nil {
+			return nil, fmt.Errorf("header_rules[%d]: %w", i, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func (c *headerRuleConfig) compile() (*headerRule, error) {
+	if !validHeaderName(c.Name) {
+		return nil, fmt.Errorf("invalid header name %q", c.Name)
+	}
+	r := &headerRule{action: c.Action, name: c.Name}
+	switch c.Action {
+	case headerActionAdd, headerActionSet:
+		if c.Value == "" {
+			return nil, fmt.Errorf("%s requires a value", c.Action)
+		}
+		if c.Match != "" {
+			return nil, fmt.Errorf("match is only supported by %s", headerActionRemove)
+		}
+	case headerActionRemove:
+	default:
+		return nil, fmt.Errorf("unknown action %q", c.Action)
+	}
+
+	var err error
+	if r.value, err = template.New(c.Name).Parse(c.Value); err != nil {
+		return nil, err
+	}
+	// catch references to unknown fields now rather than for every message
+	if err = r.value.Execute(io.Discard, &headerTemplateData{}); err != nil {
+		return nil, err
+	}
+	if c.Match != "" {
+		if r.match, err = regexp.Compile(c.Match); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// validHeaderName returns true if name only contains printable US-ASCII
+// characters other than colon, as required by RFC 5322.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' || name[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+func newHeaderTemplateData(e *mail.Envelope) *headerTemplateData {
+	rcpts := make([]string, 0, len(e.RcptTo))
+	for i := range e.RcptTo {
+		rcpts = append(rcpts, e.RcptTo[i].String())
+	}
+	return &headerTemplateData{
+		RemoteIP:  e.RemoteIP,
+		Helo:      e.Helo,
+		MailFrom:  e.MailFrom.String(),
+		RcptTo:    strings.Join(rcpts, ", "),
+		QueueID:   e.QueuedId,
+		Hostname:  localHostname(),
+		Timestamp: time.Now().Format(time.RFC1123Z),
+		TLS:       e.TLS,
+	}
+}
+
+// applyHeaderRules applies the rules to the message in order.
+func applyHeaderRules(e *mail.Envelope, rules []*headerRule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	data := newHeaderTemplateData(e)
+	msg := parseMessage(e.Data.Bytes())
+	for _, r := range rules {
+		if err := r.apply(e, msg, data); err != nil {
+			return fmt.Errorf("header rule %s %s: %w", r.action, r.name, err)
+		}
+	}
+	replaceData(e, msg.bytes())
+	return nil
+}
+
+func (r *headerRule) apply(e *mail.Envelope, msg *message, data *headerTemplateData) error {
+	if r.action == headerActionRemove {
+		n := msg.delFunc(r.name, r.matches)
+		if n > 0 {
+			msgLog(e).Debugf("removed %d %s header(s)", n, r.name)
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := r.value.Execute(&buf, data); err != nil {
+		return err
+	}
+	// never let a templated value inject additional header lines
+	value := strings.Join(strings.Fields(buf.String()), " ")
+	if value == "" {
+		return errors.New("value is empty")
+	}
+
+	if r.action == headerActionAdd {
+		msg.add(r.name, value)
+		return nil
+	}
+	msg.set(r.name, value)
+	return nil
+}
+
+func (r *headerRule) matches(value string) bool {
+	return r.match == nil || r.match.MatchString(value)
+}
+
+// headerRulesProcessor decorator adds, replaces and removes header fields.
+var headerRulesProcessor = func() backends.Decorator {
+	var rules []*headerRule
+	initFunc := backends.InitializeWith(func(backendConfig backends.BackendConfig) error {
+		configs, ok := backendConfig["header_rules"].([]headerRuleConfig)
+		if !ok {
+			return nil
+		}
+		var err error
+		rules, err = compileHeaderRules(configs)
+		return err
+	})
+	backends.Svc.AddInitializer(initFunc)
+
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail {
+					if err := applyHeaderRules(e, rules); err != nil {
+						msgLog(e).WithError(err).Error("applying header rules")
+						return backends.NewResult(err.Error()), err
+					}
+				}
+				return p.Process(e, task)
+			},
+		)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyHeaderRules(t *testing.T) {
+	setupTestLogger(t)
+	rules, err := compileHeaderRules([]headerRuleConfig{
+		{Action: headerActionRemove, Name: "Received", Match: `\b(10|192\.168)\.`},
+		{Action: headerActionAdd, Name: "X-Source-Device", Value: "{{.RemoteIP}} ({{.Helo}})"},
+		{Action: headerActionSet, Name: "X-Mailer", Value: "mailrelay for {{.MailFrom}}"},
+		{Action: headerActionAdd, Name: "X-Relayed-By", Value: "{{.Hostname}} at {{.Timestamp}}"},
+	})
+	require.NoError(t, err)
+
+	e := &mail.Envelope{
+		RemoteIP: "192.168.1.50",
+		Helo:     "scanner",
+		MailFrom: mail.Address{User: "scanner", Host: "lan"},
+		Data: *bytes.NewBufferString("Received: from scanner ([192.168.1.50])\r\n" +
+			"Received: from mx.example.com ([203.0.113.5])\r\n" +
+			"X-Mailer: ScanOS 1.0\r\n" +
+			"Subject: scan\r\n\r\nbody\r\n"),
+	}
+	require.NoError(t, applyHeaderRules(e, rules))
+
+	msg := parseMessage(e.Data.Bytes())
+	assert.Equal(t, []string{"from mx.example.com ([203.0.113.5])"}, msg.values("Received"))
+	assert.Equal(t, "192.168.1.50 (scanner)", msg.get("X-Source-Device"))
+	assert.Equal(t, []string{"mailrelay for scanner@lan"}, msg.values("X-Mailer"))
+	assert.NotEmpty(t, msg.get("X-Relayed-By"))
+	assert.Equal(t, "scan", msg.get("Subject"))
+	assert.Equal(t, "body\r\n", string(msg.body))
+}
+
+func TestApplyHeaderRules_NoHeaderInjection(t *testing.T) {
+	setupTestLogger(t)
+	rules, err := compileHeaderRules([]headerRuleConfig{
+		{Action: headerActionAdd, Name: "X-Helo", Value: "{{.Helo}}"},
+	})
+	require.NoError(t, err)
+
+	e := &mail.Envelope{
+		Helo: "evil\r\nBcc: victim@example.com",
+		Data: *bytes.NewBufferString("Subject: s\r\n\r\nbody\r\n"),
+	}
+	require.NoError(t, applyHeaderRules(e, rules))
+	assert.False(t, strings.Contains(e.Data.String(), "\r\nBcc:"))
+	assert.Equal(t, "evil Bcc: victim@example.com", parseMessage(e.Data.Bytes()).get("X-Helo"))
+}
+
+func TestCompileHeaderRules_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule headerRuleConfig
+	}{
+		{name: "unknown action", rule: headerRuleConfig{Action: "rename", Name: "X-A", Value: "v"}},
+		{name: "bad name", rule: headerRuleConfig{Action: headerActionAdd, Name: "X A", Value: "v"}},
+		{name: "missing value", rule: headerRuleConfig{Action: headerActionSet, Name: "X-A"}},
+		{name: "bad template", rule: headerRuleConfig{Action: headerActionAdd, Name: "X-A", Value: "{{.RemoteIP"}},
+		{name: "unknown field", rule: headerRuleConfig{Action: headerActionAdd, Name: "X-A", Value: "{{.Nope}}"}},
+		{name: "bad match", rule: headerRuleConfig{Action: headerActionRemove, Name: "X-A", Match: "("}},
+		{name: "match on add", rule: headerRuleConfig{Action: headerActionAdd, Name: "X-A", Value: "v", Match: "x"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileHeaderRules([]headerRuleConfig{tt.rule})
+			assert.Error(t, err)
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 	"time"
 
@@ -202,6 +203,7 @@ func TestSendMail_IPFiltering_Blocked(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "192.168.1.100")
 	assert.Contains(t, err.Error(), "not allowed to send email")
+	assert.True(t, strings.HasPrefix(err.Error(), "554 5.7.1 "), "the rejection is permanent")
 
 	// Verify no email was sent to the server
 	conn := server.GetLastConnection()
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/phires/go-guerrilla/mail/rfc5321"
+)
+
+const (
+	// listener names for lenient listeners
+	listenerSMTP       = "smtp"
+	listenerUnixSocket = "unix_socket"
+
+	// unknownHelo replaces HELO names that cannot be repaired.
+	unknownHelo = "unknown"
+)
+
+// pathCommand matches MAIL FROM and RCPT TO commands with any spacing.
+var pathCommand = regexp.MustCompile(`(?i)^\s*(MAIL\s+FROM|RCPT\s+TO)\s*:\s*(.*?)\s*$`)
+
+// lenientConfig accepts common SMTP protocol violations from broken clients
+// and rewrites the commands so that the SMTP server accepts them. Listeners
+// lists the listeners whose clients may be broken, "smtp" or "unix_socket",
+// and Sources their IP addresses or CIDR ranges. All SMTP clients are
+// treated leniently if both are empty.
+type lenientConfig struct {
+	Listeners []string `json:"listeners"`
+	Sources   []string `json:"sources"`
+}
+
+func (c *lenientConfig) validate() error {
+	for _, l := range c.Listeners {
+		if l != listenerSMTP && l != listenerUnixSocket {
+			return fmt.Errorf("lenient: unknown listener %q", l)
+		}
+	}
+	for _, s := range c.Sources {
+		if _, err := parsePrefix(s); err != nil {
+			return fmt.Errorf("lenient: %w", err)
+		}
+	}
+	return nil
+}
+
+// applies returns true if the client at addr, connected to the named
+// listener, is treated leniently.
+func (c *lenientConfig) applies(listener, addr string) bool {
+	if len(c.Listeners) == 0 && len(c.Sources) == 0 {
+		return true
+	}
+	return slices.Contains(c.Listeners, listener) || ipInList(addr, c.Sources)
+}
+
+// lenientCommand rewrites a command the SMTP server would reject as a
+// syntax error into one it accepts. It returns false for valid commands and
+// those it cannot repair, which are passed on unchanged.
+func lenientCommand(line string) (string, bool) {
+	cmd := strings.TrimLeft(strings.TrimRight(line, "\r\n"), " \t")
+	var fixed string
+	var ok bool
+	switch commandVerb(cmd) {
+	case "HELO", "EHLO":
+		fixed, ok = lenientHello(cmd)
+	case "MAIL", "RCPT":
+		fixed, ok = lenientPath(cmd)
+	default:
+		return "", false
+	}
+	if !ok && len(cmd) < len(strings.TrimRight(line, "\r\n")) {
+		// leading whitespace is a syntax error too
+		return cmd + "\r\n", true
+	}
+	return fixed, ok
+}
+
+// validHello returns true if the SMTP server accepts a HELO or EHLO command.
+func validHello(cmd string) bool {
+	var p rfc5321.Parser
+	if strings.EqualFold(cmd[:4], "HELO") {
+		_, err := p.Helo([]byte(cmd[4:]))
+		return err == nil
+	}
+	_, _, err := p.Ehlo([]byte(cmd[4:]))
+	return err == nil
+}
+
+// lenientHello repairs HELO and EHLO names, replacing characters not allowed
+// in domain names with '-'. A missing or unusable name becomes "unknown".
+func lenientHello(cmd string) (string, bool) {
+	if len(cmd) < len("HELO") || validHello(cmd) {
+		return "", false
+	}
+	verb := strings.ToUpper(cmd[:4])
+	name := ""
+	if fields := strings.Fields(cmd[4:]); len(fields) > 0 {
+		name = strings.Trim(strings.Map(domainRune, fields[0]), "-.")
+	}
+	fixed := verb + " " + name
+	if name == "" || !validHello(fixed) {
+		fixed = verb + " " + unknownHelo
+	}
+	return fixed + "\r\n", true
+}
+
+// domainRune maps runes not allowed in domain names to '-'.
+func domainRune(r rune) rune {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+		return r
+	default:
+		return '-'
+	}
+}
+
+// lenientPath repairs MAIL FROM and RCPT TO commands with spaces around the
+// colon, a path without angle brackets, or extra spaces.
+func lenientPath(cmd string) (string, bool) {
+	m := pathCommand.FindStringSubmatch(cmd)
+	if m == nil || m[2] == "" {
+		return "", false
+	}
+	prefix := strings.ToUpper(strings.Join(strings.Fields(m[1]), " ")) + ":"
+	parse := pathParser(prefix)
+	if strings.HasPrefix(strings.ToUpper(cmd), prefix) && parse(cmd[len(prefix):]) == nil {
+		return "", false
+	}
+
+	arg := m[2]
+	var path, params string
+	if i := strings.IndexByte(arg, '<'); i >= 0 && strings.IndexByte(arg[i:], '>') > 0 {
+		// a display name before the path is dropped
+		j := i + strings.IndexByte(arg[i:], '>')
+		path, params = arg[i+1:j], arg[j+1:]
+	} else {
+		fields := strings.Fields(arg)
+		path, params = strings.Trim(fields[0], "<>"), strings.Join(fields[1:], " ")
+	}
+	fixed := prefix + "<" + strings.TrimSpace(path) + ">"
+	if params = strings.Join(strings.Fields(params), " "); params != "" {
+		fixed += " " + params
+	}
+	if parse(fixed[len(prefix):]) != nil {
+		return "", false
+	}
+	return fixed + "\r\n", true
+}
+
+// pathParser returns the SMTP server's parser for the argument of a MAIL FROM
+// or RCPT TO command.
+func pathParser(prefix string) func(string) error {
+	var p rfc5321.Parser
+	return func(arg string) error {
+		if prefix == "MAIL FROM:" {
+			return p.MailFrom([]byte(arg))
+		}
+		return p.RcptTo([]byte(arg))
+	}
+}
+
+// normalize rewrites broken commands from lenient clients.
+func (s *smtpSession) normalize(line string) string {
+	if !s.lenient {
+		return line
+	}
+	fixed, ok := lenientCommand(line)
+	if !ok {
+		return line
+	}
+	Logger.Infof("lenient: rewrote %q from %s as %q", strings.TrimRight(line, "\r\n"), s.current.addr,
+		strings.TrimRight(fixed, "\r\n"))
+	return fixed
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLenientCommand(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		// valid commands are passed on unchanged
+		{line: "MAIL FROM:<app@example.com>\r\n"},
+		{line: "MAIL FROM: <app@example.com> SIZE=100\r\n"},
+		{line: "mail from:<>\r\n"},
+		{line: "RCPT TO:<a@example.com>\r\n"},
+		{line: "EHLO printer.lan\r\n"},
+		{line: "EHLO [10.0.5.20]\r\n"},
+		{line: "NOOP\r\n"},
+		// broken commands are repaired
+		{line: "MAIL FROM:app@example.com\r\n", expected: "MAIL FROM:<app@example.com>\r\n"},
+		{line: "MAIL FROM : <app@example.com>\r\n", expected: "MAIL FROM:<app@example.com>\r\n"},
+		{line: "mail  from:app@example.com  SIZE=100 \r\n", expected: "MAIL FROM:<app@example.com> SIZE=100\r\n"},
+		{line: "MAIL FROM:<app@example.com> \r\n", expected: "MAIL FROM:<app@example.com>\r\n"},
+		{line: "MAIL FROM:Scanner <scanner@example.com>\r\n", expected: "MAIL FROM:<scanner@example.com>\r\n"},
+		{line: "MAIL FROM:<app@example.com\r\n", expected: "MAIL FROM:<app@example.com>\r\n"},
+		{line: "RCPT TO: a@example.com\r\n", expected: "RCPT TO:<a@example.com>\r\n"},
+		{line: "  RCPT TO:<a@example.com>\r\n", expected: "RCPT TO:<a@example.com>\r\n"},
+		{line: "HELO\r\n", expected: "HELO unknown\r\n"},
+		{line: "ehlo \r\n", expected: "EHLO unknown\r\n"},
+		{line: "HELO printer_1.lan\r\n", expected: "HELO printer-1.lan\r\n"},
+		{line: "EHLO My Printer\r\n", expected: "EHLO My\r\n"},
+		{line: "HELO [10.0.5.20]\r\n", expected: "HELO 10.0.5.20\r\n"},
+		{line: "HELO ___\r\n", expected: "HELO unknown\r\n"},
+		// commands that cannot be repaired are passed on
+		{line: "MAIL FROM:\r\n"},
+		{line: "MAIL FROM:root\r\n"},
+		{line: "RCPT TO:<a b@example.com>\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			fixed, ok := lenientCommand(tt.line)
+			assert.Equal(t, tt.expected != "", ok)
+			assert.Equal(t, tt.expected, fixed)
+		})
+	}
+}
+
+func TestLenientConfig(t *testing.T) {
+	c := &lenientConfig{Listeners: []string{listenerUnixSocket}, Sources: []string{"10.0.5.0/24"}}
+	require.NoError(t, c.validate())
+	assert.True(t, c.applies(listenerUnixSocket, "unix:0:0"))
+	assert.True(t, c.applies(listenerSMTP, "10.0.5.20"))
+	assert.False(t, c.applies(listenerSMTP, "10.0.6.1"))
+	assert.True(t, (&lenientConfig{}).applies(listenerSMTP, "192.0.2.1"))
+
+	assert.Error(t, (&lenientConfig{Listeners: []string{"lmtp"}}).validate())
+	assert.Error(t, (&lenientConfig{Sources: []string{"printers"}}).validate())
+}
+
+func TestSMTPSession_Lenient(t *testing.T) {
+	setupTestLogger(t)
+	backendAddr, server := startFakeSMTPServer(t)
+	fe := newFrontend(backendAddr, newPeerRegistry(), time.Minute, DefaultMaxEmailSize)
+	serve := func(lenient *lenientConfig) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+		fe.serve(&frontendListener{Listener: l, lenient: lenient})
+		return l.Addr().String()
+	}
+	send := func(addr, rcpt string) {
+		r, conn := dialSMTP(t, addr)
+		assert.True(t, isPositive(lmtpExchange(t, r, conn, "EHLO")))
+		assert.True(t, isPositive(lmtpExchange(t, r, conn, "MAIL FROM: app@example.com")))
+		assert.True(t, isPositive(lmtpExchange(t, r, conn, rcpt)))
+		assert.Contains(t, lmtpExchange(t, r, conn, "DATA"), "354")
+		fmt.Fprint(conn, "Subject: test\r\n\r\nbody\r\n")
+		assert.True(t, isPositive(lmtpExchange(t, r, conn, ".")))
+	}
+
+	send(serve(&lenientConfig{Sources: []string{"127.0.0.1"}}), "RCPT TO:lenient@example.com")
+	send(serve(&lenientConfig{Sources: []string{"10.0.5.0/24"}}), "RCPT TO:other@example.com")
+	send(serve(nil), "RCPT TO:strict@example.com")
+
+	deliveries := server.deliveries()
+	assert.Contains(t, deliveries, "RCPT TO:<lenient@example.com>")
+	assert.Contains(t, deliveries, "RCPT TO:other@example.com", "other clients are passed on unchanged")
+	assert.Contains(t, deliveries, "RCPT TO:strict@example.com", "strict is the default")
+}
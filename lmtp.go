@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// lmtpConfig configures the LMTP (RFC 2033) listeners. Either or both of a
+// TCP address and a Unix socket may be given.
+type lmtpConfig struct {
+	Listen     string            `json:"listen"`
+	UnixSocket *unixSocketConfig `json:"unix_socket"`
+}
+
+func (c *lmtpConfig) validate() error {
+	if c.Listen == "" && c.UnixSocket == nil {
+		return errors.New("lmtp: listen or unix_socket is required")
+	}
+	if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			return fmt.Errorf("lmtp: invalid listen address %q", c.Listen)
+		}
+	}
+	if c.UnixSocket != nil {
+		if err := c.UnixSocket.validate(); err != nil {
+			return fmt.Errorf("lmtp: %w", err)
+		}
+	}
+	return nil
+}
+
+// lmtpSession translates an LMTP client session into SMTP transactions with
+// the SMTP server.
+//
+// LMTP returns a reply for every accepted recipient after DATA. To make those
+// replies meaningful, the message is relayed in a separate transaction for
+// each recipient, so a recipient rejected upstream fails alone. The
+// recipients given before DATA are checked against the server in a
+// transaction that is discarded once the message has been read.
+type lmtpSession struct {
+	*proxySession
+	maxSize int64
+
+	mailCmd  string
+	rcptCmds []string
+}
+
+func newLMTPSession(client, backend net.Conn, timeout time.Duration, maxSize int64) *lmtpSession {
+	return &lmtpSession{proxySession: newProxySession(client, backend, timeout), maxSize: maxSize}
+}
+
+// run handles client commands until the client quits or either side fails.
+func (s *lmtpSession) run() {
+	s.proxySession.run(s.handle)
+}
+
+// handle handles a single client command. It returns true once the session
+// is over.
+func (s *lmtpSession) handle(line string) (bool, error) {
+	switch verb := commandVerb(line); verb {
+	case "LHLO":
+		s.reset()
+		return false, s.forward("EHLO" + line[len(verb):])
+	case "HELO", "EHLO":
+		s.reply("500 5.5.1 LMTP requires LHLO\r\n")
+	case "XCLIENT", "XFORWARD", "STARTTLS", "BDAT":
+		s.reply("502 5.5.1 Command not implemented\r\n")
+	case "MAIL":
+		r, err := s.command(line)
+		if err == nil && isPositive(r) {
+			s.mailCmd, s.rcptCmds = line, nil
+			s.setTransaction(true)
+		}
+		s.reply(r)
+		return false, err
+	case "RCPT":
+		r, err := s.command(line)
+		if err == nil && isPositive(r) {
+			s.rcptCmds = append(s.rcptCmds, line)
+		}
+		s.reply(r)
+		return false, err
+	case "DATA":
+		return false, s.data()
+	case "RSET":
+		s.reset()
+		return false, s.forward(line)
+	case "QUIT":
+		return true, s.forward(line)
+	default:
+		return false, s.forward(line)
+	}
+	return false, nil
+}
+
+func (s *lmtpSession) reset() {
+	s.mailCmd, s.rcptCmds = "", nil
+	s.setTransaction(false)
+}
+
+// data reads the message and relays it to each accepted recipient,
+// replying once per recipient.
+func (s *lmtpSession) data() error {
+	switch {
+	case s.mailCmd == "":
+		s.reply("503 5.5.1 Error: need MAIL command\r\n")
+		return nil
+	case len(s.rcptCmds) == 0:
+		s.reply("503 5.5.1 Error: need RCPT command\r\n")
+		return nil
+	}
+	s.reply("354 Start mail input; end with <CRLF>.<CRLF>\r\n")
+
+	msg, tooBig, err := s.readMessage()
+	if err != nil {
+		return err
+	}
+	mailCmd, rcptCmds := s.mailCmd, s.rcptCmds
+	s.reset()
+
+	// discard the transaction used to check the recipients
+	if _, err := s.command("RSET\r\n"); err != nil {
+		return err
+	}
+	for _, rcptCmd := range rcptCmds {
+		if tooBig {
+			s.reply("552 5.3.4 Error: maximum message size exceeded\r\n")
+			continue
+		}
+		r, err := s.deliver(mailCmd, rcptCmd, msg)
+		if err != nil {
+			return err
+		}
+		s.reply(r)
+	}
+	return nil
+}
+
+// readMessage reads the message up to the terminating dot line. The message
+// is kept dot-stuffed, as it is passed on unchanged. If the message exceeds
+// the size limit it is read to the end but not kept.
+func (s *lmtpSession) readMessage() ([]byte, bool, error) {
+	var buf bytes.Buffer
+	tooBig := false
+	for {
+		line, err := s.readDataLine()
+		if err != nil {
+			return nil, false, err
+		}
+		if strings.TrimRight(line, "\r\n") == "." {
+			return buf.Bytes(), tooBig, nil
+		}
+		if tooBig {
+			continue
+		}
+		if int64(buf.Len()+len(line)) > s.maxSize {
+			tooBig = true
+			buf.Reset()
+			continue
+		}
+		buf.WriteString(line)
+	}
+}
+
+// deliver relays the message to a single recipient and returns the reply
+// for that recipient.
+func (s *lmtpSession) deliver(mailCmd, rcptCmd string, msg []byte) (string, error) {
+	r, err := s.command(mailCmd)
+	if err == nil && isPositive(r) {
+		r, err = s.command(rcptCmd)
+	}
+	if err == nil && isPositive(r) {
+		r, err = s.command("DATA\r\n")
+		if err == nil && strings.HasPrefix(r, "3") {
+			if err := s.send(string(msg)); err != nil {
+				return "", err
+			}
+			return s.command(".\r\n")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	// end the failed transaction before the next recipient
+	_, err = s.command("RSET\r\n")
+	return r, err
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMTPServer is a minimal SMTP server standing in for the relay's SMTP
+// server behind the frontend. It rejects RCPT for "bad@" recipients and
+// fails delivery after DATA for "fail@" recipients.
+type fakeSMTPServer struct {
+	mu        sync.Mutex
+	delivered map[string]string // recipient command -> message
+}
+
+func startFakeSMTPServer(t *testing.T) (string, *fakeSMTPServer) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	s := &fakeSMTPServer{delivered: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return l.Addr().String(), s
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 test.local SMTP\r\n")
+	var rcpts []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			fmt.Fprint(conn, "250-test.local Hello\r\n250 PIPELINING\r\n")
+		case strings.HasPrefix(cmd, "RCPT") && strings.Contains(cmd, "<bad@"):
+			fmt.Fprint(conn, "550 5.1.1 no such user\r\n")
+		case strings.HasPrefix(cmd, "RCPT"):
+			rcpts = append(rcpts, cmd)
+			fmt.Fprint(conn, "250 2.1.5 OK\r\n")
+		case cmd == "RSET":
+			rcpts = nil
+			fmt.Fprint(conn, "250 2.1.0 OK\r\n")
+		case cmd == "DATA":
+			fmt.Fprint(conn, "354 go ahead\r\n")
+			s.readData(conn, r, rcpts)
+			rcpts = nil
+		case cmd == "QUIT":
+			fmt.Fprint(conn, "221 2.0.0 Bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 2.1.0 OK\r\n")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) readData(conn net.Conn, r *bufio.Reader, rcpts []string) {
+	var sb strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil || line == ".\r\n" {
+			break
+		}
+		sb.WriteString(line)
+	}
+	if len(rcpts) == 1 && strings.Contains(rcpts[0], "<fail@") {
+		fmt.Fprint(conn, "dial error: upstream failed\r\n")
+		return
+	}
+	s.mu.Lock()
+	for _, rcpt := range rcpts {
+		s.delivered[rcpt] = sb.String()
+	}
+	s.mu.Unlock()
+	fmt.Fprint(conn, "250 2.0.0 OK: queued as ABC\r\n")
+}
+
+func (s *fakeSMTPServer) deliveries() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make(map[string]string, len(s.delivered))
+	for k, v := range s.delivered {
+		ret[k] = v
+	}
+	return ret
+}
+
+func dialLMTP(t *testing.T, maxSize int64) (*bufio.Reader, net.Conn, *fakeSMTPServer) {
+	t.Helper()
+	setupTestLogger(t)
+	backendAddr, server := startFakeSMTPServer(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	fe := newFrontend(backendAddr, newPeerRegistry(), time.Minute, maxSize)
+	fe.serve(&frontendListener{Listener: l, lmtp: true})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	greeting, err := readReply(r)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(greeting, "220 "))
+	return r, conn, server
+}
+
+// lmtpExchange sends a command and returns the reply.
+func lmtpExchange(t *testing.T, r *bufio.Reader, conn net.Conn, cmd string) string {
+	t.Helper()
+	fmt.Fprint(conn, cmd+"\r\n")
+	reply, err := readReply(r)
+	require.NoError(t, err)
+	return reply
+}
+
+func TestLMTP_PerRecipientReplies(t *testing.T) {
+	r, conn, server := dialLMTP(t, DefaultMaxEmailSize)
+
+	assert.Equal(t, "500 5.5.1 LMTP requires LHLO\r\n", lmtpExchange(t, r, conn, "EHLO client"))
+	assert.Contains(t, lmtpExchange(t, r, conn, "LHLO client"), "250 PIPELINING")
+	assert.Contains(t, lmtpExchange(t, r, conn, "DATA"), "503")
+	assert.True(t, isPositive(lmtpExchange(t, r, conn, "MAIL FROM:<app@example.com>")))
+	assert.True(t, isPositive(lmtpExchange(t, r, conn, "RCPT TO:<a@example.com>")))
+	assert.Contains(t, lmtpExchange(t, r, conn, "RCPT TO:<bad@example.com>"), "550")
+	assert.True(t, isPositive(lmtpExchange(t, r, conn, "RCPT TO:<fail@example.com>")))
+	assert.True(t, isPositive(lmtpExchange(t, r, conn, "RCPT TO:<b@example.com>")))
+	assert.Contains(t, lmtpExchange(t, r, conn, "DATA"), "354")
+
+	fmt.Fprint(conn, "Subject: test\r\n\r\n..leading dot\r\n.\r\n")
+	var replies []string
+	for i := 0; i < 3; i++ {
+		reply, err := readReply(r)
+		require.NoError(t, err)
+		replies = append(replies, reply)
+	}
+	assert.Equal(t, []string{
+		"250 2.0.0 OK: queued as ABC\r\n",
+		"451 4.3.0 dial error: upstream failed\r\n",
+		"250 2.0.0 OK: queued as ABC\r\n",
+	}, replies)
+
+	delivered := server.deliveries()
+	assert.Len(t, delivered, 2)
+	assert.Equal(t, "Subject: test\r\n\r\n..leading dot\r\n", delivered["RCPT TO:<a@example.com>"])
+	assert.Contains(t, delivered, "RCPT TO:<b@example.com>")
+
+	assert.Equal(t, "221 2.0.0 Bye\r\n", lmtpExchange(t, r, conn, "QUIT"))
+}
+
+func TestLMTP_MessageTooBig(t *testing.T) {
+	r, conn, server := dialLMTP(t, 10)
+
+	lmtpExchange(t, r, conn, "LHLO client")
+	lmtpExchange(t, r, conn, "MAIL FROM:<app@example.com>")
+	lmtpExchange(t, r, conn, "RCPT TO:<a@example.com>")
+	lmtpExchange(t, r, conn, "RCPT TO:<b@example.com>")
+	lmtpExchange(t, r, conn, "DATA")
+
+	fmt.Fprint(conn, "Subject: a message longer than ten bytes\r\n.\r\n")
+	for i := 0; i < 2; i++ {
+		reply, err := readReply(r)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(reply, "552 "), reply)
+	}
+	assert.Empty(t, server.deliveries())
+}
+
+func TestLMTPConfig_Validate(t *testing.T) {
+	assert.NoError(t, (&lmtpConfig{Listen: "127.0.0.1:24"}).validate())
+	assert.NoError(t, (&lmtpConfig{UnixSocket: &unixSocketConfig{Path: "/run/lmtp.sock"}}).validate())
+	assert.Error(t, (&lmtpConfig{}).validate())
+	assert.Error(t, (&lmtpConfig{Listen: "24"}).validate())
+	assert.Error(t, (&lmtpConfig{UnixSocket: &unixSocketConfig{}}).validate())
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile is a no-op on platforms without flock.
+func lockFile(_ *os.File) error {
+	return nil
+}
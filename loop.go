@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// loopMarkerHeader is added to every relayed message. Unlike Received headers
+// it is not removed by typical header rules, so loops are detected even when
+// trace headers are stripped.
+const loopMarkerHeader = "X-Mailrelay-Loop"
+
+type loopConfig struct {
+	MaxHops int `json:"max_hops"`
+}
+
+// countHops returns the number of hops the message has already taken.
+func countHops(msg *message) int {
+	received := len(msg.values("Received"))
+	markers := len(msg.values(loopMarkerHeader))
+	return max(received, markers)
+}
+
+// checkLoop returns an error if the message exceeded the hop limit, and adds
+// the relay's loop marker otherwise.
+func checkLoop(e *mail.Envelope, maxHops int) error {
+	msg := parseMessage(e.Data.Bytes())
+	if hops := countHops(msg); hops > maxHops {
+		return fmt.Errorf("554 5.4.6 Routing loop detected (%d hops, limit %d)", hops, maxHops)
+	}
+	msg.prepend(loopMarkerHeader, localHostname())
+	replaceData(e, msg.bytes())
+	return nil
+}
+
+// loopDetectProcessor decorator rejects messages that have been relayed too
+// many times, which usually means a route points back at this relay.
+var loopDetectProcessor = func() backends.Decorator {
+	config := &loopConfig{}
+	initFunc := backends.InitializeWith(func(backendConfig backends.BackendConfig) error {
+		bcfg, err := backends.Svc.ExtractConfig(backendConfig, &loopConfig{})
+		if err != nil {
+			return err
+		}
+		var ok bool
+		config, ok = bcfg.(*loopConfig)
+		if !ok {
+			return fmt.Errorf("failed to cast config to loopConfig")
+		}
+		return nil
+	})
+	backends.Svc.AddInitializer(initFunc)
+
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail {
+					if err := checkLoop(e, config.MaxHops); err != nil {
+						msgLog(e).WithError(err).Warn("rejecting message")
+						return backends.NewResult(err.Error()), err
+					}
+				}
+				return p.Process(e, task)
+			},
+		)
+	}
+}
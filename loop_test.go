@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckLoop(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		maxHops int
+		wantErr bool
+	}{
+		{name: "no trace headers", header: "Subject: s\r\n", maxHops: 3},
+		{name: "at limit", header: strings.Repeat("Received: from x\r\n", 3), maxHops: 3},
+		{name: "over limit", header: strings.Repeat("Received: from x\r\n", 4), maxHops: 3, wantErr: true},
+		{
+			name:    "markers counted when Received stripped",
+			header:  strings.Repeat(loopMarkerHeader+": relay\r\n", 4) + "Received: from x\r\n",
+			maxHops: 3,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &mail.Envelope{Data: *bytes.NewBufferString(tt.header + "\r\nbody\r\n")}
+			err := checkLoop(e, tt.maxHops)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.True(t, strings.HasPrefix(err.Error(), "554 5.4.6"))
+				assert.Equal(t, tt.header+"\r\nbody\r\n", e.Data.String(), "rejected message is unchanged")
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, strings.HasPrefix(e.Data.String(), loopMarkerHeader+": "))
+		})
+	}
+}
+
+func TestCheckLoop_DetectsRelayPingPong(t *testing.T) {
+	e := &mail.Envelope{Data: *bytes.NewBufferString("Subject: s\r\n\r\nbody\r\n")}
+	hops := 0
+	for ; hops < 10; hops++ {
+		if err := checkLoop(e, 5); err != nil {
+			break
+		}
+	}
+	assert.Equal(t, 6, hops)
+}
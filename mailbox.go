@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	mailboxDirMode  = 0o700
+	mailboxFileMode = 0o600
+
+	// mboxNullSender is the mbox From line sender of bounces.
+	mboxNullSender = "MAILER-DAEMON"
+)
+
+// mboxFromLine matches body lines that mboxrd quotes with '>'.
+var mboxFromLine = regexp.MustCompile(`(?m)^(>*From )`)
+
+// mailboxWriter delivers messages with LF line endings to Maildirs and mbox
+// files, optionally gzipped.
+type mailboxWriter struct {
+	hostname string
+	compress bool
+	// mu serializes appending to mbox files within mailrelay, the file lock
+	// against other programs
+	mu  sync.Mutex
+	seq atomic.Int64
+}
+
+func newMailboxWriter(compress bool) *mailboxWriter {
+	// '/' and ':' cannot appear in Maildir file names
+	hostname := strings.NewReplacer("/", `\057`, ":", `\072`).Replace(localHostname())
+	return &mailboxWriter{hostname: hostname, compress: compress}
+}
+
+// deliverMaildir writes the message to a new file in the Maildir, first to
+// tmp and then moved to new, as Maildir requires. It returns the path of the
+// file.
+func (w *mailboxWriter) deliverMaildir(dir string, data []byte, now time.Time) (string, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), mailboxDirMode); err != nil {
+			return "", err
+		}
+	}
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/int(time.Microsecond), os.Getpid(),
+		w.seq.Add(1), w.hostname)
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mailboxFileMode)
+	if err != nil {
+		return "", err
+	}
+	err = w.write(f, data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", errors.Join(err, os.Remove(tmp))
+	}
+	path := filepath.Join(dir, "new", name)
+	if err := os.Rename(tmp, path); err != nil {
+		return "", errors.Join(err, os.Remove(tmp))
+	}
+	return path, nil
+}
+
+// appendMbox appends the message to an mboxrd file. Compressed messages are
+// appended as separate gzip members, which gzip reads as a single stream.
+func (w *mailboxWriter) appendMbox(path, sender string, data []byte, now time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), mailboxDirMode); err != nil {
+		return err
+	}
+	if sender == "" {
+		sender = mboxNullSender
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", sender, now.UTC().Format(time.ANSIC))
+	msg := parseMessage(data)
+	msg.body = mboxFromLine.ReplaceAll(msg.body, []byte(">$1"))
+	buf.Write(msg.bytes())
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, mailboxFileMode)
+	if err != nil {
+		return err
+	}
+	err = lockFile(f)
+	if err == nil {
+		err = w.write(f, buf.Bytes())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	// closing releases the lock
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write writes data to out, gzipped if configured.
+func (w *mailboxWriter) write(out io.Writer, data []byte) error {
+	if !w.compress {
+		_, err := out.Write(data)
+		return err
+	}
+	bw := bufio.NewWriter(out)
+	zw := gzip.NewWriter(bw)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	defaultMailgunBaseURL = "https://api.mailgun.net"
+	mailgunUser           = "api"
+)
+
+// mailgunTransport relays messages with the Mailgun messages.mime API,
+// submitting the raw message to the envelope recipients.
+type mailgunTransport struct {
+	api *apiClient
+	url string
+}
+
+func newMailgunTransport(c *transportConfig, client *http.Client) *mailgunTransport {
+	return &mailgunTransport{
+		api: &apiClient{name: "Mailgun", client: client, auth: basicAuth{user: mailgunUser, password: c.APIKey}},
+		url: c.baseURL() + "/v3/" + url.PathEscape(c.Domain) + "/messages.mime",
+	}
+}
+
+func (t *mailgunTransport) name() string {
+	return t.api.name
+}
+
+func (t *mailgunTransport) send(e *mail.Envelope) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, rcpt := range getTo(e) {
+		if err := w.WriteField("to", rcpt); err != nil {
+			return err
+		}
+	}
+	part, err := w.CreateFormFile("message", "message.eml")
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(e.Data.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return t.api.do(e, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		return req, nil
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMailgunTransport(t *testing.T) {
+	setupTestLogger(t)
+	api := startFakeAPI(t, http.StatusOK, http.StatusUnauthorized, http.StatusUnauthorized)
+	tr, err := newTransport(&transportConfig{Type: transportMailgun, BaseURL: api.URL, APIKey: "key",
+		Domain: "mg.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "Mailgun", tr.name())
+
+	require.NoError(t, tr.send(transportTestEnvelope()))
+	require.Len(t, api.requests, 1)
+	req := api.requests[0]
+	assert.Equal(t, "/v3/mg.example.com/messages.mime", req.URL.Path)
+	user, password, ok := req.BasicAuth()
+	require.True(t, ok)
+	assert.Equal(t, "api", user)
+	assert.Equal(t, "key", password)
+
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/form-data", mediaType)
+	r := multipart.NewReader(bytes.NewReader(api.bodies[0]), params["boundary"])
+	var to []string
+	var message string
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		value, err := io.ReadAll(part)
+		require.NoError(t, err)
+		switch part.FormName() {
+		case "to":
+			to = append(to, string(value))
+		case "message":
+			message = string(value)
+		}
+	}
+	assert.Equal(t, []string{"ops@example.com", "audit@example.com"}, to)
+	assert.Equal(t, transportTestEnvelope().Data.String(), message)
+
+	err = tr.send(transportTestEnvelope())
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "451 4.7.0 "), err.Error())
+}
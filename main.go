@@ -10,17 +10,21 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/jpillora/ipfilter"
 	log "github.com/phires/go-guerrilla/log"
 )
 
 const (
+	DefaultConfigFile      = "/etc/mailrelay.json"
 	DefaultSMTPPort        = 465
 	DefaultMaxEmailSize    = 83886080 // 80 MB (80 * 1024 * 1024)
 	DefaultLocalListenIP   = "0.0.0.0"
 	DefaultLocalListenPort = 2525
 	DefaultTimeoutSecs     = 300 // 5 minutes
+	DefaultMaxHops         = 25
+	DefaultShutdownGrace   = 30 // seconds
 	MinEmailSizeBytes      = 1024
 )
 
@@ -38,6 +42,7 @@ type mailRelayConfig struct {
 	SMTPUsername      string   `json:"smtp_username"`
 	SMTPPassword      string   `json:"smtp_password"`
 	SMTPHelo          string   `json:"smtp_helo"`
+	SMTPXForward      bool     `json:"smtp_xforward"`
 	SkipCertVerify    bool     `json:"smtp_skip_cert_verify"`
 	MaxEmailSize      int64    `json:"smtp_max_email_size"`
 	LocalListenIP     string   `json:"local_listen_ip"`
@@ -45,10 +50,41 @@ type mailRelayConfig struct {
 	AllowedHosts      []string `json:"allowed_hosts"`
 	AllowedSenders    string   `json:"allowed_senders"`
 	TimeoutSecs       int      `json:"timeout_secs"`
+	MaxHops           int      `json:"max_hops"`
+	ShutdownGraceSecs int      `json:"shutdown_grace_secs"`
+	User              string   `json:"user"`
+	Group             string   `json:"group"`
+	Chroot            string   `json:"chroot"`
+
+	UnixSocket    *unixSocketConfig    `json:"unix_socket"`
+	LMTP          *lmtpConfig          `json:"lmtp"`
+	ProxyProtocol *proxyProtocolConfig `json:"proxy_protocol"`
+	XClient       *xclientConfig       `json:"xclient"`
+	Lenient       *lenientConfig       `json:"lenient"`
+
+	RewriteFrom  *fromRewriteConfig `json:"rewrite_from"`
+	RecipientMap string             `json:"recipient_map"`
+	HeaderRules  []headerRuleConfig `json:"header_rules"`
+	Routes       []*routeConfig     `json:"routes"`
+	DKIM         []*dkimConfig      `json:"dkim"`
+	ARC          *arcConfig         `json:"arc"`
+	Normalize    *normalizeConfig   `json:"normalize"`
+	Transcode    *transcodeConfig   `json:"transcode"`
+	Archive      *archiveConfig     `json:"archive"`
+	Transport    *transportConfig   `json:"transport"`
 }
 
 func main() {
-	err := run()
+	var err error
+	args, sendmail := sendmailArgs(os.Args)
+	switch {
+	case sendmail:
+		err = runSendmail(args, os.Stdin)
+	case len(os.Args) > 1 && os.Args[1] == dkimKeygenCommand:
+		err = runDKIMKeygen(os.Args[2:], os.Stdout)
+	default:
+		err = run()
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
@@ -73,10 +109,12 @@ func run() error {
 		return err
 	}
 
-	if err := Start(appConfig, verbose); err != nil {
+	server, err := Start(appConfig, verbose)
+	if err != nil {
 		flag.Usage()
 		return fmt.Errorf("starting server: %w", err)
 	}
+	notify("READY=1")
 
 	if test {
 		return runTest(testsender, testrcpt, appConfig.LocalListenPort)
@@ -86,7 +124,14 @@ func run() error {
 		return runIPCheck(ipToCheck)
 	}
 
-	return waitForSignal()
+	stopWatchdog := startWatchdog(upstreamHealth(appConfig))
+	if err := waitForSignal(); err != nil {
+		return err
+	}
+	stopWatchdog()
+	notify("STOPPING=1")
+	Logger.Info("shutting down")
+	return server.Shutdown(time.Duration(appConfig.ShutdownGraceSecs) * time.Second)
 }
 
 func parseFlags() (string, bool, string, string, bool, string, bool) {
@@ -98,7 +143,7 @@ func parseFlags() (string, bool, string, string, bool, string, bool) {
 	var ipToCheck string
 	var verbose bool
 
-	flag.StringVar(&configFile, "config", "/etc/mailrelay.json", "specifies JSON config file")
+	flag.StringVar(&configFile, "config", DefaultConfigFile, "specifies JSON config file")
 	flag.BoolVar(&test, "test", false, "sends a test message to SMTP server")
 	flag.StringVar(&testsender, "sender", "", "used with 'test' to specify sender email address")
 	flag.StringVar(&testrcpt, "rcpt", "", "used with 'test' to specify recipient email address")
@@ -213,22 +258,103 @@ func configDefaults(config *mailRelayConfig) {
 	config.AllowedHosts = []string{"*"}
 	config.AllowedSenders = "*"
 	config.TimeoutSecs = DefaultTimeoutSecs
+	config.MaxHops = DefaultMaxHops
+	config.ShutdownGraceSecs = DefaultShutdownGrace
 }
 
 // validateConfig validates the configuration values.
 func validateConfig(config *mailRelayConfig) error {
-	if config.SMTPServer == "" {
-		return errors.New("smtp_server is required")
+	if config.SMTPServer == "" && config.Transport == nil {
+		return errors.New("smtp_server or transport is required")
 	}
 
 	if config.SMTPPort < 1 || config.SMTPPort > 65535 {
 		return errors.New("smtp_port must be between 1 and 65535")
 	}
 
-	if config.LocalListenPort < 1 || config.LocalListenPort > 65535 {
-		return errors.New("local_listen_port must be between 1 and 65535")
+	if err := validateListeners(config); err != nil {
+		return err
+	}
+
+	if err := validateLimits(config); err != nil {
+		return err
+	}
+
+	if config.Group != "" && config.User == "" {
+		return errors.New("group requires user")
+	}
+
+	if err := validateChroot(config); err != nil {
+		return err
+	}
+
+	if err := validateRewriting(config); err != nil {
+		return err
+	}
+
+	if err := validateSigning(config); err != nil {
+		return err
+	}
+
+	return validateDelivery(config)
+}
+
+// validateRewriting validates the rules that change messages.
+func validateRewriting(config *mailRelayConfig) error {
+	if config.RewriteFrom != nil {
+		if err := config.RewriteFrom.validate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := compileHeaderRules(config.HeaderRules); err != nil {
+		return err
+	}
+
+	for _, r := range config.Routes {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+
+	if config.Normalize != nil {
+		if err := config.Normalize.validate(); err != nil {
+			return err
+		}
+	}
+
+	if config.Transcode != nil {
+		return config.Transcode.validate()
 	}
+	return nil
+}
 
+// validateSigning validates the DKIM and ARC configuration.
+func validateSigning(config *mailRelayConfig) error {
+	if err := validateDKIMConfigs(config.DKIM); err != nil {
+		return err
+	}
+	if config.ARC != nil {
+		return config.ARC.validate()
+	}
+	return nil
+}
+
+// validateDelivery validates where messages are delivered.
+func validateDelivery(config *mailRelayConfig) error {
+	if config.Archive != nil {
+		if err := config.Archive.validate(); err != nil {
+			return err
+		}
+	}
+	if config.Transport != nil {
+		return config.Transport.validate()
+	}
+	return nil
+}
+
+// validateLimits validates the size, time and hop limits.
+func validateLimits(config *mailRelayConfig) error {
 	if config.MaxEmailSize < MinEmailSizeBytes {
 		return errors.New("smtp_max_email_size must be at least 1024 bytes")
 	}
@@ -237,6 +363,58 @@ func validateConfig(config *mailRelayConfig) error {
 		return errors.New("timeout_secs must be between 1 and 3600 seconds")
 	}
 
+	if config.MaxHops < 1 {
+		return errors.New("max_hops must be at least 1")
+	}
+
+	if config.ShutdownGraceSecs < 0 || config.ShutdownGraceSecs > 3600 {
+		return errors.New("shutdown_grace_secs must be between 0 and 3600 seconds")
+	}
+
+	return nil
+}
+
+// validateListeners validates the configuration of the inbound listeners.
+func validateListeners(config *mailRelayConfig) error {
+	if config.UnixSocket != nil {
+		if err := config.UnixSocket.validate(); err != nil {
+			return err
+		}
+	}
+
+	if config.LMTP != nil {
+		if err := config.LMTP.validate(); err != nil {
+			return err
+		}
+	}
+
+	if config.ProxyProtocol != nil {
+		if err := config.ProxyProtocol.validate(); err != nil {
+			return err
+		}
+	}
+
+	if config.XClient != nil {
+		if err := config.XClient.validate(); err != nil {
+			return err
+		}
+	}
+
+	if config.Lenient != nil {
+		if err := config.Lenient.validate(); err != nil {
+			return err
+		}
+	}
+
+	minListenPort := 1
+	if config.UnixSocket != nil || config.LMTP != nil {
+		// a port of 0 disables the TCP listener
+		minListenPort = 0
+	}
+	if config.LocalListenPort < minListenPort || config.LocalListenPort > 65535 {
+		return errors.New("local_listen_port must be between 1 and 65535")
+	}
+
 	return nil
 }
 
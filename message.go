@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	netmail "net/mail"
+	"strings"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// headerField is a single header field exactly as it appeared in the message,
+// including any folded continuation lines and the terminating line ending.
+type headerField struct {
+	name string
+	raw  []byte
+}
+
+// message is a minimal view of an RFC 5322 message that allows processors to
+// inspect and rewrite header fields while leaving the body untouched.
+type message struct {
+	fields []headerField
+	sep    []byte // blank line separating header and body, nil if absent
+	body   []byte
+	eol    string // line ending used when adding new fields
+}
+
+// parseMessage splits raw message data into header fields and body. Data that
+// does not start with a header field is treated as body only.
+func parseMessage(data []byte) *message {
+	m := &message{eol: "\r\n"}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 && (i == 0 || data[i-1] != '\r') {
+		m.eol = "\n"
+	}
+
+	rest := data
+	for len(rest) > 0 {
+		line, next := nextLine(rest)
+		if isBlankLine(line) {
+			m.sep = line
+			rest = next
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(m.fields) > 0 {
+			f := &m.fields[len(m.fields)-1]
+			f.raw = append(f.raw, line...)
+			rest = next
+			continue
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 || bytes.ContainsAny(line[:colon], " \t") {
+			// not a header field, the body starts here
+			break
+		}
+		raw := append([]byte(nil), line...)
+		if raw[len(raw)-1] != '\n' {
+			raw = append(raw, m.eol...)
+		}
+		m.fields = append(m.fields, headerField{name: string(line[:colon]), raw: raw})
+		rest = next
+	}
+	m.body = rest
+	return m
+}
+
+func nextLine(data []byte) (line []byte, rest []byte) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return data[:i+1], data[i+1:]
+	}
+	return data, nil
+}
+
+func isBlankLine(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0
+}
+
+// value returns the unfolded value of the field.
+func (f headerField) value() string {
+	v := f.raw[len(f.name)+1:]
+	v = bytes.ReplaceAll(v, []byte("\r\n"), nil)
+	v = bytes.ReplaceAll(v, []byte("\n"), nil)
+	return strings.TrimSpace(string(v))
+}
+
+// get returns the value of the first field with the given name, or an empty string.
+func (m *message) get(name string) string {
+	for _, f := range m.fields {
+		if strings.EqualFold(f.name, name) {
+			return f.value()
+		}
+	}
+	return ""
+}
+
+// values returns the values of all fields with the given name, in order.
+func (m *message) values(name string) []string {
+	var ret []string
+	for _, f := range m.fields {
+		if strings.EqualFold(f.name, name) {
+			ret = append(ret, f.value())
+		}
+	}
+	return ret
+}
+
+// has returns true if at least one field with the given name exists.
+func (m *message) has(name string) bool {
+	for _, f := range m.fields {
+		if strings.EqualFold(f.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// set replaces the first field with the given name and removes any others.
+// The field is appended to the header if it does not exist yet.
+func (m *message) set(name, value string) {
+	for i, f := range m.fields {
+		if strings.EqualFold(f.name, name) {
+			m.fields[i] = m.newField(name, value)
+			m.delAfter(name, i+1)
+			return
+		}
+	}
+	m.add(name, value)
+}
+
+// add appends a field to the end of the header.
+func (m *message) add(name, value string) {
+	m.fields = append(m.fields, m.newField(name, value))
+}
+
+// prepend inserts a field at the top of the header, as trace fields require.
+func (m *message) prepend(name, value string) {
+	m.fields = append([]headerField{m.newField(name, value)}, m.fields...)
+}
+
+// del removes all fields with the given name and returns how many were removed.
+func (m *message) del(name string) int {
+	return m.delAfter(name, 0)
+}
+
+// delFunc removes the fields with the given name whose value satisfies match
+// and returns how many were removed.
+func (m *message) delFunc(name string, match func(value string) bool) int {
+	return m.delMatching(name, 0, match)
+}
+
+func (m *message) delAfter(name string, start int) int {
+	return m.delMatching(name, start, func(string) bool { return true })
+}
+
+func (m *message) delMatching(name string, start int, match func(value string) bool) int {
+	kept := m.fields[:start]
+	removed := 0
+	for _, f := range m.fields[start:] {
+		if strings.EqualFold(f.name, name) && match(f.value()) {
+			removed++
+			continue
+		}
+		kept = append(kept, f)
+	}
+	m.fields = kept
+	return removed
+}
+
+func (m *message) newField(name, value string) headerField {
+	return headerField{name: name, raw: []byte(name + ": " + value + m.eol)}
+}
+
+// bytes reassembles the message.
+func (m *message) bytes() []byte {
+	var buf bytes.Buffer
+	for _, f := range m.fields {
+		buf.Write(f.raw)
+	}
+	switch {
+	case m.sep != nil:
+		buf.Write(m.sep)
+	case len(m.fields) > 0 && len(m.body) > 0:
+		buf.WriteString(m.eol)
+	}
+	buf.Write(m.body)
+	return buf.Bytes()
+}
+
+// replaceData replaces the message data of the envelope.
+func replaceData(e *mail.Envelope, data []byte) {
+	e.Data.Reset()
+	e.Data.Write(data)
+}
+
+// parseAddress parses a bare or named RFC 5322 address such as a configured
+// sender into an envelope address.
+func parseAddress(s string) (mail.Address, error) {
+	a, err := netmail.ParseAddress(s)
+	if err != nil {
+		return mail.Address{}, err
+	}
+	at := strings.LastIndexByte(a.Address, '@')
+	if at < 0 {
+		return mail.Address{}, errors.New("address has no domain")
+	}
+	user := a.Address[:at]
+	return mail.Address{
+		User:        user,
+		Host:        a.Address[at+1:],
+		Quoted:      strings.ContainsAny(user, " \"(),:;<>@[]"),
+		DisplayName: a.Name,
+	}, nil
+}
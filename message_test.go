@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMessage(t *testing.T) {
+	data := "From: a@example.com\r\nSubject: folded\r\n  subject\r\nTo: b@example.com\r\n\r\nbody line\r\n"
+	msg := parseMessage([]byte(data))
+
+	assert.Len(t, msg.fields, 3)
+	assert.Equal(t, "a@example.com", msg.get("from"))
+	assert.Equal(t, "folded  subject", msg.get("Subject"))
+	assert.Equal(t, "\r\n", msg.eol)
+	assert.Equal(t, "body line\r\n", string(msg.body))
+	assert.Equal(t, data, string(msg.bytes()))
+}
+
+func TestParseMessage_Variants(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		wantFields int
+		wantBody   string
+		wantEOL    string
+	}{
+		{
+			name:       "bare LF",
+			data:       "Subject: hi\n\nbody\n",
+			wantFields: 1,
+			wantBody:   "body\n",
+			wantEOL:    "\n",
+		},
+		{
+			name:       "no header",
+			data:       "just a body\r\n",
+			wantFields: 0,
+			wantBody:   "just a body\r\n",
+			wantEOL:    "\r\n",
+		},
+		{
+			name:       "no separator",
+			data:       "Subject: hi\r\nthis is body\r\n",
+			wantFields: 1,
+			wantBody:   "this is body\r\n",
+			wantEOL:    "\r\n",
+		},
+		{
+			name:       "header only",
+			data:       "Subject: hi",
+			wantFields: 1,
+			wantBody:   "",
+			wantEOL:    "\r\n",
+		},
+		{
+			name:       "empty",
+			data:       "",
+			wantFields: 0,
+			wantBody:   "",
+			wantEOL:    "\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := parseMessage([]byte(tt.data))
+			assert.Len(t, msg.fields, tt.wantFields)
+			assert.Equal(t, tt.wantBody, string(msg.body))
+			assert.Equal(t, tt.wantEOL, msg.eol)
+		})
+	}
+}
+
+func TestMessageEdit(t *testing.T) {
+	msg := parseMessage([]byte("Received: one\nReceived: two\nSubject: s\n\nbody\n"))
+
+	assert.Equal(t, []string{"one", "two"}, msg.values("Received"))
+	assert.True(t, msg.has("subject"))
+	assert.False(t, msg.has("Reply-To"))
+
+	msg.set("Subject", "new")
+	msg.add("X-Added", "yes")
+	msg.prepend("Received", "zero")
+	assert.Equal(t, "Received: zero\nReceived: one\nReceived: two\nSubject: new\nX-Added: yes\n\nbody\n",
+		string(msg.bytes()))
+
+	assert.Equal(t, 3, msg.del("received"))
+	msg.set("X-Added", "replaced")
+	assert.Equal(t, "Subject: new\nX-Added: replaced\n\nbody\n", string(msg.bytes()))
+}
+
+func TestMessageSet_RemovesDuplicates(t *testing.T) {
+	msg := parseMessage([]byte("From: a\r\nTo: x\r\nFrom: b\r\n\r\n"))
+	msg.set("From", "c")
+	assert.Equal(t, "From: c\r\nTo: x\r\n\r\n", string(msg.bytes()))
+}
+
+func TestMessageAdd_HeaderlessMessage(t *testing.T) {
+	msg := parseMessage([]byte("body only\r\n"))
+	msg.add("Subject", "added")
+	assert.Equal(t, "Subject: added\r\n\r\nbody only\r\n", string(msg.bytes()))
+}
+
+func TestParseAddress(t *testing.T) {
+	a, err := parseAddress("Relay <relay@example.com>")
+	assert.NoError(t, err)
+	assert.Equal(t, "relay@example.com", a.String())
+	assert.Equal(t, "Relay", a.DisplayName)
+
+	_, err = parseAddress("root")
+	assert.Error(t, err)
+	_, err = parseAddress("me@")
+	assert.Error(t, err)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	// maxLineLength is the longest line RFC 5322 allows, without CRLF.
+	maxLineLength = 998
+
+	utf8Charset  = "utf-8"
+	asciiCharset = "us-ascii"
+)
+
+// addressHeaders are the header fields holding address lists, which are
+// encoded address by address.
+var addressHeaders = map[string]bool{
+	"from": true, "sender": true, "reply-to": true, "to": true, "cc": true, "bcc": true,
+	"resent-from": true, "resent-sender": true, "resent-to": true, "resent-cc": true, "resent-bcc": true,
+}
+
+// mediaParamHeaders are the header fields with parameters, whose values are
+// encoded parameter by parameter.
+var mediaParamHeaders = map[string]bool{"content-type": true, "content-disposition": true}
+
+// structuredHeaders are the other structured header fields, where encoded
+// words are not allowed.
+var structuredHeaders = map[string]bool{
+	"date": true, "message-id": true, "in-reply-to": true, "references": true, "received": true,
+	"return-path": true, "mime-version": true, "content-transfer-encoding": true, "content-id": true,
+	"resent-date": true, "resent-message-id": true,
+}
+
+// normalizeConfig enables repairing messages from legacy devices. Sources
+// limits it to clients in the given IP addresses or CIDR ranges, all
+// clients if empty.
+type normalizeConfig struct {
+	Sources []string `json:"sources"`
+}
+
+func (c *normalizeConfig) validate() error {
+	for _, s := range c.Sources {
+		if _, err := parsePrefix(s); err != nil {
+			return fmt.Errorf("normalize sources: %w", err)
+		}
+	}
+	return nil
+}
+
+// applies returns true if messages from the client are normalized.
+func (c *normalizeConfig) applies(remoteIP string) bool {
+	return len(c.Sources) == 0 || ipInList(remoteIP, c.Sources)
+}
+
+// normalizeMessage repairs a message so that strict providers accept it, and
+// returns the fixes applied.
+func normalizeMessage(e *mail.Envelope, now time.Time) []string {
+	data, bareCR, bareLF := toCRLF(e.Data.Bytes())
+	var fixes []string
+	if bareCR > 0 {
+		fixes = append(fixes, fmt.Sprintf("replaced %d bare CR line endings", bareCR))
+	}
+	if bareLF > 0 {
+		fixes = append(fixes, fmt.Sprintf("replaced %d bare LF line endings", bareLF))
+	}
+	msg := parseMessage(data)
+	fixes = append(fixes, addMissingHeaders(msg, e, now)...)
+	fixes = append(fixes, encodeHeaders(msg, decodeText)...)
+	fixes = append(fixes, wrapBody(msg)...)
+	replaceData(e, msg.bytes())
+	return fixes
+}
+
+// toCRLF converts all line endings to CRLF and returns the number of bare CR
+// and bare LF line endings converted.
+func toCRLF(data []byte) ([]byte, int, int) {
+	out := make([]byte, 0, len(data)+bytes.Count(data, []byte("\n")))
+	bareCR, bareLF := 0, 0
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; {
+		case c == '\r' && i+1 < len(data) && data[i+1] == '\n':
+			out = append(out, '\r', '\n')
+			i++
+		case c == '\r':
+			bareCR++
+			out = append(out, '\r', '\n')
+		case c == '\n':
+			bareLF++
+			out = append(out, '\r', '\n')
+		default:
+			out = append(out, c)
+		}
+	}
+	return out, bareCR, bareLF
+}
+
+// addMissingHeaders adds the Date, From and Message-ID fields RFC 5322
+// requires, if missing.
+func addMissingHeaders(msg *message, e *mail.Envelope, now time.Time) []string {
+	var fixes []string
+	if !msg.has("Date") {
+		msg.add("Date", now.Format(time.RFC1123Z))
+		fixes = append(fixes, "added Date")
+	}
+	if !msg.has("From") && e.MailFrom.User != "" {
+		msg.add("From", e.MailFrom.String())
+		fixes = append(fixes, "added From")
+	}
+	if !msg.has("Message-ID") {
+		id := newRelayID() + "." + strconv.FormatInt(now.UnixNano(), 36)
+		msg.add("Message-ID", "<"+id+"@"+localHostname()+">")
+		fixes = append(fixes, "added Message-ID")
+	}
+	return fixes
+}
+
+// encodeHeaders RFC 2047 encodes header fields holding raw 8-bit text, which
+// decode converts to UTF-8.
+func encodeHeaders(msg *message, decode func([]byte) string) []string {
+	var fixes []string
+	for i, f := range msg.fields {
+		if isASCII(f.raw) {
+			continue
+		}
+		text := decode([]byte(f.value()))
+		var value string
+		ok := true
+		switch name := strings.ToLower(f.name); {
+		case addressHeaders[name]:
+			value, ok = encodeAddressList(text)
+		case mediaParamHeaders[name]:
+			value, ok = encodeMediaParams(text)
+		case structuredHeaders[name]:
+			ok = false
+		default:
+			value = mime.QEncoding.Encode(utf8Charset, text)
+		}
+		if !ok {
+			fixes = append(fixes, "could not encode "+f.name)
+			continue
+		}
+		// whitespace between encoded words is ignored, the value may be folded there
+		value = strings.ReplaceAll(value, "?= =?", "?="+msg.eol+" =?")
+		msg.fields[i] = msg.newField(f.name, value)
+		fixes = append(fixes, "encoded "+f.name)
+	}
+	return fixes
+}
+
+// encodeMediaParams encodes the parameter values of a Content-Type or
+// Content-Disposition field as RFC 2231 requires. Encoded words are not
+// allowed there.
+func encodeMediaParams(text string) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(text)
+	if err != nil {
+		// legacy devices rarely quote 8-bit file names, which the mime
+		// package rejects
+		var ok bool
+		if mediaType, params, ok = splitMediaParams(text); !ok {
+			return "", false
+		}
+	}
+	value := mime.FormatMediaType(mediaType, params)
+	return value, value != ""
+}
+
+// splitMediaParams splits a Content-Type or Content-Disposition value into
+// its type and parameters, taking any unquoted text up to the next semicolon
+// as the value of a parameter.
+func splitMediaParams(text string) (string, map[string]string, bool) {
+	parts := splitUnquoted(text, ';')
+	mediaType := strings.ToLower(strings.TrimSpace(parts[0]))
+	params := map[string]string{}
+	for _, part := range parts[1:] {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || name == "" {
+			return "", nil, false
+		}
+		params[name] = unquote(strings.TrimSpace(value))
+	}
+	return mediaType, params, true
+}
+
+// splitUnquoted splits s at each sep outside double quotes.
+func splitUnquoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote removes the quotes and backslash escapes of a quoted string, and
+// returns other values as they are.
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// encodeAddressList encodes the display names of an address list. Addresses
+// themselves cannot be encoded.
+func encodeAddressList(text string) (string, bool) {
+	list, err := netmail.ParseAddressList(text)
+	if err != nil {
+		return "", false
+	}
+	addrs := make([]string, len(list))
+	for i, a := range list {
+		if !isASCII([]byte(a.Address)) {
+			return "", false
+		}
+		addrs[i] = a.String()
+	}
+	return strings.Join(addrs, ", "), true
+}
+
+// wrapBody makes a message without MIME header fields a MIME text/plain
+// message. Bodies that are not 7-bit text are quoted-printable encoded.
+func wrapBody(msg *message) []string {
+	if msg.has("MIME-Version") {
+		return nil
+	}
+	if msg.has("Content-Type") {
+		msg.add("MIME-Version", "1.0")
+		return []string{"added MIME-Version"}
+	}
+
+	charset := asciiCharset
+	encoding := "7bit"
+	if !isASCII(msg.body) || hasLongLines(msg.body) {
+		body, err := encodeQuotedPrintable(decodeText(msg.body), msg.eol)
+		if err != nil {
+			return []string{"could not encode body: " + err.Error()}
+		}
+		charset, encoding, msg.body = utf8Charset, "quoted-printable", body
+	}
+	msg.add("MIME-Version", "1.0")
+	msg.add("Content-Type", "text/plain; charset="+charset)
+	msg.add("Content-Transfer-Encoding", encoding)
+	if msg.sep == nil {
+		msg.sep = []byte(msg.eol)
+	}
+	return []string{"added MIME headers for " + encoding + " " + charset + " text"}
+}
+
+// encodeQuotedPrintable encodes text with the given line ending.
+func encodeQuotedPrintable(text, eol string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	// the writer turns line endings into CRLF hard line breaks
+	if _, err := w.Write([]byte(strings.ReplaceAll(text, "\r\n", "\n"))); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return bytes.ReplaceAll(buf.Bytes(), []byte("\r\n"), []byte(eol)), nil
+}
+
+// decodeText returns 8-bit text as UTF-8. Text that is not valid UTF-8 is
+// taken to be ISO-8859-1, which legacy devices commonly send.
+func decodeText(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func hasLongLines(body []byte) bool {
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSuffix(line, []byte("\r"))) > maxLineLength {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeProcessor decorator repairs messages from legacy devices. It runs
+// after all other rewriting, so it also repairs fields added by mailrelay,
+// and before signing.
+var normalizeProcessor = func() backends.Decorator {
+	var config *normalizeConfig
+	initFunc := backends.InitializeWith(func(backendConfig backends.BackendConfig) error {
+		if c, ok := backendConfig["normalize"].(*normalizeConfig); ok {
+			config = c
+		}
+		return nil
+	})
+	backends.Svc.AddInitializer(initFunc)
+
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail && config != nil && config.applies(e.RemoteIP) {
+					for _, fix := range normalizeMessage(e, time.Now()) {
+						msgLog(e).Infof("normalize: %s", fix)
+					}
+				}
+				return p.Process(e, task)
+			},
+		)
+	}
+}
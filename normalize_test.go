@@ -0,0 +1,161 @@
+package main
+
+import (
+	"mime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeMessage_LegacyDevice(t *testing.T) {
+	e := mail.NewEnvelope("10.0.5.20", 1)
+	e.MailFrom = mail.Address{User: "scanner", Host: "lan.example"}
+	// ISO-8859-1 subject and body, bare LF and a bare CR line ending
+	e.Data.WriteString("Subject: Scan fertig f\xfcr M\xfcller\nTo: M\xfcller <mueller@example.com>\n\n" +
+		"Seite 1 von 2\rGr\xfc\xdfe\n")
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	fixes := normalizeMessage(e, now)
+	assert.Equal(t, []string{
+		"replaced 1 bare CR line endings",
+		"replaced 4 bare LF line endings",
+		"added Date",
+		"added From",
+		"added Message-ID",
+		"encoded Subject",
+		"encoded To",
+		"added MIME headers for quoted-printable utf-8 text",
+	}, fixes)
+
+	data := e.Data.String()
+	assert.NotRegexp(t, "[^\r]\n", data, "all line endings are CRLF")
+	for _, c := range []byte(data) {
+		require.Less(t, c, byte(0x80), "the message is 7-bit")
+	}
+
+	msg := parseMessage(e.Data.Bytes())
+	assert.Equal(t, "Fri, 01 Mar 2024 12:00:00 +0000", msg.get("Date"))
+	assert.Equal(t, "scanner@lan.example", msg.get("From"))
+	assert.Regexp(t, `^<[0-9A-F]{16}\.\w+@.+>$`, msg.get("Message-ID"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "Scan fertig für Müller", subject)
+	assert.Equal(t, `=?utf-8?q?M=C3=BCller?= <mueller@example.com>`, msg.get("To"))
+	assert.Equal(t, "1.0", msg.get("MIME-Version"))
+	assert.Equal(t, "text/plain; charset=utf-8", msg.get("Content-Type"))
+	assert.Equal(t, "quoted-printable", msg.get("Content-Transfer-Encoding"))
+	assert.Equal(t, "Seite 1 von 2\r\nGr=C3=BC=C3=9Fe\r\n", string(msg.body))
+}
+
+func TestNormalizeMessage_Compliant(t *testing.T) {
+	original := "Date: Fri, 01 Mar 2024 12:00:00 +0000\r\nFrom: app@example.com\r\n" +
+		"Message-ID: <1@example.com>\r\nMIME-Version: 1.0\r\nContent-Type: text/plain\r\n\r\nbody\r\n"
+	e := mail.NewEnvelope("10.0.5.20", 1)
+	e.Data.WriteString(original)
+	assert.Empty(t, normalizeMessage(e, time.Now()))
+	assert.Equal(t, original, e.Data.String())
+
+	e = mail.NewEnvelope("10.0.5.20", 1)
+	e.Data.WriteString(strings.ReplaceAll(original, "\r\n", "\n"))
+	assert.Equal(t, []string{"replaced 7 bare LF line endings"}, normalizeMessage(e, time.Now()))
+	assert.Equal(t, original, e.Data.String())
+}
+
+func TestWrapBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		fixes    []string
+		encoding string
+		body     string
+	}{
+		{name: "ascii", data: "Subject: a\r\n\r\nhello\r\n", fixes: []string{"added MIME headers for 7bit us-ascii text"},
+			encoding: "7bit", body: "hello\r\n"},
+		{name: "utf-8", data: "Subject: a\r\n\r\nhé\r\n",
+			fixes: []string{"added MIME headers for quoted-printable utf-8 text"}, encoding: "quoted-printable",
+			body: "h=C3=A9\r\n"},
+		{name: "long line", data: "Subject: a\r\n\r\n" + strings.Repeat("x", maxLineLength+1) + "\r\n",
+			fixes: []string{"added MIME headers for quoted-printable utf-8 text"}, encoding: "quoted-printable"},
+		{name: "content type only", data: "Content-Type: text/html\r\n\r\n<p>\r\n",
+			fixes: []string{"added MIME-Version"}, body: "<p>\r\n"},
+		{name: "mime", data: "MIME-Version: 1.0\r\n\r\n\xff\r\n", body: "\xff\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := parseMessage([]byte(tt.data))
+			assert.Equal(t, tt.fixes, wrapBody(msg))
+			msg = parseMessage(msg.bytes())
+			assert.Equal(t, tt.encoding, msg.get("Content-Transfer-Encoding"))
+			if tt.body != "" {
+				assert.Equal(t, tt.body, string(msg.body))
+			}
+			assert.False(t, hasLongLines(msg.body))
+		})
+	}
+}
+
+func TestEncodeHeaders(t *testing.T) {
+	msg := parseMessage([]byte("From: \"J\xc3\xbcrgen\" <j@example.com>, plain@example.com\r\n" +
+		"Cc: broken <<\xfc\r\n" +
+		"X-Long: " + strings.Repeat("\xc3\xa9", 60) + "\r\n\r\n"))
+	assert.Equal(t, []string{"encoded From", "could not encode Cc", "encoded X-Long"}, encodeHeaders(msg, decodeText))
+	assert.Equal(t, "=?utf-8?q?J=C3=BCrgen?= <j@example.com>, <plain@example.com>", msg.get("From"))
+	assert.Contains(t, string(msg.fields[2].raw), "?=\r\n =?utf-8?q?", "long values are folded")
+	decoded, err := new(mime.WordDecoder).DecodeHeader(msg.get("X-Long"))
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("é", 60), decoded)
+}
+
+func TestEncodeHeaders_Structured(t *testing.T) {
+	msg := parseMessage([]byte("Content-Type: text/plain; name=\"\xc3\xbc.txt\"\r\n" +
+		"Content-Disposition: attachment; filename=\xc3\xbc.txt\r\n" +
+		"Message-ID: <\xc3\xbc@example.com>\r\n\r\n"))
+	assert.Equal(t, []string{"encoded Content-Type", "encoded Content-Disposition",
+		"could not encode Message-ID"}, encodeHeaders(msg, decodeText))
+	assert.Equal(t, "text/plain; name*=utf-8''%C3%BC.txt", msg.get("Content-Type"))
+	mediaType, params, err := mime.ParseMediaType(msg.get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain", mediaType)
+	assert.Equal(t, "ü.txt", params["name"])
+	mediaType, params, err = mime.ParseMediaType(msg.get("Content-Disposition"))
+	require.NoError(t, err, "unquoted 8-bit file names are quoted")
+	assert.Equal(t, "attachment", mediaType)
+	assert.Equal(t, "ü.txt", params["filename"])
+	assert.Equal(t, "<\xc3\xbc@example.com>", msg.get("Message-ID"), "structured fields are left alone")
+}
+
+func TestSplitMediaParams(t *testing.T) {
+	tests := []struct {
+		text      string
+		mediaType string
+		params    map[string]string
+		ok        bool
+	}{
+		{text: "attachment; filename=Prüf bericht.pdf", mediaType: "attachment",
+			params: map[string]string{"filename": "Prüf bericht.pdf"}, ok: true},
+		{text: `Application/PDF; Name="a;b \"c\".pdf"; size=10;`, mediaType: "application/pdf",
+			params: map[string]string{"name": `a;b "c".pdf`, "size": "10"}, ok: true},
+		{text: "inline; filename", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			mediaType, params, ok := splitMediaParams(tt.text)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.mediaType, mediaType)
+			assert.Equal(t, tt.params, params)
+		})
+	}
+}
+
+func TestNormalizeConfig(t *testing.T) {
+	c := &normalizeConfig{Sources: []string{"10.0.5.0/24"}}
+	require.NoError(t, c.validate())
+	assert.True(t, c.applies("10.0.5.20"))
+	assert.False(t, c.applies("10.0.6.1"))
+	assert.True(t, (&normalizeConfig{}).applies("192.0.2.1"))
+	assert.Error(t, (&normalizeConfig{Sources: []string{"printers"}}).validate())
+}
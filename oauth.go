@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenExpiryMargin renews access tokens this long before they expire.
+	tokenExpiryMargin = time.Minute
+
+	// jwtLifetime is how long service account assertions are valid.
+	jwtLifetime = time.Hour
+
+	maxTokenResponse = 64 * 1024
+
+	grantClientCredentials = "client_credentials"
+	grantRefreshToken      = "refresh_token"
+	grantJWTBearer         = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+// authorizer adds credentials to API requests.
+type authorizer interface {
+	authorize(req *http.Request) error
+	// invalidate discards cached credentials that the API refused.
+	invalidate()
+}
+
+// tokenSource obtains OAuth2 access tokens from a token endpoint and caches
+// them until shortly before they expire.
+type tokenSource struct {
+	client   *http.Client
+	tokenURL string
+	params   url.Values
+	// assert returns a signed JWT for the jwt-bearer grant, nil for other
+	// grants.
+	assert func(now time.Time) (string, error)
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// tokenResponse is the response of a token endpoint.
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// newTokenSource returns a token source using the client credentials grant
+// if refreshToken is empty and the refresh token grant otherwise.
+func newTokenSource(client *http.Client, tokenURL, clientID, clientSecret, refreshToken, scope string) *tokenSource {
+	params := url.Values{"client_id": {clientID}, "scope": {scope}}
+	if clientSecret != "" {
+		params.Set("client_secret", clientSecret)
+	}
+	if refreshToken != "" {
+		params.Set("grant_type", grantRefreshToken)
+		params.Set("refresh_token", refreshToken)
+	} else {
+		params.Set("grant_type", grantClientCredentials)
+	}
+	return &tokenSource{client: client, tokenURL: tokenURL, params: params}
+}
+
+func (s *tokenSource) authorize(req *http.Request) error {
+	token, err := s.accessToken(time.Now())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (s *tokenSource) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = ""
+}
+
+// accessToken returns a cached access token, or obtains a new one.
+func (s *tokenSource) accessToken(now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && now.Before(s.expiry) {
+		return s.token, nil
+	}
+
+	form := maps.Clone(s.params)
+	if s.assert != nil {
+		assertion, err := s.assert(now)
+		if err != nil {
+			return "", err
+		}
+		form.Set("assertion", assertion)
+	}
+	resp, err := s.client.PostForm(s.tokenURL, form)
+	if err != nil {
+		return "", fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenResponse))
+	if err != nil {
+		return "", fmt.Errorf("token request: %w", err)
+	}
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil || resp.StatusCode != http.StatusOK || tr.AccessToken == "" {
+		return "", fmt.Errorf("token request failed with status %d: %s %s", resp.StatusCode, tr.Error,
+			tr.ErrorDescription)
+	}
+
+	s.token = tr.AccessToken
+	s.expiry = now.Add(time.Duration(tr.ExpiresIn)*time.Second - tokenExpiryMargin)
+	if tr.RefreshToken != "" && s.params.Get("grant_type") == grantRefreshToken {
+		// providers may rotate refresh tokens
+		s.params.Set("refresh_token", tr.RefreshToken)
+	}
+	return s.token, nil
+}
+
+// serviceAccountKey is a Google service account key file.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+func loadServiceAccountKey(path string) (*serviceAccountKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var k serviceAccountKey
+	if err := json.Unmarshal(b, &k); err != nil {
+		return nil, fmt.Errorf("service account key %s: %w", path, err)
+	}
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil || k.ClientEmail == "" {
+		return nil, fmt.Errorf("service account key %s: missing client_email or private_key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("service account key %s: %w", path, err)
+	}
+	var ok bool
+	if k.key, ok = key.(*rsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("service account key %s: not an RSA key", path)
+	}
+	return &k, nil
+}
+
+// newServiceAccountTokenSource returns a token source using the jwt-bearer
+// grant of service accounts, acting as subject if not empty.
+func newServiceAccountTokenSource(client *http.Client, tokenURL string, k *serviceAccountKey,
+	scope, subject string,
+) *tokenSource {
+	return &tokenSource{
+		client:   client,
+		tokenURL: tokenURL,
+		params:   url.Values{"grant_type": {grantJWTBearer}},
+		assert: func(now time.Time) (string, error) {
+			return k.assertion(tokenURL, scope, subject, now)
+		},
+	}
+}
+
+// assertion returns a JWT signed with the service account's key.
+func (k *serviceAccountKey) assertion(audience, scope, subject string, now time.Time) (string, error) {
+	claims := map[string]any{
+		"iss":   k.ClientEmail,
+		"scope": scope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(jwtLifetime).Unix(),
+	}
+	if subject != "" {
+		claims["sub"] = subject
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTokenServer starts a token endpoint that issues the tokens in turn
+// and returns the forms it received.
+func startTokenServer(t *testing.T, tokens ...tokenResponse) (*httptest.Server, *[]url.Values) {
+	t.Helper()
+	var forms []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		forms = append(forms, r.PostForm)
+		tr := tokenResponse{Error: "invalid_grant"}
+		if len(forms) <= len(tokens) {
+			tr = tokens[len(forms)-1]
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(tr))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &forms
+}
+
+func TestTokenSource_ClientCredentials(t *testing.T) {
+	srv, forms := startTokenServer(t,
+		tokenResponse{AccessToken: "one", ExpiresIn: 3600},
+		tokenResponse{AccessToken: "two", ExpiresIn: 3600})
+	s := newTokenSource(srv.Client(), srv.URL, "app", "secret", "", "scope")
+	now := time.Now()
+
+	token, err := s.accessToken(now)
+	require.NoError(t, err)
+	assert.Equal(t, "one", token)
+	token, err = s.accessToken(now.Add(58 * time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, "one", token, "tokens are cached")
+	token, err = s.accessToken(now.Add(59 * time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, "two", token, "tokens are renewed before they expire")
+
+	require.Len(t, *forms, 2)
+	assert.Equal(t, url.Values{"grant_type": {"client_credentials"}, "client_id": {"app"},
+		"client_secret": {"secret"}, "scope": {"scope"}}, (*forms)[0])
+
+	_, err = s.accessToken(now.Add(2 * time.Hour))
+	assert.ErrorContains(t, err, "invalid_grant")
+}
+
+func TestTokenSource_RefreshToken(t *testing.T) {
+	srv, forms := startTokenServer(t,
+		tokenResponse{AccessToken: "one", ExpiresIn: 3600, RefreshToken: "rotated"},
+		tokenResponse{AccessToken: "two", ExpiresIn: 3600})
+	s := newTokenSource(srv.Client(), srv.URL, "app", "", "initial", "scope")
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	require.NoError(t, s.authorize(req))
+	assert.Equal(t, "Bearer one", req.Header.Get("Authorization"))
+	s.invalidate()
+	require.NoError(t, s.authorize(req))
+	assert.Equal(t, "Bearer two", req.Header.Get("Authorization"))
+
+	require.Len(t, *forms, 2)
+	assert.Equal(t, "refresh_token", (*forms)[0].Get("grant_type"))
+	assert.Equal(t, "initial", (*forms)[0].Get("refresh_token"))
+	assert.False(t, (*forms)[0].Has("client_secret"))
+	assert.Equal(t, "rotated", (*forms)[1].Get("refresh_token"), "rotated refresh tokens are used")
+}
+
+// writeServiceAccountKey writes a service account key file and returns its
+// path and public key.
+func writeServiceAccountKey(t *testing.T, tokenURI string) (string, *rsa.PublicKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	b, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "relay@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    tokenURI,
+	})
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "key.json")
+	require.NoError(t, os.WriteFile(path, b, 0o600))
+	return path, &key.PublicKey
+}
+
+// verifyJWT verifies an RS256 JWT and returns its claims.
+func verifyJWT(t *testing.T, jwt string, pub *rsa.PublicKey) map[string]any {
+	t.Helper()
+	parts := strings.Split(jwt, ".")
+	require.Len(t, parts, 3)
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	require.NoError(t, rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig))
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	var claims map[string]any
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	return claims
+}
+
+func TestServiceAccountTokenSource(t *testing.T) {
+	srv, forms := startTokenServer(t, tokenResponse{AccessToken: "token", ExpiresIn: 3600})
+	path, pub := writeServiceAccountKey(t, srv.URL)
+	key, err := loadServiceAccountKey(path)
+	require.NoError(t, err)
+	s := newServiceAccountTokenSource(srv.Client(), srv.URL, key, "scope", "relay@example.com")
+	now := time.Unix(1700000000, 0)
+
+	token, err := s.accessToken(now)
+	require.NoError(t, err)
+	assert.Equal(t, "token", token)
+	require.Len(t, *forms, 1)
+	assert.Equal(t, grantJWTBearer, (*forms)[0].Get("grant_type"))
+	assert.Equal(t, map[string]any{
+		"iss":   "relay@project.iam.gserviceaccount.com",
+		"sub":   "relay@example.com",
+		"scope": "scope",
+		"aud":   srv.URL,
+		"iat":   float64(1700000000),
+		"exp":   float64(1700003600),
+	}, verifyJWT(t, (*forms)[0].Get("assertion"), pub))
+
+	_, err = loadServiceAccountKey(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
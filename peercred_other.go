@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredentials is only supported on Linux. Elsewhere Unix socket peers are
+// trusted based on the socket's permissions alone.
+func peerCredentials(_ net.Conn) (int, int, error) {
+	return 0, 0, errors.New("peer credentials are not supported on this platform")
+}
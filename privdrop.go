@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resolveCredentials returns the user and group IDs to run as, given by name
+// or number. The group defaults to the user's primary group.
+func resolveCredentials(userName, groupName string) (int, int, error) {
+	uid, err := lookupID(userName, lookupUserID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %q: %w", userName, err)
+	}
+	if groupName == "" {
+		u, err := user.LookupId(strconv.Itoa(uid))
+		if err != nil {
+			return 0, 0, fmt.Errorf("primary group of user %q: %w", userName, err)
+		}
+		groupName = u.Gid
+	}
+	gid, err := lookupID(groupName, lookupGroupID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("group %q: %w", groupName, err)
+	}
+	return uid, gid, nil
+}
+
+// validateChroot refuses a chroot together with the options whose files are
+// opened by their path after the chroot, where the path no longer resolves:
+// the recipient map is reloaded, archives and mailboxes are written, pipes
+// are run and Unix sockets are removed on shutdown.
+func validateChroot(config *mailRelayConfig) error {
+	if config.Chroot == "" {
+		return nil
+	}
+	var options []string
+	if config.RecipientMap != "" {
+		options = append(options, "recipient_map")
+	}
+	if config.Archive != nil {
+		options = append(options, "archive")
+	}
+	if config.UnixSocket != nil || (config.LMTP != nil && config.LMTP.UnixSocket != nil) {
+		options = append(options, "unix_socket")
+	}
+	for _, r := range config.Routes {
+		if d := r.Delivery; d != nil && (d.Type == deliveryMaildir || d.Type == deliveryMbox || d.Type == deliveryPipe) {
+			options = append(options, fmt.Sprintf("%s delivery of route %q", d.Type, r.Name))
+		}
+	}
+	if len(options) > 0 {
+		return fmt.Errorf("chroot cannot be combined with %s", strings.Join(options, ", "))
+	}
+	return nil
+}
+
+// prepareChroot loads what mailrelay reads lazily from the file system and
+// would not find inside the chroot.
+func prepareChroot() {
+	// CA certificates for verifying the upstream server
+	if _, err := x509.SystemCertPool(); err != nil {
+		Logger.WithError(err).Warn("loading system CA certificates")
+	}
+	// the local time zone for Date and Received headers
+	time.Now().Zone()
+	// the systemd notify socket, which is outside the chroot
+	if err := connectNotifySocket(); err != nil {
+		Logger.WithError(err).Warn("connecting to systemd notify socket")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// dropPrivileges is only supported on Unix systems.
+func dropPrivileges(appConfig *mailRelayConfig) error {
+	if appConfig.User != "" || appConfig.Chroot != "" {
+		return errors.New("user and chroot are not supported on this platform")
+	}
+	return nil
+}
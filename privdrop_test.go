@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveCredentials(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("user and group IDs are not supported on windows")
+	}
+	current, err := user.Current()
+	require.NoError(t, err)
+	uid, _ := strconv.Atoi(current.Uid)
+	gid, _ := strconv.Atoi(current.Gid)
+
+	tests := []struct {
+		name    string
+		user    string
+		group   string
+		uid     int
+		gid     int
+		wantErr bool
+	}{
+		{name: "name", user: current.Username, uid: uid, gid: gid},
+		{name: "number", user: current.Uid, uid: uid, gid: gid},
+		{name: "group number", user: current.Username, group: "12345", uid: uid, gid: 12345},
+		{name: "unknown user", user: "mailrelay-no-such-user", wantErr: true},
+		{name: "unknown group", user: current.Username, group: "mailrelay-no-such-group", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid, gid, err := resolveCredentials(tt.user, tt.group)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.uid, uid)
+			assert.Equal(t, tt.gid, gid)
+		})
+	}
+}
+
+// TestDropPrivileges drops privileges in a child process, as they cannot be
+// regained by the test.
+func TestDropPrivileges(t *testing.T) {
+	if os.Getenv("MAILRELAY_TEST_DROP") != "" {
+		setupTestLogger(t)
+		err := dropPrivileges(&mailRelayConfig{User: "nobody", Chroot: os.Getenv("MAILRELAY_TEST_DROP")})
+		require.NoError(t, err)
+		_, err = os.Stat("/marker")
+		fmt.Printf("uid=%d gid=%d chroot=%t\n", os.Getuid(), os.Getgid(), err == nil)
+		return
+	}
+	if runtime.GOOS == "windows" || os.Getuid() != 0 {
+		t.Skip("dropping privileges requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no user nobody")
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, os.Chmod(dir, 0o755))
+	require.NoError(t, os.WriteFile(dir+"/marker", nil, 0o644))
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$")
+	cmd.Env = append(os.Environ(), "MAILRELAY_TEST_DROP="+dir)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	assert.Contains(t, string(out), fmt.Sprintf("uid=%s gid=%s chroot=true", nobody.Uid, nobody.Gid))
+}
@@ -0,0 +1,72 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// dropPrivileges changes root to the configured chroot directory and then
+// permanently switches to the configured user and group. It is called once
+// the listeners are bound, so mailrelay can listen on privileged ports.
+func dropPrivileges(appConfig *mailRelayConfig) error {
+	if appConfig.User == "" && appConfig.Chroot == "" {
+		return nil
+	}
+
+	// resolve the user before the chroot hides /etc/passwd
+	var uid, gid int
+	if appConfig.User != "" {
+		var err error
+		if uid, gid, err = resolveCredentials(appConfig.User, appConfig.Group); err != nil {
+			return err
+		}
+	}
+
+	if appConfig.Chroot != "" {
+		prepareChroot()
+		if err := syscall.Chroot(appConfig.Chroot); err != nil {
+			return fmt.Errorf("chroot %s: %w", appConfig.Chroot, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return fmt.Errorf("chdir: %w", err)
+		}
+		Logger.Infof("changed root to %s", appConfig.Chroot)
+	}
+
+	if appConfig.User == "" {
+		return nil
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d: %w", uid, err)
+	}
+	if err := verifyPrivileges(uid, gid); err != nil {
+		return err
+	}
+	Logger.Infof("running as uid %d gid %d", uid, gid)
+	return nil
+}
+
+// verifyPrivileges checks that the process runs as uid and gid, and cannot
+// become root again.
+func verifyPrivileges(uid, gid int) error {
+	if os.Getuid() != uid || os.Geteuid() != uid {
+		return fmt.Errorf("still running as uid %d (effective %d)", os.Getuid(), os.Geteuid())
+	}
+	if os.Getgid() != gid || os.Getegid() != gid {
+		return fmt.Errorf("still running as gid %d (effective %d)", os.Getgid(), os.Getegid())
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return errors.New("root privileges could be regained")
+	}
+	return nil
+}
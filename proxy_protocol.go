@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout limits how long a trusted proxy may take to send
+	// the PROXY header.
+	proxyHeaderTimeout = 10 * time.Second
+
+	// proxyV1MaxLength is the longest valid v1 header, including CRLF.
+	proxyV1MaxLength = 107
+
+	proxyV2HeaderLength = 16
+	proxyV2Version      = 0x2
+	proxyV2CmdLocal     = 0x0
+	proxyV2CmdProxy     = 0x1
+	proxyV2FamilyTCP4   = 0x11
+	proxyV2FamilyTCP6   = 0x21
+	proxyV2AddrLenIPv4  = 12
+	proxyV2AddrLenIPv6  = 36
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolConfig enables the PROXY protocol (v1 and v2) on TCP
+// listeners. Connections from TrustedProxies must start with a PROXY
+// header; other clients connect directly and may not send one.
+type proxyProtocolConfig struct {
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+func (c *proxyProtocolConfig) validate() error {
+	if len(c.TrustedProxies) == 0 {
+		return errors.New("proxy_protocol: trusted_proxies is required")
+	}
+	for _, s := range c.TrustedProxies {
+		if _, err := parsePrefix(s); err != nil {
+			return fmt.Errorf("proxy_protocol: %w", err)
+		}
+	}
+	return nil
+}
+
+// trusted returns true if ip belongs to a trusted proxy.
+func (c *proxyProtocolConfig) trusted(ip string) bool {
+	return ipInList(ip, c.TrustedProxies)
+}
+
+// bufferedConn is a connection whose first bytes were read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// readProxyHeader reads a v1 or v2 PROXY header from a connection and returns
+// the client address it carries. A connection the proxy made on its own
+// behalf, such as a health check, returns an invalid address.
+func readProxyHeader(conn net.Conn) (netip.Addr, net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return netip.Addr{}, nil, err
+	}
+	r := bufio.NewReader(conn)
+	var addr netip.Addr
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		addr, err = readProxyV2(r)
+	} else {
+		addr, err = readProxyV1(r)
+	}
+	if err != nil {
+		return netip.Addr{}, nil, fmt.Errorf("invalid PROXY header: %w", err)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return netip.Addr{}, nil, err
+	}
+	return addr, &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// readProxyV1 parses "PROXY TCP4 <src> <dst> <sport> <dport>\r\n".
+func readProxyV1(r *bufio.Reader) (netip.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return netip.Addr{}, errors.New("v1 header not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	switch {
+	case fields[0] != "PROXY" || len(fields) < 2:
+		return netip.Addr{}, errors.New("missing PROXY signature")
+	case fields[1] == "UNKNOWN":
+		return netip.Addr{}, nil
+	case fields[1] != "TCP4" && fields[1] != "TCP6":
+		return netip.Addr{}, fmt.Errorf("unsupported protocol %q", fields[1])
+	case len(fields) != 6:
+		return netip.Addr{}, errors.New("wrong number of fields")
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if addr.Is4() != (fields[1] == "TCP4") {
+		return netip.Addr{}, fmt.Errorf("%s address for %s", addr, fields[1])
+	}
+	return addr, nil
+}
+
+// readProxyV2 parses a binary v2 header.
+func readProxyV2(r *bufio.Reader) (netip.Addr, error) {
+	header := make([]byte, proxyV2HeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return netip.Addr{}, err
+	}
+	if header[12]>>4 != proxyV2Version {
+		return netip.Addr{}, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return netip.Addr{}, err
+	}
+
+	switch cmd := header[12] & 0x0f; cmd {
+	case proxyV2CmdLocal:
+		return netip.Addr{}, nil
+	case proxyV2CmdProxy:
+	default:
+		return netip.Addr{}, fmt.Errorf("unsupported command %d", cmd)
+	}
+
+	switch family := header[13]; family {
+	case proxyV2FamilyTCP4:
+		if len(body) < proxyV2AddrLenIPv4 {
+			return netip.Addr{}, errors.New("address block too short")
+		}
+		return netip.AddrFrom4([4]byte(body[:4])), nil
+	case proxyV2FamilyTCP6:
+		if len(body) < proxyV2AddrLenIPv6 {
+			return netip.Addr{}, errors.New("address block too short")
+		}
+		return netip.AddrFrom16([16]byte(body[:16])).Unmap(), nil
+	default:
+		// UDP, Unix sockets and unspecified addresses carry no client IP
+		return netip.Addr{}, nil
+	}
+}
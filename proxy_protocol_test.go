@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func proxyV2Header(cmd, family byte, addrs []byte) []byte {
+	h := append([]byte{}, proxyV2Signature...)
+	h = append(h, proxyV2Version<<4|cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+// readHeaderFrom runs readProxyHeader on a connection that received input.
+func readHeaderFrom(t *testing.T, input []byte) (string, string, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		_, _ = client.Write(input)
+		_, _ = client.Write([]byte("EHLO x\r\n"))
+	}()
+
+	addr, conn, err := readProxyHeader(server)
+	if err != nil {
+		return "", "", err
+	}
+	rest, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	if !addr.IsValid() {
+		return "", rest, nil
+	}
+	return addr.String(), rest, nil
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 168, 1, 50, 10, 0, 0, 1, 0x30, 0x39, 0, 25}
+	ipv6 := make([]byte, proxyV2AddrLenIPv6)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+
+	tests := []struct {
+		name     string
+		input    []byte
+		expected string
+		wantErr  bool
+	}{
+		{name: "v1 tcp4", input: []byte("PROXY TCP4 192.168.1.50 10.0.0.1 12345 25\r\n"), expected: "192.168.1.50"},
+		{name: "v1 tcp6", input: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 25\r\n"), expected: "2001:db8::1"},
+		{name: "v1 unknown", input: []byte("PROXY UNKNOWN\r\n"), expected: ""},
+		{name: "v1 family mismatch", input: []byte("PROXY TCP6 192.168.1.50 10.0.0.1 1 25\r\n"), wantErr: true},
+		{name: "v1 missing crlf", input: []byte("PROXY TCP4 192.168.1.50 10.0.0.1 1 25\n"), wantErr: true},
+		{name: "no header", input: []byte("EHLO client\r\n"), wantErr: true},
+		{name: "v2 tcp4", input: proxyV2Header(proxyV2CmdProxy, proxyV2FamilyTCP4, ipv4), expected: "192.168.1.50"},
+		{name: "v2 tcp6", input: proxyV2Header(proxyV2CmdProxy, proxyV2FamilyTCP6, ipv6), expected: "2001:db8::1"},
+		{name: "v2 local", input: proxyV2Header(proxyV2CmdLocal, 0, nil), expected: ""},
+		{name: "v2 short address", input: proxyV2Header(proxyV2CmdProxy, proxyV2FamilyTCP4, ipv4[:4]), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, rest, err := readHeaderFrom(t, tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, addr)
+			assert.Equal(t, "EHLO x\r\n", rest, "data after the header is kept")
+		})
+	}
+}
+
+func TestFrontend_ProxyProtocol(t *testing.T) {
+	setupTestLogger(t)
+
+	tests := []struct {
+		name     string
+		trusted  []string
+		header   string
+		expected string
+	}{
+		{name: "trusted proxy", trusted: []string{"127.0.0.0/8"}, header: "PROXY TCP4 203.0.113.9 127.0.0.1 5000 25\r\n",
+			expected: "203.0.113.9"},
+		{name: "untrusted client", trusted: []string{"10.0.0.0/8"}, expected: "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backendAddr, tokens := fakeBackend(t)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer l.Close()
+
+			fe := newFrontend(backendAddr, newPeerRegistry(), time.Minute, DefaultMaxEmailSize)
+			fe.serve(&frontendListener{Listener: l, proxy: &proxyProtocolConfig{TrustedProxies: tt.trusted}})
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			fmt.Fprint(conn, tt.header)
+
+			_, err = readReply(bufio.NewReader(conn))
+			require.NoError(t, err)
+			peer, ok := fe.peers.lookup(<-tokens)
+			require.True(t, ok)
+			assert.Equal(t, tt.expected, peer.addr)
+			assert.False(t, peer.trusted)
+		})
+	}
+}
+
+func TestFrontend_ProxyProtocolRejectsMissingHeader(t *testing.T) {
+	setupTestLogger(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	fe := newFrontend("127.0.0.1:1", newPeerRegistry(), time.Minute, DefaultMaxEmailSize)
+	fe.serve(&frontendListener{Listener: l, proxy: &proxyProtocolConfig{TrustedProxies: []string{"127.0.0.1"}}})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "EHLO client\r\n")
+
+	reply, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(reply), "554 5.7.1 invalid PROXY header")
+}
+
+func TestProxyProtocolConfig(t *testing.T) {
+	cfg := &proxyProtocolConfig{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}}
+	require.NoError(t, cfg.validate())
+	assert.True(t, cfg.trusted("10.1.2.3"))
+	assert.True(t, cfg.trusted("192.168.1.1"))
+	assert.False(t, cfg.trusted("192.168.1.2"))
+
+	assert.Error(t, (&proxyProtocolConfig{}).validate())
+	assert.Error(t, (&proxyProtocolConfig{TrustedProxies: []string{"10.0.0.0/33"}}).validate())
+}
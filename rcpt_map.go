@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// recipientMapCheckInterval limits how often the map file is checked for changes.
+const recipientMapCheckInterval = 5 * time.Second
+
+// recipientMap rewrites envelope recipients using rules loaded from a file.
+// The file is reloaded automatically when it changes.
+//
+// Each non-empty line holds a pattern followed by one or more comma or space
+// separated target addresses. Lines starting with '#' are comments.
+//
+//	root@localhost      admin@example.com
+//	@olddomain.com      @example.com
+//	/^printer-(.*)@lan$/ $1@example.com
+//	*                   fallback@example.com, oncall@example.com
+//
+// Patterns are tried in this order: exact addresses, domain wildcards
+// ("@domain"), regular expressions ("/regex/", in file order) and finally the
+// catch-all ("*"). A target starting with '@' keeps the original local part.
+// Regular expression targets may reference capture groups as $1 or ${name}.
+// Targets are not expanded again, so rules cannot loop.
+type recipientMap struct {
+	path string
+
+	mu        sync.Mutex
+	rules     *recipientRules
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+type recipientRules struct {
+	exact    map[string][]string
+	domains  map[string][]string
+	regexps  []regexpRule
+	catchAll []string
+}
+
+type regexpRule struct {
+	re      *regexp.Regexp
+	targets []string
+}
+
+// loadRecipientMap loads the recipient map at path.
+func loadRecipientMap(path string) (*recipientMap, error) {
+	m := &recipientMap{path: path}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *recipientMap) load() error {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(m.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	rules, err := parseRecipientRules(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.path, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = rules
+	m.modTime = info.ModTime()
+	return nil
+}
+
+// reloadIfChanged reloads the map if the file was modified since it was last
+// loaded. If the new file is invalid the previous rules stay in effect.
+func (m *recipientMap) reloadIfChanged() {
+	m.mu.Lock()
+	if time.Since(m.lastCheck) < recipientMapCheckInterval {
+		m.mu.Unlock()
+		return
+	}
+	m.lastCheck = time.Now()
+	modTime := m.modTime
+	m.mu.Unlock()
+
+	info, err := os.Stat(m.path)
+	if err != nil {
+		Logger.WithError(err).Errorf("checking recipient map %s", m.path)
+		return
+	}
+	if info.ModTime().Equal(modTime) {
+		return
+	}
+	if err := m.load(); err != nil {
+		Logger.WithError(err).Error("reloading recipient map, keeping previous rules")
+		return
+	}
+	Logger.Infof("reloaded recipient map %s", m.path)
+}
+
+func parseRecipientRules(r io.Reader) (*recipientRules, error) {
+	rules := &recipientRules{
+		exact:   make(map[string][]string),
+		domains: make(map[string][]string),
+	}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := rules.addLine(line); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (rr *recipientRules) addLine(line string) error {
+	pattern, rest := splitPattern(line)
+	targets := strings.FieldsFunc(rest, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	if len(targets) == 0 {
+		return fmt.Errorf("pattern %q has no targets", pattern)
+	}
+
+	switch {
+	case pattern == "*":
+		rr.catchAll = targets
+	case strings.HasPrefix(pattern, "/"):
+		if len(pattern) < 2 || !strings.HasSuffix(pattern, "/") {
+			return fmt.Errorf("unterminated regular expression %s", pattern)
+		}
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return fmt.Errorf("invalid regular expression %s: %w", pattern, err)
+		}
+		rr.regexps = append(rr.regexps, regexpRule{re: re, targets: targets})
+	case strings.HasPrefix(pattern, "@"):
+		rr.domains[strings.ToLower(pattern[1:])] = targets
+	case strings.Contains(pattern, "@"):
+		rr.exact[strings.ToLower(pattern)] = targets
+	default:
+		return fmt.Errorf("invalid pattern %q", pattern)
+	}
+
+	for _, t := range targets {
+		if strings.HasPrefix(t, "@") {
+			t = "postmaster" + t
+		}
+		if _, err := parseAddress(t); err != nil {
+			return fmt.Errorf("invalid target %q", t)
+		}
+	}
+	return nil
+}
+
+// splitPattern splits a line into its pattern and the remaining text. A
+// regular expression pattern may contain spaces, so it extends to the closing slash.
+func splitPattern(line string) (string, string) {
+	if strings.HasPrefix(line, "/") {
+		if end := strings.LastIndex(line, "/"); end > 0 {
+			return line[:end+1], line[end+1:]
+		}
+	}
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		return line[:i], line[i:]
+	}
+	return line, ""
+}
+
+// lookup returns the expanded targets for addr, or false if no rule matches.
+func (rr *recipientRules) lookup(addr string) ([]string, bool) {
+	addr = strings.ToLower(addr)
+	if targets, ok := rr.exact[addr]; ok {
+		return targets, true
+	}
+	if at := strings.LastIndexByte(addr, '@'); at >= 0 {
+		if targets, ok := rr.domains[addr[at+1:]]; ok {
+			return targets, true
+		}
+	}
+	for _, rule := range rr.regexps {
+		match := rule.re.FindStringSubmatchIndex(addr)
+		if match == nil {
+			continue
+		}
+		expanded := make([]string, 0, len(rule.targets))
+		for _, t := range rule.targets {
+			expanded = append(expanded, string(rule.re.ExpandString(nil, t, addr, match)))
+		}
+		return expanded, true
+	}
+	if len(rr.catchAll) > 0 {
+		return rr.catchAll, true
+	}
+	return nil, false
+}
+
+// rewrite applies all matching rules to the envelope recipients. Duplicate
+// recipients are removed.
+func (m *recipientMap) rewrite(e *mail.Envelope) {
+	rcpts := e.RcptTo
+	m.mu.Lock()
+	rules := m.rules
+	m.mu.Unlock()
+
+	ret := make([]mail.Address, 0, len(rcpts))
+	seen := make(map[string]bool)
+	appendUnique := func(a mail.Address) {
+		key := strings.ToLower(a.String())
+		if !seen[key] {
+			seen[key] = true
+			ret = append(ret, a)
+		}
+	}
+
+	for i := range rcpts {
+		orig := rcpts[i].String()
+		targets, ok := rules.lookup(orig)
+		if !ok {
+			appendUnique(rcpts[i])
+			continue
+		}
+		expanded := expandTargets(e, rcpts[i], targets)
+		if len(expanded) == 0 {
+			appendUnique(rcpts[i])
+			continue
+		}
+		names := make([]string, 0, len(expanded))
+		for _, a := range expanded {
+			appendUnique(a)
+			names = append(names, a.String())
+		}
+		msgLog(e).Infof("rewrote recipient %s -> %s", orig, strings.Join(names, ", "))
+	}
+	e.RcptTo = ret
+}
+
+func expandTargets(e *mail.Envelope, orig mail.Address, targets []string) []mail.Address {
+	ret := make([]mail.Address, 0, len(targets))
+	for _, t := range targets {
+		if strings.HasPrefix(t, "@") {
+			t = orig.User + t
+		}
+		a, err := parseAddress(t)
+		if err != nil {
+			msgLog(e).WithError(err).Errorf("recipient map produced invalid address %q", t)
+			continue
+		}
+		a.DisplayName = ""
+		ret = append(ret, a)
+	}
+	return ret
+}
+
+// rcptRewriteProcessor decorator rewrites envelope recipients using the recipient map.
+var rcptRewriteProcessor = func() backends.Decorator {
+	var rmap *recipientMap
+	initFunc := backends.InitializeWith(func(backendConfig backends.BackendConfig) error {
+		path, ok := backendConfig["recipient_map"].(string)
+		if !ok || path == "" {
+			return nil
+		}
+		var err error
+		rmap, err = loadRecipientMap(path)
+		if err != nil {
+			return fmt.Errorf("loading recipient map: %w", err)
+		}
+		return nil
+	})
+	backends.Svc.AddInitializer(initFunc)
+
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail && rmap != nil {
+					rmap.reloadIfChanged()
+					rmap.rewrite(e)
+				}
+				return p.Process(e, task)
+			},
+		)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func rewriteRecipients(rmap *recipientMap, rcpts []mail.Address) []string {
+	e := &mail.Envelope{RcptTo: rcpts}
+	rmap.rewrite(e)
+	return addressStrings(e.RcptTo)
+}
+
+func addressStrings(addrs []mail.Address) []string {
+	ret := make([]string, 0, len(addrs))
+	for i := range addrs {
+		ret = append(ret, addrs[i].String())
+	}
+	return ret
+}
+
+func TestRecipientMapRewrite(t *testing.T) {
+	setupTestLogger(t)
+	rmap, err := loadRecipientMap("testdata/recipient_map.txt")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		rcpts    []mail.Address
+		expected []string
+	}{
+		{
+			name:     "exact",
+			rcpts:    []mail.Address{{User: "Root", Host: "localhost"}},
+			expected: []string{"admin@example.com"},
+		},
+		{
+			name:     "one to many",
+			rcpts:    []mail.Address{{User: "admin", Host: "localdomain"}},
+			expected: []string{"ops@example.com", "oncall@example.com"},
+		},
+		{
+			name:     "domain wildcard keeps local part",
+			rcpts:    []mail.Address{{User: "jane", Host: "olddomain.com"}},
+			expected: []string{"jane@example.com"},
+		},
+		{
+			name:     "regex with capture group",
+			rcpts:    []mail.Address{{User: "printer-3f", Host: "lan"}},
+			expected: []string{"print-3f@example.com"},
+		},
+		{
+			name:     "catch-all",
+			rcpts:    []mail.Address{{User: "someone", Host: "elsewhere.org"}},
+			expected: []string{"fallback@example.com"},
+		},
+		{
+			name: "duplicates removed",
+			rcpts: []mail.Address{
+				{User: "root", Host: "localhost"},
+				{User: "admin", Host: "example.com"},
+				{User: "nobody", Host: "x.org"},
+				{User: "other", Host: "y.org"},
+			},
+			expected: []string{"admin@example.com", "fallback@example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, rewriteRecipients(rmap, tt.rcpts))
+		})
+	}
+}
+
+func TestRecipientMapRewrite_NoMatch(t *testing.T) {
+	setupTestLogger(t)
+	rules, err := parseRecipientRules(strings.NewReader("root@localhost admin@example.com\n"))
+	require.NoError(t, err)
+	rmap := &recipientMap{rules: rules}
+
+	rcpts := []mail.Address{{User: "user", Host: "example.com"}}
+	assert.Equal(t, []string{"user@example.com"}, rewriteRecipients(rmap, rcpts))
+}
+
+func TestParseRecipientRules_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "no targets", input: "root@localhost\n"},
+		{name: "bad regex", input: "/([a-z/ a@example.com\n"},
+		{name: "unterminated regex", input: "/abc a@example.com\n"},
+		{name: "bad pattern", input: "root a@example.com\n"},
+		{name: "bad target", input: "root@localhost not-an-address\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseRecipientRules(strings.NewReader(tt.input))
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "line 1")
+		})
+	}
+}
+
+func TestRecipientMapReload(t *testing.T) {
+	setupTestLogger(t)
+	path := filepath.Join(t.TempDir(), "aliases")
+	require.NoError(t, os.WriteFile(path, []byte("root@localhost first@example.com\n"), 0o600))
+
+	rmap, err := loadRecipientMap(path)
+	require.NoError(t, err)
+	rcpts := []mail.Address{{User: "root", Host: "localhost"}}
+	assert.Equal(t, []string{"first@example.com"}, rewriteRecipients(rmap, rcpts))
+
+	require.NoError(t, os.WriteFile(path, []byte("root@localhost second@example.com\n"), 0o600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+	rmap.reloadIfChanged()
+	assert.Equal(t, []string{"second@example.com"}, rewriteRecipients(rmap, rcpts))
+
+	// an invalid file keeps the previous rules
+	require.NoError(t, os.WriteFile(path, []byte("root@localhost\n"), 0o600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+	rmap.lastCheck = time.Time{}
+	rmap.reloadIfChanged()
+	assert.Equal(t, []string{"second@example.com"}, rewriteRecipients(rmap, rcpts))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/sirupsen/logrus"
+)
+
+const relayIDBytes = 8
+
+// newRelayID returns a random identifier for a relayed message.
+func newRelayID() string {
+	b := make([]byte, relayIDBytes)
+	if _, err := rand.Read(b); err != nil {
+		// fall back to something unique enough for correlating logs
+		return fmt.Sprintf("%016X", time.Now().UnixNano())
+	}
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+// msgLog returns a logger that tags every line with the message's relay ID.
+func msgLog(e *mail.Envelope) *logrus.Entry {
+	return Logger.WithField("relay_id", e.QueuedId)
+}
+
+// localHostname returns the name this relay uses to identify itself.
+func localHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "localhost"
+	}
+	return hostname
+}
+
+// receivedHeader builds the value of an RFC 5321 section 4.4 trace field for
+// the message. Continuation lines are folded using eol.
+func receivedHeader(e *mail.Envelope, by string, now time.Time, eol string) string {
+	helo := "unknown"
+	if fields := strings.Fields(e.Helo); len(fields) > 0 {
+		helo = fields[0]
+	}
+
+	protocol := "SMTP"
+	if e.ESMTP {
+		protocol = "ESMTP"
+	}
+	tls := ""
+	if e.TLS {
+		protocol += "S"
+		tls = " (TLS)"
+	}
+
+	addr := "[" + e.RemoteIP + "]"
+	if strings.HasPrefix(e.RemoteIP, "unix") {
+		// local Unix socket peers have no IP address
+		addr = e.RemoteIP
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "from %s (%s)%s", helo, addr, eol)
+	fmt.Fprintf(&sb, "\tby %s (mailrelay) with %s%s id %s", by, protocol, tls, e.QueuedId)
+	if len(e.RcptTo) == 1 {
+		fmt.Fprintf(&sb, "%s\tfor <%s>", eol, e.RcptTo[0].String())
+	}
+	fmt.Fprintf(&sb, ";%s\t%s", eol, now.Format(time.RFC1123Z))
+	return sb.String()
+}
+
+// stampReceived prepends a Received header to the message data.
+func stampReceived(e *mail.Envelope) {
+	msg := parseMessage(e.Data.Bytes())
+	msg.prepend("Received", receivedHeader(e, localHostname(), time.Now(), msg.eol))
+	replaceData(e, msg.bytes())
+}
+
+// relayIDProcessor decorator assigns a unique relay ID to each message. The
+// ID is returned to the client in the 250 response and tags all log lines
+// for the message. It also records what recognizes the message when the
+// client retries it, so it must run before the message is changed.
+var relayIDProcessor = func() backends.Decorator {
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail {
+					// the envelope is reused for every message of a session,
+					// so the ID guerrilla assigned on connect is not unique
+					e.QueuedId = newRelayID()
+					recordReceivedMessage(e)
+					msgLog(e).Infof("received message from %s (%s) -- from:%s, rcpts:%d",
+						e.RemoteIP, e.Helo, e.MailFrom.String(), len(e.RcptTo))
+				}
+				return p.Process(e, task)
+			},
+		)
+	}
+}
+
+// receivedProcessor decorator stamps the relay's Received trace header.
+var receivedProcessor = func() backends.Decorator {
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail {
+					stampReceived(e)
+				}
+				return p.Process(e, task)
+			},
+		)
+	}
+}
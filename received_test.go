@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRelayID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := newRelayID()
+		assert.Len(t, id, 2*relayIDBytes)
+		assert.False(t, seen[id], "relay IDs must be unique")
+		seen[id] = true
+	}
+}
+
+func TestReceivedHeader(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		envelope *mail.Envelope
+		expected string
+	}{
+		{
+			name: "single recipient with TLS",
+			envelope: &mail.Envelope{
+				RemoteIP: "192.168.1.50",
+				Helo:     "scanner.lan",
+				ESMTP:    true,
+				TLS:      true,
+				QueuedId: "ABC123",
+				RcptTo:   []mail.Address{{User: "me", Host: "example.com"}},
+			},
+			expected: "from scanner.lan ([192.168.1.50])\r\n" +
+				"\tby relay.example.com (mailrelay) with ESMTPS (TLS) id ABC123\r\n" +
+				"\tfor <me@example.com>;\r\n" +
+				"\tFri, 01 Mar 2024 12:30:00 +0000",
+		},
+		{
+			name: "no helo, several recipients",
+			envelope: &mail.Envelope{
+				RemoteIP: "10.0.0.1",
+				QueuedId: "ABC123",
+				RcptTo: []mail.Address{
+					{User: "a", Host: "example.com"},
+					{User: "b", Host: "example.com"},
+				},
+			},
+			expected: "from unknown ([10.0.0.1])\r\n" +
+				"\tby relay.example.com (mailrelay) with SMTP id ABC123;\r\n" +
+				"\tFri, 01 Mar 2024 12:30:00 +0000",
+		},
+		{
+			name: "unix socket peer",
+			envelope: &mail.Envelope{
+				RemoteIP: "unix:1000:100",
+				Helo:     "app",
+				ESMTP:    true,
+				QueuedId: "ABC123",
+			},
+			expected: "from app (unix:1000:100)\r\n" +
+				"\tby relay.example.com (mailrelay) with ESMTP id ABC123;\r\n" +
+				"\tFri, 01 Mar 2024 12:30:00 +0000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, receivedHeader(tt.envelope, "relay.example.com", now, "\r\n"))
+		})
+	}
+}
+
+func TestStampReceived(t *testing.T) {
+	e := &mail.Envelope{
+		RemoteIP: "192.168.1.50",
+		Helo:     "scanner",
+		QueuedId: "ABC123",
+		Data:     *bytes.NewBufferString("Received: from older\nSubject: s\n\nbody\n"),
+	}
+	stampReceived(e)
+
+	msg := parseMessage(e.Data.Bytes())
+	received := msg.values("Received")
+	assert.Len(t, received, 2)
+	assert.True(t, strings.HasPrefix(received[0], "from scanner ([192.168.1.50])"))
+	assert.Contains(t, received[0], "id ABC123")
+	assert.Equal(t, "from older", received[1])
+	assert.NotContains(t, e.Data.String(), "\r\n", "line endings of the message are kept")
+}
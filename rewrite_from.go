@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	netmail "net/mail"
+	"strings"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	rewriteModeBoth     = "both"
+	rewriteModeEnvelope = "envelope"
+	rewriteModeHeader   = "header"
+)
+
+// fromRewriteConfig describes how the envelope sender and the From header are
+// rewritten so they match the account used to authenticate with the upstream.
+type fromRewriteConfig struct {
+	Address    string `json:"address"`
+	Mode       string `json:"mode"`
+	KeepName   bool   `json:"keep_original_name"`
+	AddReplyTo bool   `json:"add_reply_to"`
+	// Sources overrides the rule for specific client IPs or CIDR ranges.
+	Sources map[string]*fromRewriteConfig `json:"sources"`
+}
+
+func (c *fromRewriteConfig) validate() error {
+	if c.Address != "" {
+		if _, err := parseAddress(c.Address); err != nil {
+			return fmt.Errorf("rewrite_from address %q is invalid", c.Address)
+		}
+	}
+	switch c.Mode {
+	case "", rewriteModeBoth, rewriteModeEnvelope, rewriteModeHeader:
+	default:
+		return fmt.Errorf("rewrite_from mode must be one of %q, %q or %q",
+			rewriteModeBoth, rewriteModeEnvelope, rewriteModeHeader)
+	}
+	for src, rule := range c.Sources {
+		if _, err := parsePrefix(src); err != nil {
+			return fmt.Errorf("rewrite_from sources: %w", err)
+		}
+		if len(rule.Sources) > 0 {
+			return errors.New("rewrite_from sources cannot be nested")
+		}
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *fromRewriteConfig) rewritesEnvelope() bool {
+	return c.Mode != rewriteModeHeader
+}
+
+func (c *fromRewriteConfig) rewritesHeader() bool {
+	return c.Mode != rewriteModeEnvelope
+}
+
+// fromRewriteProcessor decorator rewrites the sender before the message is relayed.
+var fromRewriteProcessor = func() backends.Decorator {
+	var global *fromRewriteConfig
+	var routes []*routeConfig
+	initFunc := backends.InitializeWith(func(backendConfig backends.BackendConfig) error {
+		if c, ok := backendConfig["rewrite_from"].(*fromRewriteConfig); ok {
+			global = c
+		}
+		if r, ok := backendConfig["routes"].([]*routeConfig); ok {
+			routes = r
+		}
+		return nil
+	})
+	backends.Svc.AddInitializer(initFunc)
+
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail {
+					if rule := resolveFromRewrite(global, matchRoute(routes, e), e.RemoteIP); rule != nil {
+						if err := rewriteFrom(e, rule); err != nil {
+							return backends.NewResult(err.Error()), err
+						}
+					}
+				}
+				return p.Process(e, task)
+			},
+		)
+	}
+}
+
+// resolveFromRewrite picks the most specific rule for a message: a per-source
+// override of the route rule, a per-source override of the global rule, the
+// route rule and finally the global rule. It returns nil if nothing should be
+// rewritten.
+func resolveFromRewrite(global *fromRewriteConfig, route *routeConfig, remoteIP string) *fromRewriteConfig {
+	var candidates []*fromRewriteConfig
+	if route != nil && route.RewriteFrom != nil {
+		candidates = append(candidates, route.RewriteFrom)
+	}
+	if global != nil {
+		candidates = append(candidates, global)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	rule := candidates[0]
+	for _, c := range candidates {
+		if src := sourceOverride(c, remoteIP); src != nil {
+			rule = src
+			break
+		}
+	}
+	if rule.Address == "" {
+		return nil
+	}
+	return rule
+}
+
+// sourceOverride returns the override with the longest prefix containing remoteIP.
+func sourceOverride(c *fromRewriteConfig, remoteIP string) *fromRewriteConfig {
+	var best *fromRewriteConfig
+	bestBits := -1
+	for src, rule := range c.Sources {
+		prefix, err := parsePrefix(src)
+		if err != nil || prefix.Bits() <= bestBits || !ipInList(remoteIP, []string{src}) {
+			continue
+		}
+		best, bestBits = rule, prefix.Bits()
+	}
+	return best
+}
+
+// rewriteFrom applies a rewrite rule to the envelope sender and the From header.
+func rewriteFrom(e *mail.Envelope, rule *fromRewriteConfig) error {
+	newFrom, err := parseAddress(rule.Address)
+	if err != nil {
+		return fmt.Errorf("rewrite_from address %q is invalid", rule.Address)
+	}
+	origEnvelope := e.MailFrom.String()
+
+	if rule.rewritesEnvelope() && !e.MailFrom.NullPath && !e.MailFrom.IsEmpty() {
+		e.MailFrom = mail.Address{User: newFrom.User, Host: newFrom.Host, Quoted: newFrom.Quoted}
+		msgLog(e).Infof("rewrote envelope sender %s -> %s", origEnvelope, e.MailFrom.String())
+	}
+
+	if !rule.rewritesHeader() {
+		return nil
+	}
+
+	msg := parseMessage(e.Data.Bytes())
+	origHeader := msg.get("From")
+	name, origAddr := originalSender(origHeader, origEnvelope)
+
+	// netmail quotes the local part itself, so it gets the unquoted address
+	from := netmail.Address{Name: newFrom.DisplayName, Address: newFrom.User + "@" + newFrom.Host}
+	if rule.KeepName && name != "" && !strings.EqualFold(name, from.Address) {
+		from.Name = name
+	}
+	msg.set("From", from.String())
+	if rule.AddReplyTo && origAddr != "" && !msg.has("Reply-To") {
+		msg.set("Reply-To", origAddr)
+	}
+
+	replaceData(e, msg.bytes())
+	msgLog(e).Infof("rewrote From header %q -> %q", origHeader, from.String())
+	return nil
+}
+
+// originalSender returns a display name and a reply address for the original
+// sender, taken from the From header if it can be parsed and the envelope
+// sender otherwise.
+func originalSender(header, envelope string) (name string, addr string) {
+	if header != "" {
+		if a, err := netmail.ParseAddress(header); err == nil {
+			if a.Name != "" {
+				return a.Name, a.Address
+			}
+			return a.Address, a.Address
+		}
+		return header, ""
+	}
+	if envelope != "" {
+		return envelope, envelope
+	}
+	return "", ""
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewriteFrom(t *testing.T) {
+	setupTestLogger(t)
+
+	tests := []struct {
+		name         string
+		rule         *fromRewriteConfig
+		mailFrom     mail.Address
+		data         string
+		wantMailFrom string
+		wantData     string
+	}{
+		{
+			name:         "envelope and header",
+			rule:         &fromRewriteConfig{Address: "me@fastmail.com"},
+			mailFrom:     mail.Address{User: "scanner", Host: "localhost"},
+			data:         "From: scanner@localhost\r\nSubject: scan\r\n\r\nbody\r\n",
+			wantMailFrom: "me@fastmail.com",
+			wantData:     "From: <me@fastmail.com>\r\nSubject: scan\r\n\r\nbody\r\n",
+		},
+		{
+			name:         "keep name and add reply-to",
+			rule:         &fromRewriteConfig{Address: "me@fastmail.com", KeepName: true, AddReplyTo: true},
+			mailFrom:     mail.Address{User: "root", Host: "nas"},
+			data:         "From: NAS Monitor <root@nas.lan>\r\n\r\nbody\r\n",
+			wantMailFrom: "me@fastmail.com",
+			wantData: "From: \"NAS Monitor\" <me@fastmail.com>\r\nReply-To: root@nas.lan\r\n" +
+				"\r\nbody\r\n",
+		},
+		{
+			name:         "keep name falls back to address",
+			rule:         &fromRewriteConfig{Address: "me@fastmail.com", KeepName: true},
+			mailFrom:     mail.Address{User: "root", Host: "nas"},
+			data:         "From: root@nas\nSubject: s\n\nbody\n",
+			wantMailFrom: "me@fastmail.com",
+			wantData:     "From: \"root@nas\" <me@fastmail.com>\nSubject: s\n\nbody\n",
+		},
+		{
+			name:         "existing reply-to kept",
+			rule:         &fromRewriteConfig{Address: "me@fastmail.com", AddReplyTo: true},
+			mailFrom:     mail.Address{User: "root", Host: "nas"},
+			data:         "From: root@nas\r\nReply-To: admin@example.com\r\n\r\nbody\r\n",
+			wantMailFrom: "me@fastmail.com",
+			wantData:     "From: <me@fastmail.com>\r\nReply-To: admin@example.com\r\n\r\nbody\r\n",
+		},
+		{
+			name:         "envelope only",
+			rule:         &fromRewriteConfig{Address: "me@fastmail.com", Mode: rewriteModeEnvelope},
+			mailFrom:     mail.Address{User: "root", Host: "nas"},
+			data:         "From: root@nas\r\n\r\nbody\r\n",
+			wantMailFrom: "me@fastmail.com",
+			wantData:     "From: root@nas\r\n\r\nbody\r\n",
+		},
+		{
+			name:         "header only adds missing From",
+			rule:         &fromRewriteConfig{Address: "me@fastmail.com", Mode: rewriteModeHeader},
+			mailFrom:     mail.Address{User: "root", Host: "nas"},
+			data:         "Subject: s\r\n\r\nbody\r\n",
+			wantMailFrom: "root@nas",
+			wantData:     "Subject: s\r\nFrom: <me@fastmail.com>\r\n\r\nbody\r\n",
+		},
+		{
+			name:         "configured display name",
+			rule:         &fromRewriteConfig{Address: "Alerts <alerts@fastmail.com>"},
+			mailFrom:     mail.Address{User: "root", Host: "nas"},
+			data:         "From: root@nas\r\n\r\nbody\r\n",
+			wantMailFrom: "alerts@fastmail.com",
+			wantData:     "From: \"Alerts\" <alerts@fastmail.com>\r\n\r\nbody\r\n",
+		},
+		{
+			name:         "keep name without original sender",
+			rule:         &fromRewriteConfig{Address: "Alerts <alerts@fastmail.com>", KeepName: true},
+			mailFrom:     mail.Address{NullPath: true},
+			data:         "Subject: bounce\r\n\r\nbody\r\n",
+			wantMailFrom: "",
+			wantData:     "Subject: bounce\r\nFrom: \"Alerts\" <alerts@fastmail.com>\r\n\r\nbody\r\n",
+		},
+		{
+			name:         "quoted local part",
+			rule:         &fromRewriteConfig{Address: `"nas alerts"@example.com`},
+			mailFrom:     mail.Address{User: "root", Host: "nas"},
+			data:         "From: root@nas\r\n\r\nbody\r\n",
+			wantMailFrom: `"nas alerts"@example.com`,
+			wantData:     "From: <\"nas alerts\"@example.com>\r\n\r\nbody\r\n",
+		},
+		{
+			name:         "null sender not rewritten",
+			rule:         &fromRewriteConfig{Address: "me@fastmail.com", Mode: rewriteModeEnvelope},
+			mailFrom:     mail.Address{NullPath: true},
+			data:         "Subject: bounce\r\n\r\nbody\r\n",
+			wantMailFrom: "",
+			wantData:     "Subject: bounce\r\n\r\nbody\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &mail.Envelope{
+				MailFrom: tt.mailFrom,
+				Data:     *bytes.NewBufferString(tt.data),
+			}
+			require.NoError(t, rewriteFrom(e, tt.rule))
+			assert.Equal(t, tt.wantMailFrom, e.MailFrom.String())
+			assert.Equal(t, tt.wantData, e.Data.String())
+		})
+	}
+}
+
+func TestResolveFromRewrite(t *testing.T) {
+	scanner := &fromRewriteConfig{Address: "scanner@example.com"}
+	disabled := &fromRewriteConfig{}
+	global := &fromRewriteConfig{
+		Address: "me@example.com",
+		Sources: map[string]*fromRewriteConfig{
+			"192.168.1.0/24":  {Address: "lan@example.com"},
+			"192.168.1.50/32": scanner,
+			"192.168.1.99":    disabled,
+		},
+	}
+	route := &routeConfig{Name: "alerts", RewriteFrom: &fromRewriteConfig{Address: "alerts@example.com"}}
+
+	assert.Nil(t, resolveFromRewrite(nil, nil, "10.0.0.1"))
+	assert.Equal(t, "me@example.com", resolveFromRewrite(global, nil, "10.0.0.1").Address)
+	assert.Equal(t, "lan@example.com", resolveFromRewrite(global, nil, "192.168.1.10").Address)
+	assert.Same(t, scanner, resolveFromRewrite(global, nil, "192.168.1.50"))
+	assert.Nil(t, resolveFromRewrite(global, nil, "192.168.1.99"))
+	assert.Equal(t, "alerts@example.com", resolveFromRewrite(global, route, "10.0.0.1").Address)
+	// a per-source override is more specific than a route
+	assert.Same(t, scanner, resolveFromRewrite(global, route, "192.168.1.50"))
+}
+
+func TestFromRewriteConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *fromRewriteConfig
+		wantErr bool
+	}{
+		{name: "valid", config: &fromRewriteConfig{Address: "me@example.com", Mode: rewriteModeHeader}},
+		{name: "empty address disables", config: &fromRewriteConfig{}},
+		{name: "invalid address", config: &fromRewriteConfig{Address: "me@"}, wantErr: true},
+		{name: "invalid mode", config: &fromRewriteConfig{Address: "me@example.com", Mode: "body"}, wantErr: true},
+		{
+			name: "invalid source",
+			config: &fromRewriteConfig{
+				Address: "me@example.com",
+				Sources: map[string]*fromRewriteConfig{"nas": {Address: "nas@example.com"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "nested sources",
+			config: &fromRewriteConfig{
+				Sources: map[string]*fromRewriteConfig{"10.0.0.1": {
+					Sources: map[string]*fromRewriteConfig{"10.0.0.2": {}},
+				}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
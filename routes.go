@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"path"
+	"strings"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// routeConfig selects per-message settings based on where a message came from
+// and where it is going. Empty match lists match everything.
+type routeConfig struct {
+	Name        string             `json:"name"`
+	Sources     []string           `json:"sources"`
+	Senders     []string           `json:"senders"`
+	Recipients  []string           `json:"recipients"`
+	RewriteFrom *fromRewriteConfig `json:"rewrite_from"`
+	Delivery    *deliveryConfig    `json:"delivery"`
+	// Destinations replace the global upstream for the route's messages.
+	Destinations []*destinationConfig `json:"destinations"`
+}
+
+// matchRoute returns the first route matching the envelope, or nil.
+func matchRoute(routes []*routeConfig, e *mail.Envelope) *routeConfig {
+	for _, r := range routes {
+		if r.matches(e) {
+			return r
+		}
+	}
+	return nil
+}
+
+// recipientRoute returns the first route matching the envelope for a single
+// recipient, or nil.
+func recipientRoute(routes []*routeConfig, e *mail.Envelope, rcpt mail.Address) *routeConfig {
+	for _, r := range routes {
+		if r.matchesOrigin(e) && (len(r.Recipients) == 0 || addressMatches(rcpt.String(), r.Recipients)) {
+			return r
+		}
+	}
+	return nil
+}
+
+// matches returns true if the envelope came from one of the route's sources,
+// was sent by one of its senders and is addressed to at least one of its recipients.
+func (r *routeConfig) matches(e *mail.Envelope) bool {
+	if !r.matchesOrigin(e) {
+		return false
+	}
+	if len(r.Recipients) == 0 {
+		return true
+	}
+	for i := range e.RcptTo {
+		if addressMatches(e.RcptTo[i].String(), r.Recipients) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesOrigin returns true if the envelope came from one of the route's
+// sources and was sent by one of its senders.
+func (r *routeConfig) matchesOrigin(e *mail.Envelope) bool {
+	if len(r.Sources) > 0 && !ipInList(e.RemoteIP, r.Sources) {
+		return false
+	}
+	return len(r.Senders) == 0 || addressMatches(e.MailFrom.String(), r.Senders)
+}
+
+func (r *routeConfig) validate() error {
+	for _, s := range r.Sources {
+		if _, err := parsePrefix(s); err != nil {
+			return fmt.Errorf("route %q: %w", r.Name, err)
+		}
+	}
+	for _, p := range append(append([]string{}, r.Senders...), r.Recipients...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("route %q: bad address pattern %q", r.Name, p)
+		}
+	}
+	if r.RewriteFrom != nil {
+		if err := r.RewriteFrom.validate(); err != nil {
+			return fmt.Errorf("route %q: %w", r.Name, err)
+		}
+	}
+	if r.Delivery != nil {
+		if err := r.Delivery.validate(); err != nil {
+			return fmt.Errorf("route %q: %w", r.Name, err)
+		}
+	}
+	if err := validateDestinations(r.Destinations); err != nil {
+		return fmt.Errorf("route %q: %w", r.Name, err)
+	}
+	return nil
+}
+
+// ipInList returns true if ip is contained in any of the IP addresses or CIDR
+// ranges in list.
+func ipInList(ip string, list []string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, s := range list {
+		if prefix, err := parsePrefix(s); err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefix parses a CIDR range or a single IP address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address %q", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// addressMatches returns true if addr matches any of the glob patterns, e.g.
+// "*@example.com". Matching is case-insensitive.
+func addressMatches(addr string, patterns []string) bool {
+	addr = strings.ToLower(addr)
+	for _, p := range patterns {
+		if ok, err := path.Match(strings.ToLower(p), addr); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
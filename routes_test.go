@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchRoute(t *testing.T) {
+	routes := []*routeConfig{
+		{Name: "scanner", Sources: []string{"192.168.1.50"}},
+		{Name: "nas", Senders: []string{"root@nas"}},
+		{Name: "corp", Recipients: []string{"*@corp.example.com"}},
+		{Name: "default"},
+	}
+
+	tests := []struct {
+		name     string
+		envelope *mail.Envelope
+		expected string
+	}{
+		{
+			name: "source match",
+			envelope: &mail.Envelope{
+				RemoteIP: "192.168.1.50",
+				MailFrom: mail.Address{User: "root", Host: "nas"},
+			},
+			expected: "scanner",
+		},
+		{
+			name: "sender match",
+			envelope: &mail.Envelope{
+				RemoteIP: "192.168.1.60",
+				MailFrom: mail.Address{User: "ROOT", Host: "nas"},
+			},
+			expected: "nas",
+		},
+		{
+			name: "recipient match on any recipient",
+			envelope: &mail.Envelope{
+				RemoteIP: "10.0.0.1",
+				RcptTo: []mail.Address{
+					{User: "a", Host: "example.com"},
+					{User: "b", Host: "corp.example.com"},
+				},
+			},
+			expected: "corp",
+		},
+		{
+			name:     "fallback",
+			envelope: &mail.Envelope{RemoteIP: "10.0.0.1"},
+			expected: "default",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := matchRoute(routes, tt.envelope)
+			if assert.NotNil(t, r) {
+				assert.Equal(t, tt.expected, r.Name)
+			}
+		})
+	}
+
+	assert.Nil(t, matchRoute(nil, &mail.Envelope{}))
+}
+
+func TestRecipientRoute(t *testing.T) {
+	routes := []*routeConfig{
+		{Name: "scanner", Sources: []string{"192.168.1.50"}, Recipients: []string{"*@lan"}},
+		{Name: "corp", Recipients: []string{"*@corp.example.com"}},
+	}
+	e := &mail.Envelope{RemoteIP: "192.168.1.50"}
+
+	assert.Equal(t, "scanner", recipientRoute(routes, e, mail.Address{User: "ops", Host: "lan"}).Name)
+	assert.Equal(t, "corp", recipientRoute(routes, e, mail.Address{User: "a", Host: "corp.example.com"}).Name)
+	assert.Nil(t, recipientRoute(routes, e, mail.Address{User: "a", Host: "example.org"}))
+	e.RemoteIP = "192.168.1.60"
+	assert.Nil(t, recipientRoute(routes, e, mail.Address{User: "ops", Host: "lan"}))
+}
+
+func TestIPInList(t *testing.T) {
+	list := []string{"192.168.1.0/24", "10.1.2.3", "2001:db8::/32"}
+
+	assert.True(t, ipInList("192.168.1.77", list))
+	assert.True(t, ipInList("10.1.2.3", list))
+	assert.True(t, ipInList("::ffff:10.1.2.3", list))
+	assert.True(t, ipInList("2001:db8::1", list))
+	assert.False(t, ipInList("10.1.2.4", list))
+	assert.False(t, ipInList("not-an-ip", list))
+}
+
+func TestRouteValidate(t *testing.T) {
+	assert.NoError(t, (&routeConfig{Name: "ok", Sources: []string{"10.0.0.0/8"}}).validate())
+	assert.Error(t, (&routeConfig{Name: "bad cidr", Sources: []string{"10.0.0.0/99"}}).validate())
+	assert.Error(t, (&routeConfig{Name: "bad pattern", Senders: []string{"[a"}}).validate())
+	assert.Error(t, (&routeConfig{
+		Name:        "bad rewrite",
+		RewriteFrom: &fromRewriteConfig{Address: "not an address"},
+	}).validate())
+	assert.Error(t, (&routeConfig{Name: "bad delivery", Delivery: &deliveryConfig{Type: "maildir"}}).validate())
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	netmail "net/mail"
+	"strings"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	defaultSendGridBaseURL = "https://api.sendgrid.com"
+
+	// sendGridNoSubject replaces missing subjects, which SendGrid requires.
+	sendGridNoSubject = "(no subject)"
+)
+
+// sendGridHeaders are the header fields passed on besides X- fields, which
+// SendGrid sets itself otherwise.
+var sendGridHeaders = map[string]bool{"in-reply-to": true, "references": true}
+
+// sendGridTransport relays messages with the SendGrid v3 mail send API.
+// The API does not take MIME, so the message is converted: the From and
+// Reply-To fields, subject, text and HTML bodies, attachments and X- header
+// fields are passed on. Each envelope recipient gets a personalization of
+// its own, so recipients do not see each other.
+type sendGridTransport struct {
+	api *apiClient
+	url string
+}
+
+func newSendGridTransport(c *transportConfig, client *http.Client) *sendGridTransport {
+	return &sendGridTransport{
+		api: &apiClient{name: "SendGrid", client: client, auth: bearerAuth(c.APIKey)},
+		url: c.baseURL() + "/v3/mail/send",
+	}
+}
+
+type sendGridMail struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	ReplyTo          *sendGridAddress          `json:"reply_to,omitempty"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+}
+
+type sendGridPersonalization struct {
+	To []sendGridAddress `json:"to"`
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     []byte `json:"content"`
+	Type        string `json:"type"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition"`
+}
+
+// sendGridAddressOf returns the address of a From or Reply-To field, or nil.
+func sendGridAddressOf(value string) *sendGridAddress {
+	a, err := netmail.ParseAddress(value)
+	if err != nil {
+		return nil
+	}
+	return &sendGridAddress{Email: a.Address, Name: a.Name}
+}
+
+// newSendGridMail converts the message to a mail send request.
+func newSendGridMail(e *mail.Envelope) *sendGridMail {
+	c := parseContent(e.Data.Bytes())
+	m := &sendGridMail{Subject: c.Subject, Headers: map[string]string{}}
+	if m.Subject == "" {
+		m.Subject = sendGridNoSubject
+	}
+	m.From = sendGridAddress{Email: e.MailFrom.String()}
+	m.addHeaders(c.Headers)
+	for _, rcpt := range getTo(e) {
+		m.Personalizations = append(m.Personalizations, sendGridPersonalization{
+			To: []sendGridAddress{{Email: rcpt}},
+		})
+	}
+	// SendGrid requires non-empty content, with the text before the HTML
+	switch {
+	case c.Text != "":
+		m.Content = append(m.Content, sendGridContent{Type: mediaTypeText, Value: c.Text})
+	case c.HTML == "":
+		m.Content = append(m.Content, sendGridContent{Type: mediaTypeText, Value: " "})
+	}
+	if c.HTML != "" {
+		m.Content = append(m.Content, sendGridContent{Type: mediaTypeHTML, Value: c.HTML})
+	}
+	for _, a := range c.Attachments {
+		m.Attachments = append(m.Attachments, sendGridAttachment{
+			Content:     a.Content,
+			Type:        a.ContentType,
+			Filename:    a.Filename,
+			Disposition: "attachment",
+		})
+	}
+	return m
+}
+
+// addHeaders takes the sender, the reply address and the header fields to
+// pass on from the message's header.
+func (m *sendGridMail) addHeaders(headers []contentHeader) {
+	for _, h := range headers {
+		name := strings.ToLower(h.Name)
+		switch {
+		case name == "from":
+			if a := sendGridAddressOf(h.Value); a != nil {
+				m.From = *a
+			}
+		case name == "reply-to":
+			m.ReplyTo = sendGridAddressOf(h.Value)
+		case sendGridHeaders[name] || (strings.HasPrefix(name, "x-") && !strings.HasPrefix(name, "x-sg-")):
+			m.Headers[h.Name] = h.Value
+		}
+	}
+}
+
+func (t *sendGridTransport) name() string {
+	return t.api.name
+}
+
+func (t *sendGridTransport) send(e *mail.Envelope) error {
+	body, err := json.Marshal(newSendGridMail(e))
+	if err != nil {
+		return err
+	}
+	return t.api.do(e, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSendGridMail(t *testing.T) {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.MailFrom = mail.Address{User: "bounce", Host: "example.com"}
+	e.RcptTo = []mail.Address{{User: "ops", Host: "example.com"}, {User: "audit", Host: "example.com"}}
+	e.Data.WriteString("From: Backup <backup@example.com>\r\nReply-To: ops@example.com\r\n" +
+		"Subject: nightly\r\nX-Job: 42\r\nX-SG-Id: 1\r\nReferences: <a@example.com>\r\n" +
+		"MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>done</p>\r\n" +
+		"--b\r\nContent-Type: text/csv\r\nContent-Disposition: attachment; filename=report.csv\r\n\r\na,b\r\n" +
+		"--b--\r\n")
+
+	m := newSendGridMail(e)
+	assert.Equal(t, sendGridAddress{Email: "backup@example.com", Name: "Backup"}, m.From)
+	assert.Equal(t, &sendGridAddress{Email: "ops@example.com"}, m.ReplyTo)
+	assert.Equal(t, "nightly", m.Subject)
+	assert.Equal(t, []sendGridPersonalization{
+		{To: []sendGridAddress{{Email: "ops@example.com"}}},
+		{To: []sendGridAddress{{Email: "audit@example.com"}}},
+	}, m.Personalizations)
+	assert.Equal(t, []sendGridContent{{Type: "text/html", Value: "<p>done</p>\n"}}, m.Content)
+	require.Len(t, m.Attachments, 1)
+	assert.Equal(t, "report.csv", m.Attachments[0].Filename)
+	assert.Equal(t, "a,b\r\n", string(m.Attachments[0].Content))
+	assert.Equal(t, map[string]string{"X-Job": "42", "References": "<a@example.com>"}, m.Headers)
+
+	e.Data.Reset()
+	e.Data.WriteString("To: ops@example.com\r\n\r\nbody\r\n")
+	m = newSendGridMail(e)
+	assert.Equal(t, sendGridAddress{Email: "bounce@example.com"}, m.From)
+	assert.Equal(t, sendGridNoSubject, m.Subject)
+	assert.Equal(t, []sendGridContent{{Type: "text/plain", Value: "body\n"}}, m.Content)
+
+	e.Data.Reset()
+	e.Data.WriteString("To: ops@example.com\r\n\r\n")
+	assert.Equal(t, []sendGridContent{{Type: "text/plain", Value: " "}}, newSendGridMail(e).Content,
+		"SendGrid refuses empty content")
+}
+
+func TestSendGridTransport(t *testing.T) {
+	setupTestLogger(t)
+	api := startFakeAPI(t)
+	tr, err := newTransport(&transportConfig{Type: transportSendGrid, BaseURL: api.URL, APIKey: "key"})
+	require.NoError(t, err)
+	assert.Equal(t, "SendGrid", tr.name())
+
+	require.NoError(t, tr.send(transportTestEnvelope()))
+	require.Len(t, api.requests, 1)
+	req := api.requests[0]
+	assert.Equal(t, "/v3/mail/send", req.URL.Path)
+	assert.Equal(t, "Bearer key", req.Header.Get("Authorization"))
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	var body sendGridMail
+	require.NoError(t, json.Unmarshal(api.bodies[0], &body))
+	assert.Equal(t, "nightly", body.Subject)
+	assert.Len(t, body.Personalizations, 2)
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// sendmailCommand is the sub-command (or program name, when mailrelay is
+// installed as a symlink) that selects sendmail-compatible submission.
+const sendmailCommand = "sendmail"
+
+// sendmailOptions holds the parsed sendmail command line.
+type sendmailOptions struct {
+	configFile        string
+	sender            string
+	fullName          string
+	extractRecipients bool
+	ignoreDots        bool
+	direct            bool
+	verbose           bool
+	recipients        []string
+}
+
+// sendmailArgs returns the sendmail arguments if mailrelay was invoked as
+// sendmail, either through a symlink or as "mailrelay sendmail ...".
+func sendmailArgs(args []string) ([]string, bool) {
+	if len(args) == 0 {
+		return nil, false
+	}
+	name := strings.TrimSuffix(filepath.Base(args[0]), ".exe")
+	if name == sendmailCommand {
+		return args[1:], true
+	}
+	if len(args) > 1 && args[1] == sendmailCommand {
+		return args[2:], true
+	}
+	return nil, false
+}
+
+// parseSendmailArgs parses the subset of sendmail options used by scripts and
+// cron: -t, -i, -oi, -f/-r sender, -F full name and -C config file. Other -o
+// options and the -B, -N, -R and -V delivery options are accepted and ignored.
+// --direct relays the message without going through the running mailrelay
+// server.
+func parseSendmailArgs(args []string) (*sendmailOptions, error) {
+	opts := &sendmailOptions{configFile: DefaultConfigFile}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			opts.recipients = append(opts.recipients, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			opts.recipients = append(opts.recipients, arg)
+			continue
+		}
+		next, err := opts.parseOption(args, i)
+		if err != nil {
+			return nil, err
+		}
+		i = next
+	}
+	return opts, nil
+}
+
+// parseOption parses the option at args[i] and returns the index of the last
+// argument consumed.
+func (opts *sendmailOptions) parseOption(args []string, i int) (int, error) {
+	arg := args[i]
+	switch {
+	case arg == "--direct":
+		opts.direct = true
+	case arg == "-bm":
+		// deliver mail, the default
+	case arg == "-oi":
+		opts.ignoreDots = true
+	case strings.HasPrefix(arg, "-o"):
+		// other sendmail options have no meaning here
+	case strings.ContainsAny(arg[1:2], "frFCBNRV"):
+		value, next, err := optionValue(args, i)
+		if err != nil {
+			return i, err
+		}
+		switch arg[1] {
+		case 'f', 'r':
+			opts.sender = value
+		case 'F':
+			opts.fullName = value
+		case 'C':
+			opts.configFile = value
+		default:
+			// body type, DSN and envelope ID options are not relayed
+		}
+		return next, nil
+	default:
+		return i, opts.setFlags(arg[1:])
+	}
+	return i, nil
+}
+
+// optionValue returns the value of the option at args[i], which is either
+// attached ("-fuser@example.com") or the next argument, and the index of the
+// last argument consumed.
+func optionValue(args []string, i int) (string, int, error) {
+	if len(args[i]) > 2 {
+		return args[i][2:], i, nil
+	}
+	if i+1 >= len(args) {
+		return "", i, fmt.Errorf("option %s requires a value", args[i])
+	}
+	return args[i+1], i + 1, nil
+}
+
+// setFlags sets single letter flags, which may be combined as in "-ti".
+func (opts *sendmailOptions) setFlags(flags string) error {
+	for _, c := range flags {
+		switch c {
+		case 't':
+			opts.extractRecipients = true
+		case 'i':
+			opts.ignoreDots = true
+		case 'v':
+			opts.verbose = true
+		default:
+			return fmt.Errorf("unsupported option -%s", flags)
+		}
+	}
+	return nil
+}
+
+// readSendmailMessage reads a message from r. Unless ignoreDots is set, a line
+// containing a single dot ends the message, as with traditional sendmail.
+func readSendmailMessage(r io.Reader, ignoreDots bool) ([]byte, error) {
+	if ignoreDots {
+		return io.ReadAll(r)
+	}
+	var buf bytes.Buffer
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if string(bytes.TrimRight(line, "\r\n")) == "." && len(line) > 1 {
+			return buf.Bytes(), nil
+		}
+		buf.Write(line)
+		if errors.Is(err, io.EOF) {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sendmailSubmission is a message ready to be submitted.
+type sendmailSubmission struct {
+	sender     string
+	recipients []string
+	data       []byte
+}
+
+// prepareSendmailMessage determines the envelope of a message read from the
+// command line and strips its Bcc header.
+func prepareSendmailMessage(data []byte, opts *sendmailOptions) (*sendmailSubmission, error) {
+	msg := parseMessage(data)
+	sub := &sendmailSubmission{sender: opts.sender}
+	if sub.sender == "" {
+		sub.sender = defaultSender()
+	}
+	if sub.sender != "<>" {
+		sub.sender = qualifyAddress(sub.sender)
+	}
+
+	for _, r := range opts.recipients {
+		addrs, err := parseRecipientList(r)
+		if err != nil {
+			return nil, err
+		}
+		sub.recipients = append(sub.recipients, addrs...)
+	}
+	if opts.extractRecipients {
+		for _, name := range []string{"To", "Cc", "Bcc"} {
+			for _, v := range msg.values(name) {
+				addrs, err := parseRecipientList(v)
+				if err != nil {
+					return nil, fmt.Errorf("%s header: %w", name, err)
+				}
+				sub.recipients = append(sub.recipients, addrs...)
+			}
+		}
+	}
+	if len(sub.recipients) == 0 {
+		return nil, errors.New("no recipients given")
+	}
+
+	// Bcc recipients must not be visible to the other recipients
+	msg.del("Bcc")
+	if !msg.has("From") {
+		from := netmail.Address{Name: opts.fullName, Address: sub.sender}
+		if sub.sender == "<>" {
+			from.Address = "MAILER-DAEMON@" + localHostname()
+		}
+		msg.prepend("From", from.String())
+	}
+	sub.data = msg.bytes()
+	return sub, nil
+}
+
+// parseRecipientList parses a comma separated address list. Bare local names
+// such as "root", which cron commonly uses, are qualified with the local
+// hostname.
+func parseRecipientList(value string) ([]string, error) {
+	if list, err := netmail.ParseAddressList(value); err == nil {
+		ret := make([]string, 0, len(list))
+		for _, a := range list {
+			ret = append(ret, a.Address)
+		}
+		return ret, nil
+	}
+
+	var ret []string
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		a, err := parseAddress(qualifyAddress(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q", part)
+		}
+		ret = append(ret, a.String())
+	}
+	return ret, nil
+}
+
+// qualifyAddress appends the local hostname to a bare local name.
+func qualifyAddress(addr string) string {
+	if strings.ContainsAny(addr, "@<> ") {
+		return addr
+	}
+	return addr + "@" + localHostname()
+}
+
+// defaultSender returns the address of the user running the command.
+func defaultSender() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		// Windows user names include the domain
+		return filepath.Base(u.Username)
+	}
+	return "root"
+}
+
+// runSendmail reads a message from stdin and submits it using the
+// configuration file.
+func runSendmail(args []string, stdin io.Reader) error {
+	opts, err := parseSendmailArgs(args)
+	if err != nil {
+		return err
+	}
+	appConfig, err := loadConfig(opts.configFile)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	logLevel := "warn"
+	if opts.verbose {
+		logLevel = "debug"
+	}
+	// stdout belongs to the calling script, so only log to stderr
+	if Logger, err = log.GetLogger(log.OutputStderr.String(), logLevel); err != nil {
+		return fmt.Errorf("creating logger: %w", err)
+	}
+
+	data, err := readSendmailMessage(stdin, opts.ignoreDots)
+	if err != nil {
+		return fmt.Errorf("reading message: %w", err)
+	}
+	sub, err := prepareSendmailMessage(data, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.direct {
+		if err := setupIPFilter(appConfig); err != nil {
+			return err
+		}
+		return submitDirect(appConfig, sub)
+	}
+	network, addr := relayAddress(appConfig)
+	return submitToRelay(network, addr, sub)
+}
+
+// relayAddress returns the network and address of the locally running relay,
+// preferring its Unix socket.
+func relayAddress(appConfig *mailRelayConfig) (string, string) {
+	if appConfig.UnixSocket != nil {
+		return "unix", appConfig.UnixSocket.Path
+	}
+	host := appConfig.LocalListenIP
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "tcp", net.JoinHostPort(host, strconv.Itoa(appConfig.LocalListenPort))
+}
+
+// submitToRelay submits the message to the running mailrelay server.
+func submitToRelay(network, addr string, sub *sendmailSubmission) error {
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		return fmt.Errorf("connecting to mailrelay at %s: %w", addr, err)
+	}
+	conn, err := smtp.NewClient(c, "localhost")
+	if err != nil {
+		c.Close()
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Hello(localHostname()); err != nil {
+		return err
+	}
+	sender := sub.sender
+	if sender == "<>" {
+		sender = ""
+	}
+	if err := conn.Mail(sender); err != nil {
+		return err
+	}
+	for _, rcpt := range sub.recipients {
+		if err := conn.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("recipient %s: %w", rcpt, err)
+		}
+	}
+	wc, err := conn.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(sub.data); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return conn.Quit()
+}
+
+// submitDirect passes the message through the processor chain, relaying it
+// to the upstream server without a running mailrelay server.
+func submitDirect(appConfig *mailRelayConfig, sub *sendmailSubmission) error {
+	e := mail.NewEnvelope("127.0.0.1", 0)
+	e.Helo = localHostname()
+	e.ESMTP = true
+	if sub.sender != "<>" {
+		from, err := parseAddress(sub.sender)
+		if err != nil {
+			return fmt.Errorf("invalid sender %q", sub.sender)
+		}
+		e.MailFrom = from
+	}
+	for _, r := range sub.recipients {
+		rcpt, err := parseAddress(r)
+		if err != nil {
+			return fmt.Errorf("invalid recipient %q", r)
+		}
+		e.RcptTo = append(e.RcptTo, rcpt)
+	}
+	e.Data.Write(sub.data)
+
+	for _, p := range processors {
+		backends.Svc.AddProcessor(p.name, p.constructor)
+	}
+	bcfg := newBackendConfig(appConfig)
+	// set by the daemon when running as a server
+	bcfg["primary_mail_host"] = localHostname()
+	b, err := backends.New(bcfg, Logger)
+	if err != nil {
+		return err
+	}
+	if err := b.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := b.Shutdown(); err != nil {
+			Logger.WithError(err).Error("shutting down backend")
+		}
+	}()
+
+	result := b.Process(e)
+	if code := result.Code(); code < 200 || code >= 300 {
+		return errors.New(strings.TrimSpace(result.String()))
+	}
+	Logger.Debugf("relayed message: %s", strings.TrimSpace(result.String()))
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jpillora/ipfilter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendmailArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected []string
+		ok       bool
+	}{
+		{name: "symlink", args: []string{"/usr/sbin/sendmail", "-t"}, expected: []string{"-t"}, ok: true},
+		{name: "windows", args: []string{`sendmail.exe`, "-t"}, expected: []string{"-t"}, ok: true},
+		{name: "sub-command", args: []string{"mailrelay", "sendmail", "-oi", "a@b"}, expected: []string{"-oi", "a@b"}, ok: true},
+		{name: "server", args: []string{"mailrelay", "-config=x.json"}, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, ok := sendmailArgs(tt.args)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.expected, args)
+		})
+	}
+}
+
+func TestParseSendmailArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected *sendmailOptions
+		wantErr  bool
+	}{
+		{
+			name: "cron",
+			args: []string{"-FCronDaemon", "-i", "-B8BITMIME", "-oem", "root"},
+			expected: &sendmailOptions{
+				configFile: DefaultConfigFile,
+				fullName:   "CronDaemon",
+				ignoreDots: true,
+				recipients: []string{"root"},
+			},
+		},
+		{
+			name: "typical script",
+			args: []string{"-t", "-oi", "-f", "backup@example.com"},
+			expected: &sendmailOptions{
+				configFile:        DefaultConfigFile,
+				sender:            "backup@example.com",
+				extractRecipients: true,
+				ignoreDots:        true,
+			},
+		},
+		{
+			name: "attached values and combined flags",
+			args: []string{"-ti", "-rnas@example.com", "-C/tmp/relay.json", "-F", "NAS", "--direct", "a@b.com"},
+			expected: &sendmailOptions{
+				configFile:        "/tmp/relay.json",
+				sender:            "nas@example.com",
+				fullName:          "NAS",
+				extractRecipients: true,
+				ignoreDots:        true,
+				direct:            true,
+				recipients:        []string{"a@b.com"},
+			},
+		},
+		{
+			name: "end of options",
+			args: []string{"-bm", "--", "-odd@example.com"},
+			expected: &sendmailOptions{
+				configFile: DefaultConfigFile,
+				recipients: []string{"-odd@example.com"},
+			},
+		},
+		{name: "missing value", args: []string{"-f"}, wantErr: true},
+		{name: "unknown flag", args: []string{"-bs"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseSendmailArgs(tt.args)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, opts)
+		})
+	}
+}
+
+func TestReadSendmailMessage(t *testing.T) {
+	input := "Subject: hi\n\nline one\n.\nafter dot\n"
+
+	data, err := readSendmailMessage(strings.NewReader(input), false)
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: hi\n\nline one\n", string(data))
+
+	data, err = readSendmailMessage(strings.NewReader(input), true)
+	require.NoError(t, err)
+	assert.Equal(t, input, string(data))
+
+	data, err = readSendmailMessage(strings.NewReader("Subject: hi\r\n\r\nno newline"), false)
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: hi\r\n\r\nno newline", string(data))
+}
+
+func TestPrepareSendmailMessage(t *testing.T) {
+	host := localHostname()
+	input := "From: Backup <backup@example.com>\n" +
+		"To: root, Ops <ops@example.com>\n" +
+		"Cc: cc@example.com\n" +
+		"Bcc: secret@example.com\n" +
+		"Subject: nightly\n\nbody\n"
+
+	sub, err := prepareSendmailMessage([]byte(input), &sendmailOptions{
+		sender:            "backup@example.com",
+		extractRecipients: true,
+		recipients:        []string{"extra@example.com"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "backup@example.com", sub.sender)
+	assert.Equal(t, []string{
+		"extra@example.com", "root@" + host, "ops@example.com", "cc@example.com", "secret@example.com",
+	}, sub.recipients)
+	assert.NotContains(t, string(sub.data), "Bcc")
+	assert.NotContains(t, string(sub.data), "secret@example.com")
+	assert.Contains(t, string(sub.data), "To: root, Ops <ops@example.com>\n")
+
+	// recipients are taken from the command line only without -t
+	sub, err = prepareSendmailMessage([]byte(input), &sendmailOptions{sender: "me", recipients: []string{"a@b.com"}})
+	require.NoError(t, err)
+	assert.Equal(t, "me@"+host, sub.sender)
+	assert.Equal(t, []string{"a@b.com"}, sub.recipients)
+
+	_, err = prepareSendmailMessage([]byte(input), &sendmailOptions{sender: "me@example.com"})
+	assert.Error(t, err)
+}
+
+func TestPrepareSendmailMessage_AddsFrom(t *testing.T) {
+	sub, err := prepareSendmailMessage([]byte("Subject: x\n\nbody\n"), &sendmailOptions{
+		sender:     "cron@example.com",
+		fullName:   "Cron Daemon",
+		recipients: []string{"a@b.com"},
+	})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(sub.data), "From: \"Cron Daemon\" <cron@example.com>\n"))
+}
+
+func TestSubmitToRelay(t *testing.T) {
+	server := NewMockSMTPServer(t)
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	sub := &sendmailSubmission{
+		sender:     "backup@example.com",
+		recipients: []string{"a@example.com", "b@example.com"},
+		data:       []byte("Subject: nightly\n\n.dot line\nbody\n"),
+	}
+	network, addr := relayAddress(&mailRelayConfig{
+		LocalListenIP:   server.Address(),
+		LocalListenPort: server.Port(),
+	})
+	require.NoError(t, submitToRelay(network, addr, sub))
+
+	conn := server.GetLastConnection()
+	require.NotNil(t, conn)
+	assert.Equal(t, "backup@example.com", conn.From)
+	assert.Equal(t, []string{"a@example.com", "b@example.com"}, conn.To)
+	assert.Contains(t, conn.Data, "Subject: nightly")
+}
+
+func TestSubmitDirect(t *testing.T) {
+	setupTestLogger(t)
+
+	server := NewMockSMTPServer(t)
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	AllowedSendersFilter = ipfilter.New(ipfilter.Options{})
+
+	appConfig := &mailRelayConfig{}
+	configDefaults(appConfig)
+	appConfig.SMTPServer = server.Address()
+	appConfig.SMTPPort = server.Port()
+	appConfig.SMTPStartTLS = true
+	appConfig.SkipCertVerify = true
+
+	sub := &sendmailSubmission{
+		sender:     "backup@example.com",
+		recipients: []string{"ops@example.com"},
+		data:       []byte("From: backup@example.com\nSubject: nightly\n\nbody\n"),
+	}
+	require.NoError(t, submitDirect(appConfig, sub))
+
+	conn := server.GetLastConnection()
+	require.NotNil(t, conn)
+	assert.Equal(t, "backup@example.com", conn.From)
+	assert.Equal(t, []string{"ops@example.com"}, conn.To)
+	assert.Contains(t, conn.Data, "Received: from ")
+	assert.Contains(t, conn.Data, "Subject: nightly")
+}
+
+func TestRelayAddress(t *testing.T) {
+	tests := []struct {
+		config  *mailRelayConfig
+		network string
+		addr    string
+	}{
+		{&mailRelayConfig{LocalListenIP: "0.0.0.0", LocalListenPort: 2525}, "tcp", "127.0.0.1:2525"},
+		{&mailRelayConfig{LocalListenIP: "::1", LocalListenPort: 25}, "tcp", "[::1]:25"},
+		{&mailRelayConfig{UnixSocket: &unixSocketConfig{Path: "/run/mailrelay.sock"}}, "unix", "/run/mailrelay.sock"},
+	}
+	for _, tt := range tests {
+		network, addr := relayAddress(tt.config)
+		assert.Equal(t, tt.network, network)
+		assert.Equal(t, tt.addr, addr)
+	}
+}
@@ -2,6 +2,11 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	guerrilla "github.com/phires/go-guerrilla"
 	"github.com/phires/go-guerrilla/backends"
@@ -13,9 +18,71 @@ const (
 	saveWorkersSize = 3
 )
 
+// saveProcess is the chain of processors each message passes through, in
+// order. Processors that are not configured pass messages through unchanged.
+var saveProcess = []string{
+	"Peer",
+	"RelayID",
+	"HeadersParser",
+	"Header",
+	"Hasher",
+	"Debugger",
+	"LoopDetect",
+	"RcptRewrite",
+	"RewriteFrom",
+	"HeaderRules",
+	"Transcode",
+	"Normalize",
+	"Received",
+	"DKIM",
+	"ARC",
+	"Archive",
+	"Deliver",
+	"MailRelay",
+}
+
+// processors are the mailrelay processors referenced by saveProcess.
+var processors = []struct {
+	name        string
+	constructor backends.ProcessorConstructor
+}{
+	{"Peer", peerProcessor},
+	{"RelayID", relayIDProcessor},
+	{"LoopDetect", loopDetectProcessor},
+	{"RcptRewrite", rcptRewriteProcessor},
+	{"RewriteFrom", fromRewriteProcessor},
+	{"HeaderRules", headerRulesProcessor},
+	{"Transcode", transcodeProcessor},
+	{"Normalize", normalizeProcessor},
+	{"Received", receivedProcessor},
+	{"DKIM", dkimProcessor},
+	{"ARC", arcProcessor},
+	{"Archive", archiveProcessor},
+	{"Deliver", deliverProcessor},
+	{"MailRelay", mailRelayProcessor},
+}
+
+// mailRelayServer is a running mailrelay server.
+type mailRelayServer struct {
+	daemon   *guerrilla.Daemon
+	frontend *frontend
+}
+
 // Start starts the server.
-func Start(appConfig *mailRelayConfig, verbose bool) (err error) {
-	listen := fmt.Sprintf("%s:%d", appConfig.LocalListenIP, appConfig.LocalListenPort)
+func Start(appConfig *mailRelayConfig, verbose bool) (*mailRelayServer, error) {
+	// clients connect to a frontend, which proxies connections to the SMTP
+	// server on loopback
+	listeners, err := frontendListeners(appConfig)
+	if err != nil {
+		return nil, err
+	}
+	listen, err := loopbackAddr()
+	if err != nil {
+		closeListeners(listeners)
+		return nil, err
+	}
+	timeout := time.Duration(appConfig.TimeoutSecs) * time.Second
+	fe := newFrontend(listen, newPeerRegistry(), timeout, appConfig.MaxEmailSize)
 
 	logLevel := "info"
 	if verbose {
@@ -32,12 +99,140 @@ func Start(appConfig *mailRelayConfig, verbose bool) (err error) {
 		IsEnabled:       true,
 		MaxSize:         appConfig.MaxEmailSize,
 		Timeout:         appConfig.TimeoutSecs,
+		XClientOn:       true,
 	}
 	cfg.Servers = append(cfg.Servers, sc)
 
-	bcfg := backends.BackendConfig{
+	cfg.BackendConfig = newBackendConfig(appConfig)
+	cfg.BackendConfig["peers"] = fe.peers
+
+	d := &guerrilla.Daemon{Config: cfg}
+	for _, p := range processors {
+		d.AddProcessor(p.name, p.constructor)
+	}
+
+	if err := d.Start(); err != nil {
+		closeListeners(listeners)
+		return nil, err
+	}
+	// everything is bound, so privileges are no longer needed
+	if err := dropPrivileges(appConfig); err != nil {
+		d.Shutdown()
+		closeListeners(listeners)
+		return nil, fmt.Errorf("dropping privileges: %w", err)
+	}
+	for _, l := range listeners {
+		Logger.Infof("listening on %s %s", l.Addr().Network(), l.Addr())
+		fe.serve(l)
+	}
+	return &mailRelayServer{daemon: d, frontend: fe}, nil
+}
+
+// Shutdown stops accepting mail and waits up to grace for the sessions and
+// deliveries in progress to finish. It returns an error if any had to be
+// abandoned.
+func (s *mailRelayServer) Shutdown(grace time.Duration) error {
+	abandoned := s.frontend.shutdown(time.Now().Add(grace))
+	// the SMTP server waits for deliveries, which may take a while longer
+	// than the abandoned sessions
+	deliveries := deliveriesInFlight.Load()
+	if deliveries == 0 {
+		s.daemon.Shutdown()
+	}
+	if abandoned > 0 || deliveries > 0 {
+		return fmt.Errorf("shutdown abandoned %d sessions and %d deliveries", abandoned, deliveries)
+	}
+	Logger.Info("shutdown complete")
+	return nil
+}
+
+// frontendListeners returns the listeners served by the frontend: the
+// sockets passed by systemd, or those in the configuration.
+func frontendListeners(appConfig *mailRelayConfig) ([]*frontendListener, error) {
+	listeners, err := systemdListeners(appConfig)
+	if err != nil || listeners != nil {
+		return listeners, err
+	}
+	return openListeners(appConfig)
+}
+
+// newFrontendListener returns a frontend listener configured for l.
+func newFrontendListener(appConfig *mailRelayConfig, l net.Listener, lmtp bool,
+	unixSocket *unixSocketConfig,
+) *frontendListener {
+	fl := &frontendListener{Listener: l, lmtp: lmtp, unixSocket: unixSocket}
+	if unixSocket == nil {
+		fl.proxy = appConfig.ProxyProtocol
+	}
+	if !lmtp {
+		fl.xclient = appConfig.XClient
+		fl.lenient = appConfig.Lenient
+	}
+	return fl
+}
+
+// openListeners opens the listeners served by the frontend.
+func openListeners(appConfig *mailRelayConfig) ([]*frontendListener, error) {
+	var listeners []*frontendListener
+	add := func(l net.Listener, err error, lmtp bool, unixSocket *unixSocketConfig) error {
+		if err != nil {
+			closeListeners(listeners)
+			return err
+		}
+		listeners = append(listeners, newFrontendListener(appConfig, l, lmtp, unixSocket))
+		return nil
+	}
+
+	if appConfig.LocalListenPort != 0 {
+		addr := net.JoinHostPort(appConfig.LocalListenIP, strconv.Itoa(appConfig.LocalListenPort))
+		l, err := net.Listen("tcp", addr)
+		if err := add(l, err, false, nil); err != nil {
+			return nil, err
+		}
+	}
+	if s := appConfig.UnixSocket; s != nil {
+		l, err := s.listen()
+		if err := add(l, err, false, s); err != nil {
+			return nil, err
+		}
+	}
+	if lmtp := appConfig.LMTP; lmtp != nil && lmtp.Listen != "" {
+		l, err := net.Listen("tcp", lmtp.Listen)
+		if err := add(l, err, true, nil); err != nil {
+			return nil, err
+		}
+	}
+	if lmtp := appConfig.LMTP; lmtp != nil && lmtp.UnixSocket != nil {
+		l, err := lmtp.UnixSocket.listen()
+		if err := add(l, err, true, lmtp.UnixSocket); err != nil {
+			return nil, err
+		}
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []*frontendListener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// loopbackAddr returns a free loopback address for the SMTP server behind the
+// frontend.
+func loopbackAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// newBackendConfig returns the configuration for the processor chain.
+func newBackendConfig(appConfig *mailRelayConfig) backends.BackendConfig {
+	return backends.BackendConfig{
 		"save_workers_size":     saveWorkersSize,
-		"save_process":          "HeadersParser|Header|Hasher|Debugger|MailRelay",
+		"save_process":          strings.Join(saveProcess, "|"),
 		"log_received_mails":    true,
 		"smtp_username":         appConfig.SMTPUsername,
 		"smtp_password":         appConfig.SMTPPassword,
@@ -47,13 +242,19 @@ func Start(appConfig *mailRelayConfig, verbose bool) (err error) {
 		"smtp_login_auth_type":  appConfig.SMTPLoginAuthType,
 		"smtp_skip_cert_verify": appConfig.SkipCertVerify,
 		"smtp_helo":             appConfig.SMTPHelo,
+		"smtp_xforward":         appConfig.SMTPXForward,
+		"max_hops":              appConfig.MaxHops,
+		"rewrite_from":          appConfig.RewriteFrom,
+		"recipient_map":         appConfig.RecipientMap,
+		"header_rules":          appConfig.HeaderRules,
+		"routes":                appConfig.Routes,
+		"dkim":                  appConfig.DKIM,
+		"arc":                   appConfig.ARC,
+		"normalize":             appConfig.Normalize,
+		"transcode":             appConfig.Transcode,
+		"archive":               appConfig.Archive,
+		"transport":             appConfig.Transport,
 	}
-	cfg.BackendConfig = bcfg
-
-	d := guerrilla.Daemon{Config: cfg}
-	d.AddProcessor("MailRelay", mailRelayProcessor)
-
-	return d.Start()
 }
 
 type relayConfig struct {
@@ -65,11 +266,28 @@ type relayConfig struct {
 	Password      string `json:"smtp_password"`
 	SkipVerify    bool   `json:"smtp_skip_cert_verify"`
 	HeloHost      string `json:"smtp_helo"`
+	XForward      bool   `json:"smtp_xforward"`
 }
 
-// mailRelayProcessor decorator relays emails to another SMTP server.
+// deliveriesInFlight counts the messages being relayed upstream or delivered
+// locally.
+var deliveriesInFlight atomic.Int64
+
+// mailRelayProcessor decorator relays emails to another SMTP server, or
+// through the configured HTTP API transport. Recipients of routes with
+// destinations are relayed to those instead.
 var mailRelayProcessor = func() backends.Decorator {
 	config := &relayConfig{}
+	var api transport
+	var routes []*routeConfig
+	var destinations map[*routeConfig][]*destination
+	status := newDestinationStatus()
+	upstream := &destination{name: "upstream", send: func(e *mail.Envelope) error {
+		if api != nil {
+			return sendAPI(e, api)
+		}
+		return relayError(sendMail(e, config))
+	}}
 	initFunc := backends.InitializeWith(func(backendConfig backends.BackendConfig) error {
 		configType := backends.BaseConfig(&relayConfig{})
 		bcfg, err := backends.Svc.ExtractConfig(backendConfig, configType)
@@ -81,7 +299,15 @@ var mailRelayProcessor = func() backends.Decorator {
 		if !ok {
 			return fmt.Errorf("failed to cast config to relayConfig")
 		}
-		return nil
+		api = nil
+		if c, ok := backendConfig["transport"].(*transportConfig); ok && c != nil {
+			if api, err = newTransport(c); err != nil {
+				return err
+			}
+		}
+		routes, _ = backendConfig["routes"].([]*routeConfig)
+		destinations, err = newRouteDestinations(routes)
+		return err
 	})
 	backends.Svc.AddInitializer(initFunc)
 
@@ -89,8 +315,15 @@ var mailRelayProcessor = func() backends.Decorator {
 		return backends.ProcessWith(
 			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
 				if task == backends.TaskSaveMail {
-
-					err := sendMail(e, config)
+					deliveriesInFlight.Add(1)
+					var err error
+					targets := planRelay(e, routes, destinations, upstream)
+					if len(targets) > 1 || (len(targets) == 1 && targets[0].dest != upstream) {
+						err = relayToDestinations(e, targets, status, time.Now())
+					} else {
+						err = upstream.send(e)
+					}
+					deliveriesInFlight.Add(-1)
 					if err != nil {
 						return backends.NewResult(err.Error()), err
 					}
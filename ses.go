@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	defaultSESBaseURL = "https://email.{region}.amazonaws.com"
+	sesService        = "ses"
+
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4DateLayout = "20060102T150405Z"
+)
+
+// validateSES validates the settings of the Amazon SES transport.
+func (c *transportConfig) validateSES() error {
+	if c.Region == "" {
+		return errors.New("ses transport: region is required")
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return errors.New("ses transport: access_key_id and secret_access_key are required")
+	}
+	return nil
+}
+
+// sesTransport relays messages with the Amazon SES v2 SendEmail action,
+// submitting the raw message to the envelope recipients.
+type sesTransport struct {
+	api *apiClient
+	url string
+}
+
+func newSESTransport(c *transportConfig, client *http.Client) *sesTransport {
+	return &sesTransport{
+		api: &apiClient{
+			name:   "Amazon SES",
+			client: client,
+			auth: &sigV4Signer{
+				region:       c.Region,
+				service:      sesService,
+				accessKeyID:  c.AccessKeyID,
+				secretKey:    c.SecretAccessKey,
+				sessionToken: c.SessionToken,
+				now:          time.Now,
+			},
+		},
+		url: c.baseURL() + "/v2/email/outbound-emails",
+	}
+}
+
+// sesSendEmail is the request of the SendEmail action.
+type sesSendEmail struct {
+	FromEmailAddress string `json:"FromEmailAddress,omitempty"`
+	Destination      struct {
+		ToAddresses []string `json:"ToAddresses"`
+	} `json:"Destination"`
+	Content struct {
+		Raw struct {
+			Data []byte `json:"Data"`
+		} `json:"Raw"`
+	} `json:"Content"`
+}
+
+func (t *sesTransport) name() string {
+	return t.api.name
+}
+
+func (t *sesTransport) send(e *mail.Envelope) error {
+	var r sesSendEmail
+	r.FromEmailAddress = e.MailFrom.String()
+	r.Destination.ToAddresses = getTo(e)
+	r.Content.Raw.Data = e.Data.Bytes()
+	body, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+	return t.api.do(e, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+}
+
+// sigV4Signer signs requests with AWS Signature Version 4.
+type sigV4Signer struct {
+	region       string
+	service      string
+	accessKeyID  string
+	secretKey    string
+	sessionToken string
+	now          func() time.Time
+}
+
+func (s *sigV4Signer) authorize(req *http.Request) error {
+	payload := []byte{}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		if payload, err = io.ReadAll(body); err != nil {
+			return err
+		}
+	}
+	now := s.now().UTC()
+	amzDate := now.Format(sigV4DateLayout)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(payload),
+	}, "\n")
+	scope := now.Format("20060102") + "/" + s.region + "/" + s.service + "/aws4_request"
+	stringToSign := sigV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{now.Format("20060102"), s.region, s.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", sigV4Algorithm+" Credential="+s.accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, stringToSign)))
+	return nil
+}
+
+func (s *sigV4Signer) invalidate() {}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
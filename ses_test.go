@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigV4Signer(t *testing.T) {
+	// The get-vanilla case of the AWS Signature Version 4 test suite
+	s := &sigV4Signer{
+		region:      "us-east-1",
+		service:     "service",
+		accessKeyID: "AKIDEXAMPLE",
+		secretKey:   "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		now:         func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) },
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	require.NoError(t, err)
+	require.NoError(t, s.authorize(req))
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, "+
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+
+	s.sessionToken = "session"
+	req, err = http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	require.NoError(t, err)
+	require.NoError(t, s.authorize(req))
+	assert.Equal(t, "session", req.Header.Get("X-Amz-Security-Token"))
+	assert.Contains(t, req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,")
+}
+
+func TestSESTransport(t *testing.T) {
+	setupTestLogger(t)
+	api := startFakeAPI(t, http.StatusOK, http.StatusTooManyRequests, http.StatusBadRequest)
+	tr, err := newTransport(&transportConfig{Type: transportSES, BaseURL: api.URL, Region: "eu-west-1",
+		AccessKeyID: "AKID", SecretAccessKey: "secret"})
+	require.NoError(t, err)
+	assert.Equal(t, "Amazon SES", tr.name())
+
+	require.NoError(t, tr.send(transportTestEnvelope()))
+	require.Len(t, api.requests, 1)
+	req := api.requests[0]
+	assert.Equal(t, "/v2/email/outbound-emails", req.URL.Path)
+	assert.True(t, strings.HasPrefix(req.Header.Get("Authorization"),
+		"AWS4-HMAC-SHA256 Credential=AKID/"), req.Header.Get("Authorization"))
+	assert.Contains(t, req.Header.Get("Authorization"), "/eu-west-1/ses/aws4_request")
+	var body sesSendEmail
+	require.NoError(t, json.Unmarshal(api.bodies[0], &body))
+	assert.Equal(t, "backup@example.com", body.FromEmailAddress)
+	assert.Equal(t, []string{"ops@example.com", "audit@example.com"}, body.Destination.ToAddresses)
+	assert.Equal(t, transportTestEnvelope().Data.String(), string(body.Content.Raw.Data))
+
+	err = tr.send(transportTestEnvelope())
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "451 "), err.Error())
+	err = tr.send(transportTestEnvelope())
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "554 "), err.Error())
+}
+
+func TestSESTransport_DefaultURL(t *testing.T) {
+	tr := newSESTransport(&transportConfig{Type: transportSES, Region: "eu-west-1"}, http.DefaultClient)
+	assert.Equal(t, "https://email.eu-west-1.amazonaws.com/v2/email/outbound-emails", tr.url)
+}
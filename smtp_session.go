@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// smtpSession relays an SMTP client session to the SMTP server.
+//
+// Trusted relays may identify their clients with XCLIENT and XFORWARD. The
+// session handles those commands rather than passing them on, since the SMTP
+// server already knows the relay by its peer token; the client they describe
+// replaces the relay in the peer registry instead. XCLIENT starts a new
+// session on behalf of the client, which is then subject to allowed_senders
+// like any other. XFORWARD only describes the client of the next
+// transaction, and the relay remains responsible for it.
+type smtpSession struct {
+	*proxySession
+	peers    *peerRegistry
+	token    string
+	greeting string
+	// relay is set for trusted relays, which may use XCLIENT and XFORWARD
+	relay bool
+	// lenient sessions repair broken commands
+	lenient bool
+
+	// session is the peer of the session, current the peer of the
+	// transaction, which differ after XFORWARD
+	session *peerInfo
+	current *peerInfo
+}
+
+func newSMTPSession(client, backend net.Conn, timeout time.Duration, peers *peerRegistry,
+	token, greeting string, relay bool,
+) *smtpSession {
+	peer, _ := peers.lookup(token)
+	return &smtpSession{
+		proxySession: newProxySession(client, backend, timeout),
+		peers:        peers,
+		token:        token,
+		greeting:     greeting,
+		relay:        relay,
+		session:      peer,
+		current:      peer,
+	}
+}
+
+// run handles client commands until the client quits or either side fails.
+func (s *smtpSession) run() {
+	s.proxySession.run(func(line string) (bool, error) {
+		return s.handle(s.normalize(line))
+	})
+}
+
+// handle handles a single client command. It returns true once the session
+// is over.
+func (s *smtpSession) handle(line string) (bool, error) {
+	switch verb := commandVerb(line); verb {
+	case "HELO", "EHLO":
+		s.endTransaction()
+		return false, s.hello(verb, line)
+	case "XCLIENT", "XFORWARD":
+		if !s.relay {
+			s.reply("550 5.7.0 Error: insufficient authorization\r\n")
+			return false, nil
+		}
+		if verb == "XFORWARD" {
+			s.xforward(line)
+			return false, nil
+		}
+		return false, s.xclient(line)
+	case "MAIL":
+		r, err := s.command(line)
+		if err == nil && isPositive(r) {
+			s.setTransaction(true)
+		}
+		s.reply(r)
+		return false, err
+	case "DATA":
+		return false, s.data(line)
+	case "RSET":
+		s.endTransaction()
+		return false, s.forward(line)
+	case "QUIT":
+		return true, s.forward(line)
+	default:
+		return false, s.forward(line)
+	}
+}
+
+// hello passes HELO or EHLO to the SMTP server. Trusted relays are told about
+// XCLIENT and XFORWARD in addition to the extensions the server advertises.
+func (s *smtpSession) hello(verb, line string) error {
+	r, err := s.command(line)
+	if err != nil {
+		return err
+	}
+	if s.relay && verb == "EHLO" && isPositive(r) {
+		r = addExtensions(r, xclientExtension, xforwardExtension)
+	}
+	s.reply(r)
+	return nil
+}
+
+// addExtensions appends extension lines to a positive EHLO reply.
+func addExtensions(reply string, extensions ...string) string {
+	var sb strings.Builder
+	for _, line := range strings.Split(strings.TrimSuffix(reply, "\r\n"), "\r\n") {
+		if len(line) > 3 {
+			line = line[:3] + "-" + line[4:]
+		}
+		sb.WriteString(line + "\r\n")
+	}
+	for i, ext := range extensions {
+		sep := "-"
+		if i == len(extensions)-1 {
+			sep = " "
+		}
+		sb.WriteString(reply[:3] + sep + ext + "\r\n")
+	}
+	return sb.String()
+}
+
+// data relays the message, which ends the transaction.
+func (s *smtpSession) data(line string) error {
+	r, err := s.command(line)
+	if err != nil {
+		return err
+	}
+	s.reply(r)
+	if !strings.HasPrefix(r, "3") {
+		return nil
+	}
+	for {
+		line, err := s.readDataLine()
+		if err != nil {
+			return err
+		}
+		if strings.TrimRight(line, "\r\n") != "." {
+			if err := s.send(line); err != nil {
+				return err
+			}
+			continue
+		}
+		r, err := s.command(line)
+		if err != nil {
+			return err
+		}
+		s.endTransaction()
+		s.reply(r)
+		return nil
+	}
+}
+
+// endTransaction marks the end of a mail transaction, which also ends the
+// client given by XFORWARD.
+func (s *smtpSession) endTransaction() {
+	s.setTransaction(false)
+	if s.current != s.session {
+		s.setPeer(s.session)
+	}
+}
+
+func (s *smtpSession) setPeer(p *peerInfo) {
+	s.current = p
+	s.peers.update(s.token, p)
+}
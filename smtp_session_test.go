@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startSMTPFrontend serves an SMTP listener in front of a fake SMTP server.
+func startSMTPFrontend(t *testing.T) (*frontend, string, *fakeSMTPServer) {
+	t.Helper()
+	setupTestLogger(t)
+	backendAddr, server := startFakeSMTPServer(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	fe := newFrontend(backendAddr, newPeerRegistry(), time.Minute, DefaultMaxEmailSize)
+	fe.serve(&frontendListener{Listener: l})
+	return fe, l.Addr().String(), server
+}
+
+func dialSMTP(t *testing.T, addr string) (*bufio.Reader, net.Conn) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	greeting, err := readReply(r)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(greeting, "220 "), greeting)
+	return r, conn
+}
+
+func TestSMTPSession_Relay(t *testing.T) {
+	_, addr, server := startSMTPFrontend(t)
+	r, conn := dialSMTP(t, addr)
+
+	assert.Equal(t, "250-test.local Hello\r\n250 PIPELINING\r\n", lmtpExchange(t, r, conn, "EHLO client"))
+	assert.True(t, isPositive(lmtpExchange(t, r, conn, "MAIL FROM:<app@example.com>")))
+	assert.True(t, isPositive(lmtpExchange(t, r, conn, "RCPT TO:<a@example.com>")))
+	assert.Contains(t, lmtpExchange(t, r, conn, "DATA"), "354")
+	fmt.Fprint(conn, "Subject: test\r\n\r\n..leading dot\r\n")
+	assert.Equal(t, "250 2.0.0 OK: queued as ABC\r\n", lmtpExchange(t, r, conn, "."))
+	assert.Equal(t, "221 2.0.0 Bye\r\n", lmtpExchange(t, r, conn, "QUIT"))
+
+	assert.Equal(t, "Subject: test\r\n\r\n..leading dot\r\n", server.deliveries()["RCPT TO:<a@example.com>"])
+}
+
+func TestFrontend_Shutdown(t *testing.T) {
+	fe, addr, server := startSMTPFrontend(t)
+
+	idleReader, idle := dialSMTP(t, addr)
+	lmtpExchange(t, idleReader, idle, "EHLO idle")
+
+	busyReader, busy := dialSMTP(t, addr)
+	lmtpExchange(t, busyReader, busy, "EHLO busy")
+	lmtpExchange(t, busyReader, busy, "MAIL FROM:<app@example.com>")
+	lmtpExchange(t, busyReader, busy, "RCPT TO:<a@example.com>")
+
+	abandoned := make(chan int)
+	go func() { abandoned <- fe.shutdown(time.Now().Add(time.Minute)) }()
+
+	// idle clients are told right away
+	reply, err := io.ReadAll(idleReader)
+	require.NoError(t, err)
+	assert.Equal(t, shutdownReply, string(reply))
+
+	// the transaction in progress is completed
+	assert.Contains(t, lmtpExchange(t, busyReader, busy, "DATA"), "354")
+	fmt.Fprint(busy, "Subject: test\r\n\r\nbody\r\n")
+	assert.Equal(t, "250 2.0.0 OK: queued as ABC\r\n", lmtpExchange(t, busyReader, busy, "."))
+	assert.Equal(t, shutdownReply, lmtpExchange(t, busyReader, busy, "MAIL FROM:<app@example.com>"))
+
+	assert.Equal(t, 0, <-abandoned)
+	assert.Contains(t, server.deliveries(), "RCPT TO:<a@example.com>")
+}
+
+func TestFrontend_ShutdownRejectsLateClients(t *testing.T) {
+	fe, addr, _ := startSMTPFrontend(t)
+	r, conn := dialSMTP(t, addr)
+	lmtpExchange(t, r, conn, "MAIL FROM:<app@example.com>")
+
+	abandoned := make(chan int)
+	go func() { abandoned <- fe.shutdown(time.Now().Add(200 * time.Millisecond)) }()
+
+	// wait for the shutdown to begin
+	require.Eventually(t, fe.draining.Load, time.Second, 10*time.Millisecond)
+	late, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer late.Close()
+	reply, err := io.ReadAll(late)
+	require.NoError(t, err)
+	assert.Equal(t, shutdownReply, string(reply))
+
+	// the client in a transaction did not finish in time
+	assert.Equal(t, 1, <-abandoned)
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err, "the listener is closed once the shutdown is over")
+}
+
+func TestSMTPSession_LineTooLong(t *testing.T) {
+	_, addr, server := startSMTPFrontend(t)
+	r, conn := dialSMTP(t, addr)
+	lmtpExchange(t, r, conn, "EHLO client")
+
+	// lines of message data may be longer than commands
+	long := strings.Repeat("a", 2*maxCommandLine)
+	assert.True(t, isPositive(lmtpExchange(t, r, conn, "MAIL FROM:<app@example.com>")))
+	assert.True(t, isPositive(lmtpExchange(t, r, conn, "RCPT TO:<a@example.com>")))
+	assert.Contains(t, lmtpExchange(t, r, conn, "DATA"), "354")
+	fmt.Fprint(conn, "Subject: test\r\n\r\n"+long+"\r\n")
+	assert.True(t, isPositive(lmtpExchange(t, r, conn, ".")))
+	assert.Contains(t, server.deliveries()["RCPT TO:<a@example.com>"], long)
+
+	// an overlong command ends the session
+	fmt.Fprint(conn, "NOOP "+long+"\r\n")
+	reply, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, lineTooLongReply, string(reply))
+}
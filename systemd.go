@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sdListenFDsStart is the first file descriptor passed by systemd.
+	sdListenFDsStart = 3
+
+	// sdLMTPName is the FileDescriptorName= of sockets that speak LMTP.
+	sdLMTPName = "lmtp"
+
+	// watchdogPings is the number of watchdog pings per watchdog interval.
+	watchdogPings = 2
+)
+
+// systemdListeners returns the listening sockets passed by systemd socket
+// activation, or nil if mailrelay was not socket activated. Sockets named
+// "lmtp" with FileDescriptorName= speak LMTP, all others SMTP. The
+// environment is cleared so the sockets are not passed on to children.
+func systemdListeners(appConfig *mailRelayConfig) ([]*frontendListener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds := os.Getenv("LISTEN_FDS")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(sdListenFDsStart+i), fmt.Sprintf("LISTEN_FD_%d", sdListenFDsStart+i))
+	}
+	return activatedListeners(appConfig, files, names)
+}
+
+// activatedListeners turns the files passed by systemd into listeners. The
+// files are closed, the listeners hold duplicates.
+func activatedListeners(appConfig *mailRelayConfig, files []*os.File, names []string) ([]*frontendListener, error) {
+	var listeners []*frontendListener
+	for i, f := range files {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("socket activation: %s: %w", f.Name(), err)
+		}
+		lmtp := i < len(names) && names[i] == sdLMTPName
+
+		var unixSocket *unixSocketConfig
+		if l.Addr().Network() == "unix" {
+			// the permissions were set by systemd, only the peer rules apply
+			switch {
+			case !lmtp:
+				unixSocket = appConfig.UnixSocket
+			case appConfig.LMTP != nil:
+				unixSocket = appConfig.LMTP.UnixSocket
+			}
+			if unixSocket == nil {
+				unixSocket = &unixSocketConfig{}
+			}
+		}
+		listeners = append(listeners, newFrontendListener(appConfig, l, lmtp, unixSocket))
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state update, such as "READY=1", to the systemd service
+// manager. It does nothing unless mailrelay runs as a Type=notify service.
+func sdNotify(state string) error {
+	notifyConn.Lock()
+	defer notifyConn.Unlock()
+	if err := notifyConn.connect(); err != nil || notifyConn.conn == nil {
+		return err
+	}
+	if _, err := notifyConn.conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	return nil
+}
+
+// notifySocket is a connection to the systemd notify socket. It is kept open
+// so that it survives a chroot.
+type notifySocket struct {
+	sync.Mutex
+	socket string
+	conn   net.Conn
+}
+
+var notifyConn notifySocket
+
+// connect connects to the socket in NOTIFY_SOCKET, if it is set and not
+// connected yet. The caller holds the lock.
+func (n *notifySocket) connect() error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if n.conn != nil && n.socket == socket {
+		return nil
+	}
+	if n.conn != nil {
+		n.conn.Close()
+		n.conn = nil
+	}
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	n.socket, n.conn = socket, conn
+	return nil
+}
+
+// connectNotifySocket connects to the systemd notify socket ahead of time.
+func connectNotifySocket() error {
+	notifyConn.Lock()
+	defer notifyConn.Unlock()
+	return notifyConn.connect()
+}
+
+// notify sends a state update to systemd, logging any failure.
+func notify(state string) {
+	if err := sdNotify(state); err != nil {
+		Logger.WithError(err).Warnf("notifying systemd of %s", state)
+	}
+}
+
+// watchdogInterval returns the interval of the systemd watchdog, or false if
+// it is not enabled for this process.
+func watchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// startWatchdog pings the systemd watchdog twice per interval for as long
+// as healthy returns nil, so systemd restarts mailrelay once it stops being
+// able to relay. It returns a function that stops the pings.
+func startWatchdog(healthy func(timeout time.Duration) error) func() {
+	interval, ok := watchdogInterval()
+	if !ok {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval / watchdogPings)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := healthy(interval / watchdogPings); err != nil {
+					Logger.WithError(err).Warn("upstream unhealthy, skipping watchdog ping")
+					continue
+				}
+				notify("WATCHDOG=1")
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// upstreamHealth returns a health check that connects to the upstream SMTP
+// server, or to the API of the transport.
+func upstreamHealth(appConfig *mailRelayConfig) func(timeout time.Duration) error {
+	addr := net.JoinHostPort(appConfig.SMTPServer, strconv.Itoa(appConfig.SMTPPort))
+	if appConfig.Transport != nil {
+		addr = appConfig.Transport.hostPort()
+	}
+	return func(timeout time.Duration) error {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
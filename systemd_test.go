@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNotifySocket listens for sd_notify messages and points NOTIFY_SOCKET
+// at it.
+func fakeNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("notify sockets are not tested on windows")
+	}
+	dir, err := os.MkdirTemp("", "mr")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "notify")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// readNotify returns the next sd_notify message, or "" if none arrives.
+func readNotify(t *testing.T, conn *net.UnixConn, timeout time.Duration) string {
+	t.Helper()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(timeout)))
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return ""
+	}
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	conn := fakeNotifySocket(t)
+	require.NoError(t, sdNotify("READY=1"))
+	assert.Equal(t, "READY=1", readNotify(t, conn, time.Second))
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	assert.NoError(t, sdNotify("STOPPING=1"))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	interval, ok := watchdogInterval()
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, interval)
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	_, ok = watchdogInterval()
+	assert.False(t, ok, "the watchdog is meant for another process")
+
+	t.Setenv("WATCHDOG_USEC", "")
+	_, ok = watchdogInterval()
+	assert.False(t, ok)
+}
+
+func TestStartWatchdog(t *testing.T) {
+	setupTestLogger(t)
+	conn := fakeNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", "")
+
+	healthy := make(chan error, 1)
+	healthy <- nil
+	stop := startWatchdog(func(time.Duration) error {
+		select {
+		case err := <-healthy:
+			return err
+		default:
+			return errors.New("upstream down")
+		}
+	})
+	defer stop()
+
+	assert.Equal(t, "WATCHDOG=1", readNotify(t, conn, time.Second))
+	assert.Equal(t, "", readNotify(t, conn, 50*time.Millisecond), "no pings while the upstream is down")
+	healthy <- nil
+	assert.Equal(t, "WATCHDOG=1", readNotify(t, conn, time.Second))
+}
+
+func TestSystemdListeners_NotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := systemdListeners(&mailRelayConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, listeners)
+}
+
+func TestActivatedListeners(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket activation is not supported on windows")
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcp.Close()
+	unix := listenTestSocket(t, &unixSocketConfig{})
+
+	var files []*os.File
+	for _, l := range []net.Listener{tcp, unix} {
+		f, err := l.(interface{ File() (*os.File, error) }).File()
+		require.NoError(t, err)
+		files = append(files, f)
+	}
+
+	appConfig := &mailRelayConfig{ProxyProtocol: &proxyProtocolConfig{TrustedProxies: []string{"10.0.0.1"}}}
+	listeners, err := activatedListeners(appConfig, files, []string{"smtp", "lmtp"})
+	require.NoError(t, err)
+	defer closeListeners(listeners)
+	require.Len(t, listeners, 2)
+
+	assert.False(t, listeners[0].lmtp)
+	assert.Nil(t, listeners[0].unixSocket)
+	assert.Equal(t, appConfig.ProxyProtocol, listeners[0].proxy)
+	assert.Equal(t, tcp.Addr().String(), listeners[0].Addr().String())
+
+	assert.True(t, listeners[1].lmtp)
+	assert.NotNil(t, listeners[1].unixSocket)
+	assert.Nil(t, listeners[1].proxy)
+}
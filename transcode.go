@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/netip"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+const (
+	defaultFallbackCharset = "iso-8859-1"
+
+	cteQuotedPrintable = "quoted-printable"
+	cteBase64          = "base64"
+
+	// base64LineLength is the length of base64 encoded body lines.
+	base64LineLength = 76
+
+	// maxMIMEDepth limits how deeply nested multiparts are transcoded.
+	maxMIMEDepth = 10
+)
+
+// transcodeConfig enables converting text in legacy charsets to UTF-8.
+// Sources maps IP addresses or CIDR ranges to the charset their clients
+// send, whatever the labels say, unless the text is valid UTF-8. The charset
+// of text from other clients is detected, and Fallback is used for 8-bit text
+// that is neither UTF-8 nor Japanese and has no usable label.
+type transcodeConfig struct {
+	Sources  map[string]string `json:"sources"`
+	Fallback string            `json:"fallback"`
+}
+
+func (c *transcodeConfig) validate() error {
+	for src, charset := range c.Sources {
+		if _, err := parsePrefix(src); err != nil {
+			return fmt.Errorf("transcode sources: %w", err)
+		}
+		if _, err := lookupCharset(charset); err != nil {
+			return fmt.Errorf("transcode sources: %w", err)
+		}
+	}
+	if c.Fallback != "" {
+		if _, err := lookupCharset(c.Fallback); err != nil {
+			return fmt.Errorf("transcode fallback: %w", err)
+		}
+	}
+	return nil
+}
+
+// transcoder returns the transcoder for messages from the client. The most
+// specific source range matching the client selects its charset.
+func (c *transcodeConfig) transcoder(remoteIP string) *transcoder {
+	t := &transcoder{fallback: c.Fallback}
+	if t.fallback == "" {
+		t.fallback = defaultFallbackCharset
+	}
+	addr, err := netip.ParseAddr(remoteIP)
+	if err != nil {
+		return t
+	}
+	bits := -1
+	for src, charset := range c.Sources {
+		prefix, err := parsePrefix(src)
+		if err == nil && prefix.Contains(addr.Unmap()) && prefix.Bits() > bits {
+			t.forced, bits = charset, prefix.Bits()
+		}
+	}
+	return t
+}
+
+// lookupCharset returns the encoding of a charset label. Labels are those of
+// the WHATWG Encoding Standard, as in web browsers.
+func lookupCharset(label string) (encoding.Encoding, error) {
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		return nil, fmt.Errorf("unknown charset %q", label)
+	}
+	return enc, nil
+}
+
+func isUTF8Label(label string) bool {
+	enc, err := lookupCharset(label)
+	if err != nil {
+		return false
+	}
+	name, err := htmlindex.Name(enc)
+	return err == nil && name == utf8Charset
+}
+
+// transcoder converts the text of a single message to UTF-8.
+type transcoder struct {
+	forced   string
+	fallback string
+}
+
+// charset returns the charset of text, or "" if it is plain ASCII.
+func (t *transcoder) charset(text []byte, label string) string {
+	switch {
+	case isASCII(text):
+		if bytes.Contains(text, []byte("\x1b$B")) || bytes.Contains(text, []byte("\x1b$@")) {
+			return "iso-2022-jp"
+		}
+		return ""
+	case utf8.Valid(text):
+		return utf8Charset
+	case t.forced != "":
+		return t.forced
+	case looksShiftJIS(text):
+		return "shift_jis"
+	case looksEUCJP(text):
+		return "euc-jp"
+	}
+	if _, err := lookupCharset(label); err == nil && !isUTF8Label(label) {
+		return label
+	}
+	return t.fallback
+}
+
+// decodeHeader converts a header field value to UTF-8.
+func (t *transcoder) decodeHeader(value []byte) string {
+	text, err := toUTF8(value, t.charset(value, ""))
+	if err != nil {
+		return decodeText(value)
+	}
+	return text
+}
+
+func toUTF8(text []byte, charset string) (string, error) {
+	if charset == "" || isUTF8Label(charset) {
+		return string(text), nil
+	}
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return "", err
+	}
+	b, err := enc.NewDecoder().Bytes(text)
+	return string(b), err
+}
+
+// inRange returns true if lo <= c <= hi.
+func inRange(c, lo, hi byte) bool {
+	return c >= lo && c <= hi
+}
+
+// looksShiftJIS returns true if the 8-bit bytes of text form Shift_JIS
+// characters, including kana, which Japanese text nearly always contains and
+// which rules out Latin text that happens to be valid Shift_JIS.
+func looksShiftJIS(text []byte) bool {
+	kana := false
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c < utf8.RuneSelf || inRange(c, 0xA1, 0xDF):
+			// ASCII or half-width katakana
+		case inRange(c, 0x81, 0x9F) || inRange(c, 0xE0, 0xFC):
+			if i+1 == len(text) || !inRange(text[i+1], 0x40, 0xFC) || text[i+1] == 0x7F {
+				return false
+			}
+			i++
+			kana = kana || (c == 0x82 && inRange(text[i], 0x9F, 0xF1)) || (c == 0x83 && inRange(text[i], 0x40, 0x96))
+		default:
+			return false
+		}
+	}
+	return kana
+}
+
+// looksEUCJP returns true if the 8-bit bytes of text form EUC-JP characters,
+// including kana.
+func looksEUCJP(text []byte) bool {
+	kana := false
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		trail := 1
+		switch {
+		case c < utf8.RuneSelf:
+			continue
+		case c == 0x8F:
+			// JIS X 0212
+			trail = 2
+		case c != 0x8E && !inRange(c, 0xA1, 0xFE):
+			return false
+		}
+		if i+trail >= len(text) {
+			return false
+		}
+		for _, d := range text[i+1 : i+1+trail] {
+			if !inRange(d, 0xA1, 0xFE) {
+				return false
+			}
+		}
+		kana = kana || c == 0xA4 || c == 0xA5
+		i += trail
+	}
+	return kana
+}
+
+// transcodeMessage converts header fields and text parts in legacy charsets
+// to UTF-8 and returns the conversions made.
+func transcodeMessage(e *mail.Envelope, t *transcoder) []string {
+	msg := parseMessage(e.Data.Bytes())
+	fixes := encodeHeaders(msg, t.decodeHeader)
+	fixes = append(fixes, t.transcodeEntity(msg, 0)...)
+	if len(fixes) > 0 {
+		replaceData(e, msg.bytes())
+	}
+	return fixes
+}
+
+// transcodeEntity transcodes a message or a body part.
+func (t *transcoder) transcodeEntity(msg *message, depth int) []string {
+	mediaType, params := "text/plain", map[string]string{}
+	if ct := msg.get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(ct); err != nil {
+			return nil
+		}
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		return t.transcodeMultipart(msg, params["boundary"], depth)
+	case strings.HasPrefix(mediaType, "text/"):
+		return t.transcodeText(msg, mediaType, params, depth == 0)
+	}
+	return nil
+}
+
+// transcodeText converts a text body to UTF-8 and labels it as such.
+func (t *transcoder) transcodeText(msg *message, mediaType string, params map[string]string, top bool) []string {
+	cte := strings.ToLower(msg.get("Content-Transfer-Encoding"))
+	raw, err := decodeTransferEncoding(msg.body, cte)
+	if err != nil {
+		return []string{fmt.Sprintf("could not decode %s body: %v", mediaType, err)}
+	}
+	label := params["charset"]
+	charset := t.charset(raw, label)
+	if charset == "" || (charset == utf8Charset && isUTF8Label(label)) {
+		return nil
+	}
+	text, err := toUTF8(raw, charset)
+	if err != nil {
+		return []string{fmt.Sprintf("could not transcode %s from %s: %v", mediaType, charset, err)}
+	}
+
+	if cte != cteBase64 && (!isASCII([]byte(text)) || hasLongLines([]byte(text))) {
+		cte = cteQuotedPrintable
+	}
+	body, err := encodeTransferEncoding(text, cte, msg.eol)
+	if err != nil {
+		return []string{fmt.Sprintf("could not encode %s body: %v", mediaType, err)}
+	}
+	msg.body = body
+	params["charset"] = utf8Charset
+	msg.set("Content-Type", mime.FormatMediaType(mediaType, params))
+	if cte != "" {
+		msg.set("Content-Transfer-Encoding", cte)
+	}
+	if top && !msg.has("MIME-Version") {
+		msg.add("MIME-Version", "1.0")
+	}
+	if msg.sep == nil {
+		msg.sep = []byte(msg.eol)
+	}
+	return []string{fmt.Sprintf("transcoded %s from %s", mediaType, charset)}
+}
+
+// transcodeMultipart transcodes the parts of a multipart body.
+func (t *transcoder) transcodeMultipart(msg *message, boundary string, depth int) []string {
+	if boundary == "" || depth >= maxMIMEDepth {
+		return nil
+	}
+	var fixes []string
+	var buf bytes.Buffer
+	for _, seg := range splitMultipart(msg.body, boundary) {
+		if !seg.part {
+			buf.Write(seg.data)
+			continue
+		}
+		part := parseMessage(seg.data)
+		fixes = append(fixes, encodeHeaders(part, t.decodeHeader)...)
+		fixes = append(fixes, t.transcodeEntity(part, depth+1)...)
+		buf.Write(part.bytes())
+	}
+	msg.body = buf.Bytes()
+	return fixes
+}
+
+// mimeSegment is a body part or the text around and between body parts.
+type mimeSegment struct {
+	data []byte
+	part bool
+}
+
+// splitMultipart splits a multipart body into the preamble, the delimiter
+// lines, the body parts and the epilogue, which together make up the body.
+func splitMultipart(body []byte, boundary string) []mimeSegment {
+	delim := []byte("--" + boundary)
+	var segs []mimeSegment
+	start, off := 0, 0
+	inPart := false
+	for rest := body; len(rest) > 0; {
+		line, next := nextLine(rest)
+		if bytes.HasPrefix(line, delim) {
+			after := bytes.TrimRight(line[len(delim):], " \t\r\n")
+			if closing := bytes.Equal(after, []byte("--")); closing || len(after) == 0 {
+				segs = append(segs, mimeSegment{data: body[start:off], part: inPart}, mimeSegment{data: line})
+				start, inPart = off+len(line), !closing
+			}
+		}
+		off += len(line)
+		rest = next
+	}
+	return append(segs, mimeSegment{data: body[start:], part: inPart})
+}
+
+func decodeTransferEncoding(body []byte, cte string) ([]byte, error) {
+	switch cte {
+	case cteQuotedPrintable:
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	case cteBase64:
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	default:
+		return body, nil
+	}
+}
+
+func encodeTransferEncoding(text, cte, eol string) ([]byte, error) {
+	switch cte {
+	case cteQuotedPrintable:
+		return encodeQuotedPrintable(text, eol)
+	case cteBase64:
+		s := base64.StdEncoding.EncodeToString([]byte(text))
+		var buf bytes.Buffer
+		for len(s) > 0 {
+			n := min(len(s), base64LineLength)
+			buf.WriteString(s[:n] + eol)
+			s = s[n:]
+		}
+		return buf.Bytes(), nil
+	default:
+		return []byte(text), nil
+	}
+}
+
+// transcodeProcessor decorator converts text in legacy charsets to UTF-8. It
+// runs before normalizing, which then only sees UTF-8.
+var transcodeProcessor = func() backends.Decorator {
+	var config *transcodeConfig
+	initFunc := backends.InitializeWith(func(backendConfig backends.BackendConfig) error {
+		if c, ok := backendConfig["transcode"].(*transcodeConfig); ok {
+			config = c
+		}
+		return nil
+	})
+	backends.Svc.AddInitializer(initFunc)
+
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail && config != nil {
+					for _, fix := range transcodeMessage(e, config.transcoder(e.RemoteIP)) {
+						msgLog(e).Infof("transcode: %s", fix)
+					}
+				}
+				return p.Process(e, task)
+			},
+		)
+	}
+}
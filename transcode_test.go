@@ -0,0 +1,192 @@
+package main
+
+import (
+	"mime"
+	"strings"
+	"testing"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+)
+
+const (
+	japaneseText = "スキャンが完了しました。ファイルを確認してください。"
+	germanText   = "Grüße aus dem Büro, Mädchen für alles"
+)
+
+func encodeTestText(t *testing.T, charset, text string) string {
+	t.Helper()
+	enc := map[string]interface {
+		String(string) (string, error)
+	}{
+		"shift_jis":   japanese.ShiftJIS.NewEncoder(),
+		"euc-jp":      japanese.EUCJP.NewEncoder(),
+		"iso-2022-jp": japanese.ISO2022JP.NewEncoder(),
+		"iso-8859-1":  charmap.ISO8859_1.NewEncoder(),
+	}[charset]
+	require.NotNil(t, enc, charset)
+	s, err := enc.String(text)
+	require.NoError(t, err)
+	return s
+}
+
+func TestTranscoder_Charset(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		label    string
+		forced   string
+		expected string
+	}{
+		{name: "ascii", text: "hello", expected: ""},
+		{name: "utf-8", text: japaneseText, label: "iso-8859-1", expected: "utf-8"},
+		{name: "shift_jis", text: encodeTestText(t, "shift_jis", japaneseText), expected: "shift_jis"},
+		{name: "shift_jis mislabeled", text: encodeTestText(t, "shift_jis", japaneseText), label: "iso-8859-1",
+			expected: "shift_jis"},
+		{name: "euc-jp", text: encodeTestText(t, "euc-jp", japaneseText), expected: "euc-jp"},
+		{name: "iso-2022-jp", text: encodeTestText(t, "iso-2022-jp", japaneseText), expected: "iso-2022-jp"},
+		{name: "latin-1", text: encodeTestText(t, "iso-8859-1", germanText), expected: "iso-8859-1"},
+		{name: "latin-1 label", text: encodeTestText(t, "iso-8859-1", germanText), label: "windows-1252",
+			expected: "windows-1252"},
+		{name: "wrong utf-8 label", text: encodeTestText(t, "iso-8859-1", germanText), label: "utf-8",
+			expected: "iso-8859-1"},
+		{name: "forced", text: encodeTestText(t, "iso-8859-1", germanText), forced: "shift_jis", expected: "shift_jis"},
+		{name: "forced but utf-8", text: germanText, forced: "shift_jis", expected: "utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &transcoder{forced: tt.forced, fallback: defaultFallbackCharset}
+			assert.Equal(t, tt.expected, tr.charset([]byte(tt.text), tt.label))
+		})
+	}
+}
+
+func TestTranscodeMessage_Plain(t *testing.T) {
+	e := mail.NewEnvelope("10.0.7.3", 1)
+	e.Data.WriteString("Subject: " + encodeTestText(t, "shift_jis", "スキャン完了") + "\n" +
+		"Content-Type: text/plain; charset=iso-8859-1; format=flowed\n\n" +
+		encodeTestText(t, "shift_jis", japaneseText) + "\n")
+	tr := (&transcodeConfig{}).transcoder(e.RemoteIP)
+
+	assert.Equal(t, []string{"encoded Subject", "transcoded text/plain from shift_jis"}, transcodeMessage(e, tr))
+	msg := parseMessage(e.Data.Bytes())
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "スキャン完了", subject)
+	assert.Equal(t, "text/plain; charset=utf-8; format=flowed", msg.get("Content-Type"))
+	assert.Equal(t, "quoted-printable", msg.get("Content-Transfer-Encoding"))
+	assert.Equal(t, "1.0", msg.get("MIME-Version"))
+	body, err := decodeTransferEncoding(msg.body, cteQuotedPrintable)
+	require.NoError(t, err)
+	assert.Equal(t, japaneseText+"\n", string(body))
+}
+
+func TestTranscodeMessage_Multipart(t *testing.T) {
+	latin := encodeTestText(t, "iso-8859-1", germanText)
+	data := "MIME-Version: 1.0\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\n\n" +
+		"preamble\n" +
+		"--b1\n" +
+		"Content-Type: text/plain\n" +
+		"Content-Transfer-Encoding: base64\n\n" +
+		mustBase64(t, latin) +
+		"--b1 \n" +
+		"Content-Type: application/octet-stream\n\n" +
+		"\xfc\xfd\xfe\n" +
+		"--b1\n" +
+		"Content-Type: text/html; charset=utf-8\n\n" +
+		"<p>" + germanText + "</p>\n" +
+		"--b1--\n" +
+		"epilogue\n"
+	e := mail.NewEnvelope("10.0.5.20", 1)
+	e.Data.WriteString(data)
+	tr := (&transcodeConfig{Sources: map[string]string{"10.0.0.0/8": "shift_jis", "10.0.5.0/24": "latin1"}}).
+		transcoder(e.RemoteIP)
+	require.Equal(t, "latin1", tr.forced, "the most specific source wins")
+
+	assert.Equal(t, []string{"transcoded text/plain from latin1"}, transcodeMessage(e, tr))
+	out := e.Data.String()
+	assert.Contains(t, out, "preamble\n--b1\nContent-Type: text/plain; charset=utf-8\n"+
+		"Content-Transfer-Encoding: base64\n\n"+mustBase64(t, germanText)+"--b1 \n")
+	assert.Contains(t, out, "\xfc\xfd\xfe\n--b1\n", "other parts are left alone")
+	assert.Contains(t, out, "<p>"+germanText+"</p>\n--b1--\nepilogue\n")
+}
+
+func TestTranscodeMessage_AttachmentFilename(t *testing.T) {
+	latin := encodeTestText(t, "iso-8859-1", germanText)
+	data := "MIME-Version: 1.0\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\n\n" +
+		"--b1\n" +
+		"Content-Type: text/plain; name=\"Pr\xfcf.txt\"\n" +
+		"Content-Disposition: attachment; filename=\"Pr\xfcf.txt\"\n\n" +
+		latin + "\n" +
+		"--b1--\n"
+	e := mail.NewEnvelope("10.0.5.20", 1)
+	e.Data.WriteString(data)
+	tr := (&transcodeConfig{Sources: map[string]string{"10.0.5.0/24": "latin1"}}).transcoder(e.RemoteIP)
+
+	assert.Equal(t, []string{"encoded Content-Type", "encoded Content-Disposition",
+		"transcoded text/plain from latin1"}, transcodeMessage(e, tr))
+	msg := parseMessage(e.Data.Bytes())
+	segs := splitMultipart(msg.body, "b1")
+	require.Len(t, segs, 5)
+	require.True(t, segs[2].part)
+	part := parseMessage(segs[2].data)
+	mediaType, params, err := mime.ParseMediaType(part.get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain", mediaType)
+	assert.Equal(t, map[string]string{"name": "Prüf.txt", "charset": "utf-8"}, params)
+	disposition, params, err := mime.ParseMediaType(part.get("Content-Disposition"))
+	require.NoError(t, err)
+	assert.Equal(t, "attachment", disposition)
+	assert.Equal(t, "Prüf.txt", params["filename"])
+}
+
+// mustBase64 base64 encodes text the way encodeTransferEncoding does, with
+// LF line endings.
+func mustBase64(t *testing.T, text string) string {
+	t.Helper()
+	b, err := encodeTransferEncoding(text, cteBase64, "\n")
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestTranscodeMessage_Unchanged(t *testing.T) {
+	for _, data := range []string{
+		"Subject: ascii\n\nhello\n",
+		"Subject: utf-8\nContent-Type: text/plain; charset=UTF-8\n\n" + germanText + "\n",
+		"Content-Type: image/png\n\n\x89PNG\n",
+		"Content-Type: multipart/mixed\n\n--x\n\n\xff\n--x--\n",
+	} {
+		e := mail.NewEnvelope("192.0.2.1", 1)
+		e.Data.WriteString(data)
+		assert.Empty(t, transcodeMessage(e, (&transcodeConfig{}).transcoder(e.RemoteIP)))
+		assert.Equal(t, data, e.Data.String())
+	}
+}
+
+func TestSplitMultipart(t *testing.T) {
+	body := "pre\r\n--b\r\none\r\n--bb\r\n--b\r\ntwo\r\n--b--\r\npost"
+	segs := splitMultipart([]byte(body), "b")
+	var parts []string
+	var joined strings.Builder
+	for _, s := range segs {
+		if s.part {
+			parts = append(parts, string(s.data))
+		}
+		joined.Write(s.data)
+	}
+	assert.Equal(t, []string{"one\r\n--bb\r\n", "two\r\n"}, parts)
+	assert.Equal(t, body, joined.String())
+}
+
+func TestTranscodeConfig_Validate(t *testing.T) {
+	require.NoError(t, (&transcodeConfig{Sources: map[string]string{"10.0.7.0/24": "Shift_JIS"}, Fallback: "cp1252"}).
+		validate())
+	assert.Error(t, (&transcodeConfig{Sources: map[string]string{"printers": "shift_jis"}}).validate())
+	assert.Error(t, (&transcodeConfig{Sources: map[string]string{"10.0.7.0/24": "klingon"}}).validate())
+	assert.Error(t, (&transcodeConfig{Fallback: "klingon"}).validate())
+}
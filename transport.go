@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	transportGraph    = "graph"
+	transportGmail    = "gmail"
+	transportSES      = "ses"
+	transportSendGrid = "sendgrid"
+	transportMailgun  = "mailgun"
+
+	defaultTransportTimeout = time.Minute
+
+	// maxAPIResponse limits the response body logged for failed requests.
+	maxAPIResponse = 1024
+)
+
+// transportConfig relays messages through an HTTP API instead of the SMTP
+// server. BaseURL and TokenURL default to those of the service.
+type transportConfig struct {
+	Type               string `json:"type"`
+	BaseURL            string `json:"base_url"`
+	TokenURL           string `json:"token_url"`
+	TenantID           string `json:"tenant_id"`
+	ClientID           string `json:"client_id"`
+	ClientSecret       string `json:"client_secret"`
+	RefreshToken       string `json:"refresh_token"`
+	ServiceAccountFile string `json:"service_account_file"`
+	User               string `json:"user"`
+	Region             string `json:"region"`
+	AccessKeyID        string `json:"access_key_id"`
+	SecretAccessKey    string `json:"secret_access_key"`
+	SessionToken       string `json:"session_token"`
+	APIKey             string `json:"api_key"`
+	Domain             string `json:"domain"`
+	TimeoutSecs        int    `json:"timeout_secs"`
+}
+
+func (c *transportConfig) validate() error {
+	for _, u := range []string{c.BaseURL, c.TokenURL} {
+		if u == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("%s transport: %q is not an http or https URL", c.Type, u)
+		}
+	}
+	if c.TimeoutSecs < 0 {
+		return fmt.Errorf("%s transport: timeout_secs must not be negative", c.Type)
+	}
+	switch c.Type {
+	case transportGraph:
+		return c.validateGraph()
+	case transportGmail:
+		return c.validateGmail()
+	case transportSES:
+		return c.validateSES()
+	case transportSendGrid, transportMailgun:
+		return c.validateAPIKey()
+	default:
+		return fmt.Errorf("unknown transport type %q", c.Type)
+	}
+}
+
+// validateAPIKey validates the settings of the transports authenticating
+// with an API key.
+func (c *transportConfig) validateAPIKey() error {
+	if c.APIKey == "" {
+		return fmt.Errorf("%s transport: api_key is required", c.Type)
+	}
+	if c.Type == transportMailgun && c.Domain == "" {
+		return errors.New("mailgun transport: domain is required")
+	}
+	return nil
+}
+
+// defaultBaseURLs are the base URLs of the services' APIs.
+var defaultBaseURLs = map[string]string{
+	transportGraph:    defaultGraphBaseURL,
+	transportGmail:    defaultGmailBaseURL,
+	transportSES:      defaultSESBaseURL,
+	transportSendGrid: defaultSendGridBaseURL,
+	transportMailgun:  defaultMailgunBaseURL,
+}
+
+// baseURL returns the base URL of the API.
+func (c *transportConfig) baseURL() string {
+	if c.BaseURL != "" {
+		return strings.TrimSuffix(c.BaseURL, "/")
+	}
+	return strings.ReplaceAll(defaultBaseURLs[c.Type], "{region}", c.Region)
+}
+
+// hostPort returns the address of the API's server.
+func (c *transportConfig) hostPort() string {
+	u, err := url.Parse(c.baseURL())
+	if err != nil {
+		return ""
+	}
+	port := u.Port()
+	switch {
+	case port != "":
+	case u.Scheme == "http":
+		port = "80"
+	default:
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// transport relays messages upstream.
+type transport interface {
+	name() string
+	send(e *mail.Envelope) error
+}
+
+// newTransport returns the transport of the configuration.
+func newTransport(c *transportConfig) (transport, error) {
+	timeout := defaultTransportTimeout
+	if c.TimeoutSecs > 0 {
+		timeout = time.Duration(c.TimeoutSecs) * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	switch c.Type {
+	case transportGraph:
+		return newGraphTransport(c, client), nil
+	case transportGmail:
+		return newGmailTransport(c, client)
+	case transportSES:
+		return newSESTransport(c, client), nil
+	case transportSendGrid:
+		return newSendGridTransport(c, client), nil
+	case transportMailgun:
+		return newMailgunTransport(c, client), nil
+	default:
+		return nil, fmt.Errorf("unknown transport type %q", c.Type)
+	}
+}
+
+// sendAPI relays the message through an HTTP API transport.
+func sendAPI(e *mail.Envelope, t transport) error {
+	if !senderAllowed(e) {
+		err := senderNotAllowed(e)
+		msgLog(e).Info(err.Error())
+		return err
+	}
+	msgLog(e).Infof("starting email send -- from:%s, via:%s", e.MailFrom.String(), t.name())
+	if err := t.send(e); err != nil {
+		return err
+	}
+	msgLog(e).Info("email sent with no errors.")
+	return nil
+}
+
+// apiClient makes authorized requests to an HTTP API.
+type apiClient struct {
+	name   string
+	client *http.Client
+	auth   authorizer
+}
+
+// do sends the request made by newRequest. If the API refuses the
+// credentials, they are renewed and the request is sent once more.
+func (a *apiClient) do(e *mail.Envelope, newRequest func() (*http.Request, error)) error {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return err
+		}
+		if err := a.auth.authorize(req); err != nil {
+			msgLog(e).WithError(err).Errorf("authorizing %s request", a.name)
+			return fmt.Errorf("451 4.7.0 Could not authenticate to %s, try again later", a.name)
+		}
+		resp, err := a.client.Do(req)
+		if err != nil {
+			msgLog(e).WithError(err).Errorf("%s request failed", a.name)
+			return fmt.Errorf("451 4.4.1 Could not reach %s, try again later", a.name)
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxAPIResponse))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 1 {
+			a.auth.invalidate()
+			continue
+		}
+		if err == nil && resp.StatusCode/100 != 2 {
+			msgLog(e).Errorf("%s responded %s: %s", a.name, resp.Status, strings.TrimSpace(string(body)))
+		}
+		return apiStatusError(a.name, resp.StatusCode)
+	}
+}
+
+// bearerAuth authorizes requests with a static bearer token.
+type bearerAuth string
+
+func (a bearerAuth) authorize(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+string(a))
+	return nil
+}
+
+func (a bearerAuth) invalidate() {}
+
+// basicAuth authorizes requests with a user name and password.
+type basicAuth struct {
+	user     string
+	password string
+}
+
+func (a basicAuth) authorize(req *http.Request) error {
+	req.SetBasicAuth(a.user, a.password)
+	return nil
+}
+
+func (a basicAuth) invalidate() {}
+
+// apiStatusError returns the SMTP reply for an API response status, or nil
+// for success. Rate limiting, server errors and refused credentials are
+// temporary failures, other client errors permanent ones.
+func apiStatusError(name string, status int) error {
+	switch {
+	case status/100 == 2:
+		return nil
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		// expired keys, a skewed clock or missing permissions are for the
+		// operator to fix, the message is not at fault
+		return fmt.Errorf("451 4.7.0 %s refused the credentials (status %d), try again later", name, status)
+	case status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status/100 == 5:
+		return fmt.Errorf("451 4.4.2 %s failed (status %d), try again later", name, status)
+	default:
+		return fmt.Errorf("554 5.0.0 %s rejected the message (status %d)", name, status)
+	}
+}
+
+// apiRecipients are the envelope recipients of a message, sorted by the
+// header field listing them, with the names given there. Recipients the To
+// and Cc fields do not list are blind copies.
+type apiRecipients struct {
+	to, cc, bcc []*netmail.Address
+}
+
+// envelopeRecipients sorts the envelope recipients by the header fields of
+// msg. Addresses in the header that are not envelope recipients are left out,
+// as this relay is not asked to deliver to them.
+func envelopeRecipients(e *mail.Envelope, msg *message) *apiRecipients {
+	listed := map[string]*netmail.Address{}
+	fields := map[string]string{}
+	for _, name := range []string{"To", "Cc"} {
+		for _, a := range headerAddresses(msg, name) {
+			key := strings.ToLower(a.Address)
+			if _, ok := fields[key]; !ok {
+				listed[key], fields[key] = a, name
+			}
+		}
+	}
+	r := &apiRecipients{}
+	seen := map[string]bool{}
+	for _, rcpt := range e.RcptTo {
+		a := &netmail.Address{Address: rcpt.String()}
+		key := strings.ToLower(a.Address)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if l, ok := listed[key]; ok {
+			a.Name = l.Name
+		}
+		switch fields[key] {
+		case "To":
+			r.to = append(r.to, a)
+		case "Cc":
+			r.cc = append(r.cc, a)
+		default:
+			r.bcc = append(r.bcc, a)
+		}
+	}
+	return r
+}
+
+// headerAddresses returns the addresses of the fields with the given name
+// that can be parsed.
+func headerAddresses(msg *message, name string) []*netmail.Address {
+	var addrs []*netmail.Address
+	for _, v := range msg.values(name) {
+		if list, err := netmail.ParseAddressList(v); err == nil {
+			addrs = append(addrs, list...)
+		}
+	}
+	return addrs
+}
+
+// submittedMessage returns the message data for APIs that take the
+// recipients from the header. The To and Cc fields are rewritten to list
+// only envelope recipients, and the other envelope recipients are put in a
+// Bcc field, so that the API delivers to the envelope recipients and no one
+// else. Fields that list envelope recipients only are left as they are.
+func submittedMessage(e *mail.Envelope) []byte {
+	msg := parseMessage(e.Data.Bytes())
+	r := envelopeRecipients(e, msg)
+	rcpts := map[string]bool{}
+	for _, rcpt := range e.RcptTo {
+		rcpts[strings.ToLower(rcpt.String())] = true
+	}
+	changed := msg.del("Bcc") > 0
+	for _, f := range []struct {
+		name  string
+		addrs []*netmail.Address
+	}{{"To", r.to}, {"Cc", r.cc}} {
+		if !msg.has(f.name) {
+			continue
+		}
+		// fields that cannot be parsed are replaced too
+		keep := true
+		for _, v := range msg.values(f.name) {
+			list, err := netmail.ParseAddressList(v)
+			keep = keep && err == nil
+			for _, a := range list {
+				keep = keep && rcpts[strings.ToLower(a.Address)]
+			}
+		}
+		if keep {
+			continue
+		}
+		changed = true
+		if len(f.addrs) == 0 {
+			msg.del(f.name)
+		} else {
+			msg.set(f.name, formatAddressList(f.addrs))
+		}
+	}
+	if len(r.bcc) > 0 {
+		changed = true
+		msg.add("Bcc", formatAddressList(r.bcc))
+	}
+	if !changed {
+		return e.Data.Bytes()
+	}
+	return msg.bytes()
+}
+
+// formatAddressList formats addresses for an address list field.
+func formatAddressList(addrs []*netmail.Address) string {
+	list := make([]string, len(addrs))
+	for i, a := range addrs {
+		list[i] = a.Address
+		if a.Name != "" {
+			list[i] = a.String()
+		}
+	}
+	return strings.Join(list, ", ")
+}
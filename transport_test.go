@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jpillora/ipfilter"
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAPI is a local stand-in for an HTTP API and its token endpoint at
+// /token. It responds with the statuses in turn, and then with 202.
+type fakeAPI struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	tokens   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func startFakeAPI(t *testing.T, statuses ...int) *fakeAPI {
+	t.Helper()
+	api := &fakeAPI{statuses: statuses}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		if r.URL.Path == "/token" {
+			api.tokens++
+			assert.NoError(t, json.NewEncoder(w).Encode(tokenResponse{
+				AccessToken: fmt.Sprintf("token-%d", api.tokens),
+				ExpiresIn:   3600,
+			}))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		api.requests = append(api.requests, r)
+		api.bodies = append(api.bodies, body)
+		status := http.StatusAccepted
+		if len(api.statuses) > 0 {
+			status, api.statuses = api.statuses[0], api.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func transportTestEnvelope() *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "0123456789ABCDEF"
+	e.MailFrom = mail.Address{User: "backup", Host: "example.com"}
+	e.RcptTo = []mail.Address{{User: "ops", Host: "example.com"}, {User: "audit", Host: "example.com"}}
+	e.Data.WriteString("From: backup@example.com\r\nTo: Ops <ops@example.com>\r\nSubject: nightly\r\n\r\nbody\r\n")
+	return e
+}
+
+func TestSubmittedMessage(t *testing.T) {
+	e := transportTestEnvelope()
+	assert.Equal(t, "From: backup@example.com\r\nTo: Ops <ops@example.com>\r\nSubject: nightly\r\n"+
+		"Bcc: audit@example.com\r\n\r\nbody\r\n", string(submittedMessage(e)))
+
+	e.RcptTo = e.RcptTo[:1]
+	assert.Equal(t, e.Data.Bytes(), submittedMessage(e), "messages listing all recipients are unchanged")
+
+	// another transaction covers ops, who is in the header too
+	e = transportTestEnvelope()
+	e.RcptTo = e.RcptTo[1:]
+	e.Data.Reset()
+	e.Data.WriteString("From: backup@example.com\r\nTo: Ops <ops@example.com>, Audit <audit@example.com>\r\n" +
+		"Cc: dev@example.com\r\nBcc: boss@example.com\r\nSubject: nightly\r\n\r\nbody\r\n")
+	assert.Equal(t, "From: backup@example.com\r\nTo: \"Audit\" <audit@example.com>\r\nSubject: nightly\r\n"+
+		"\r\nbody\r\n", string(submittedMessage(e)), "only envelope recipients are listed")
+}
+
+func TestAPIStatusError(t *testing.T) {
+	tests := []struct {
+		status int
+		reply  string
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusAccepted},
+		{status: http.StatusBadRequest, reply: "554 "},
+		{status: http.StatusRequestEntityTooLarge, reply: "554 "},
+		{status: http.StatusUnauthorized, reply: "451 "},
+		{status: http.StatusForbidden, reply: "451 4.7.0 "},
+		{status: http.StatusTooManyRequests, reply: "451 "},
+		{status: http.StatusServiceUnavailable, reply: "451 "},
+	}
+	for _, tt := range tests {
+		err := apiStatusError("API", tt.status)
+		if tt.reply == "" {
+			assert.NoError(t, err)
+			continue
+		}
+		require.Error(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), tt.reply), "%d: %v", tt.status, err)
+	}
+}
+
+func TestAPIClient_RenewsRefusedToken(t *testing.T) {
+	setupTestLogger(t)
+	api := startFakeAPI(t, http.StatusUnauthorized)
+	c := &apiClient{name: "API", client: api.Client(),
+		auth: newTokenSource(api.Client(), api.URL+"/token", "app", "secret", "", "scope")}
+	newRequest := func() (*http.Request, error) { return http.NewRequest(http.MethodPost, api.URL+"/send", nil) }
+
+	require.NoError(t, c.do(transportTestEnvelope(), newRequest))
+	require.Len(t, api.requests, 2)
+	assert.Equal(t, "Bearer token-1", api.requests[0].Header.Get("Authorization"))
+	assert.Equal(t, "Bearer token-2", api.requests[1].Header.Get("Authorization"))
+
+	api.statuses = []int{http.StatusUnauthorized, http.StatusUnauthorized}
+	err := c.do(transportTestEnvelope(), newRequest)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "451 "), err.Error())
+
+	api.Close()
+	c.auth.invalidate()
+	err = c.do(transportTestEnvelope(), newRequest)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "451 "), err.Error())
+}
+
+func TestSubmitDirect_Transport(t *testing.T) {
+	setupTestLogger(t)
+	api := startFakeAPI(t)
+	AllowedSendersFilter = ipfilter.New(ipfilter.Options{})
+
+	appConfig := &mailRelayConfig{}
+	configDefaults(appConfig)
+	appConfig.Transport = &transportConfig{Type: transportGraph, BaseURL: api.URL, TokenURL: api.URL + "/token",
+		ClientID: "app", ClientSecret: "secret", User: "relay@example.com"}
+	require.NoError(t, validateConfig(appConfig))
+
+	sub := &sendmailSubmission{
+		sender:     "backup@example.com",
+		recipients: []string{"ops@example.com"},
+		data:       []byte("From: backup@example.com\nTo: ops@example.com\nSubject: nightly\n\nbody\n"),
+	}
+	require.NoError(t, submitDirect(appConfig, sub))
+	require.Len(t, api.requests, 1)
+	assert.Equal(t, "/v1.0/users/relay@example.com/sendMail", api.requests[0].URL.Path)
+}
+
+func TestTransportConfig_Validate(t *testing.T) {
+	valid := []*transportConfig{
+		{Type: transportGraph, TenantID: "contoso", ClientID: "app", ClientSecret: "secret", User: "relay@contoso.com"},
+		{Type: transportGraph, TenantID: "contoso", ClientID: "app", RefreshToken: "token"},
+		{Type: transportGraph, TokenURL: "http://127.0.0.1:8080/token", BaseURL: "http://127.0.0.1:8080",
+			ClientID: "app", RefreshToken: "token"},
+		{Type: transportGmail, ClientID: "app", ClientSecret: "secret", RefreshToken: "token"},
+		{Type: transportGmail, ServiceAccountFile: "/etc/mailrelay/key.json", User: "relay@example.com"},
+		{Type: transportSES, Region: "eu-west-1", AccessKeyID: "AKID", SecretAccessKey: "secret"},
+		{Type: transportSendGrid, APIKey: "key"},
+		{Type: transportMailgun, APIKey: "key", Domain: "mg.example.com"},
+	}
+	for _, c := range valid {
+		assert.NoError(t, c.validate())
+	}
+	invalid := []*transportConfig{
+		{Type: "smtp"},
+		{Type: transportGraph, TenantID: "contoso", ClientSecret: "secret", User: "relay@contoso.com"},
+		{Type: transportGraph, TenantID: "contoso", ClientID: "app", User: "relay@contoso.com"},
+		{Type: transportGraph, TenantID: "contoso", ClientID: "app", ClientSecret: "secret"},
+		{Type: transportGraph, ClientID: "app", RefreshToken: "token"},
+		{Type: transportGraph, TenantID: "contoso", ClientID: "app", RefreshToken: "token", BaseURL: "graph"},
+		{Type: transportGraph, TenantID: "contoso", ClientID: "app", RefreshToken: "token", TimeoutSecs: -1},
+		{Type: transportGmail},
+		{Type: transportGmail, RefreshToken: "token"},
+		{Type: transportGmail, ServiceAccountFile: "/etc/mailrelay/key.json"},
+		{Type: transportGmail, ClientID: "app", ClientSecret: "secret", RefreshToken: "token",
+			ServiceAccountFile: "/etc/mailrelay/key.json", User: "relay@example.com"},
+		{Type: transportSES, AccessKeyID: "AKID", SecretAccessKey: "secret"},
+		{Type: transportSES, Region: "eu-west-1", AccessKeyID: "AKID"},
+		{Type: transportSendGrid},
+		{Type: transportMailgun, APIKey: "key"},
+		{Type: transportMailgun, Domain: "mg.example.com"},
+	}
+	for _, c := range invalid {
+		assert.Error(t, c.validate(), "%+v", c)
+	}
+}
+
+func TestTransportConfig_HostPort(t *testing.T) {
+	assert.Equal(t, "graph.microsoft.com:443", (&transportConfig{Type: transportGraph}).hostPort())
+	assert.Equal(t, "127.0.0.1:80", (&transportConfig{Type: transportGmail, BaseURL: "http://127.0.0.1"}).hostPort())
+	assert.Equal(t, "localhost:8080",
+		(&transportConfig{Type: transportGmail, BaseURL: "https://localhost:8080/"}).hostPort())
+	assert.Equal(t, "email.eu-west-1.amazonaws.com:443",
+		(&transportConfig{Type: transportSES, Region: "eu-west-1"}).hostPort())
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+)
+
+// unixSocketConfig configures a Unix domain socket listener. Clients that can
+// open the socket are trusted, unless AllowedUIDs or AllowedGIDs restrict
+// them by their credentials.
+type unixSocketConfig struct {
+	Path        string `json:"path"`
+	Mode        string `json:"mode"`
+	Owner       string `json:"owner"`
+	Group       string `json:"group"`
+	AllowedUIDs []int  `json:"allowed_uids"`
+	AllowedGIDs []int  `json:"allowed_gids"`
+}
+
+const defaultSocketMode = 0o660
+
+func (c *unixSocketConfig) validate() error {
+	if c.Path == "" {
+		return errors.New("unix_socket: path is required")
+	}
+	if _, err := c.mode(); err != nil {
+		return fmt.Errorf("unix_socket: invalid mode %q", c.Mode)
+	}
+	return nil
+}
+
+func (c *unixSocketConfig) mode() (os.FileMode, error) {
+	if c.Mode == "" {
+		return defaultSocketMode, nil
+	}
+	m, err := strconv.ParseUint(c.Mode, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, errors.New("invalid mode")
+	}
+	return os.FileMode(m), nil
+}
+
+// hasPeerRules returns true if peers are restricted by their credentials.
+func (c *unixSocketConfig) hasPeerRules() bool {
+	return len(c.AllowedUIDs) > 0 || len(c.AllowedGIDs) > 0
+}
+
+// allowed returns true if a peer with the given credentials may connect.
+func (c *unixSocketConfig) allowed(uid, gid int) bool {
+	if !c.hasPeerRules() {
+		return true
+	}
+	return slices.Contains(c.AllowedUIDs, uid) || slices.Contains(c.AllowedGIDs, gid)
+}
+
+// listen creates the socket and applies its permissions and ownership. A
+// stale socket left by a previous run is removed.
+func (c *unixSocketConfig) listen() (net.Listener, error) {
+	if info, err := os.Lstat(c.Path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(c.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", c.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.setPermissions(); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("unix_socket %s: %w", c.Path, err)
+	}
+	return l, nil
+}
+
+func (c *unixSocketConfig) setPermissions() error {
+	mode, err := c.mode()
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(c.Path, mode); err != nil {
+		return err
+	}
+	if c.Owner == "" && c.Group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if c.Owner != "" {
+		if uid, err = lookupID(c.Owner, lookupUserID); err != nil {
+			return fmt.Errorf("owner: %w", err)
+		}
+	}
+	if c.Group != "" {
+		if gid, err = lookupID(c.Group, lookupGroupID); err != nil {
+			return fmt.Errorf("group: %w", err)
+		}
+	}
+	return os.Chown(c.Path, uid, gid)
+}
+
+// lookupID resolves a user or group given by name or numeric ID.
+func lookupID(nameOrID string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+func lookupUserID(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGroupID(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	defaultWebhookTimeout  = 30 * time.Second
+	defaultWebhookAttempts = 3
+
+	// maxWebhookResponse limits the response body logged for failed posts.
+	maxWebhookResponse = 512
+
+	webhookSignatureHeader = "X-Mailrelay-Signature"
+	webhookRelayIDHeader   = "X-Mailrelay-Relay-ID"
+)
+
+// webhookRetryDelay is the delay before the second attempt to post to a
+// webhook. It doubles with every further attempt.
+var webhookRetryDelay = time.Second
+
+// webhookPayload is the JSON document posted to webhooks.
+type webhookPayload struct {
+	RelayID  string        `json:"relay_id"`
+	Client   webhookClient `json:"client"`
+	From     string        `json:"from"`
+	To       []string      `json:"to"`
+	Received time.Time     `json:"received"`
+	*messageContent
+}
+
+type webhookClient struct {
+	IP   string `json:"ip"`
+	Helo string `json:"helo"`
+}
+
+// validateWebhook validates the settings of webhook and chat deliveries.
+func (c *deliveryConfig) validateWebhook() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s delivery: url must be an http or https URL", c.Type)
+	}
+	if c.Attempts < 0 {
+		return fmt.Errorf("%s delivery: attempts must not be negative", c.Type)
+	}
+	return nil
+}
+
+// newWebhookPayload returns the document describing the message for the
+// recipients. Attachment content is only included if attachments is true.
+func newWebhookPayload(e *mail.Envelope, rcpts []mail.Address, attachments bool, now time.Time) *webhookPayload {
+	p := &webhookPayload{
+		RelayID:        e.QueuedId,
+		Client:         webhookClient{IP: e.RemoteIP, Helo: e.Helo},
+		From:           e.MailFrom.String(),
+		To:             make([]string, len(rcpts)),
+		Received:       now.UTC(),
+		messageContent: parseContent(e.Data.Bytes()),
+	}
+	for i, rcpt := range rcpts {
+		p.To[i] = rcpt.String()
+	}
+	if !attachments {
+		for _, a := range p.Attachments {
+			a.Content = nil
+		}
+	}
+	return p
+}
+
+// signWebhook returns the signature header value of a webhook body, the hex
+// encoded HMAC-SHA256 of the body keyed with the secret.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook posts the message as JSON to the webhook.
+func (d *localDelivery) postWebhook(e *mail.Envelope, now time.Time) error {
+	body, err := json.Marshal(newWebhookPayload(e, d.rcpts, d.config.Attachments, now))
+	if err != nil {
+		return err
+	}
+	return d.postJSON(e, body)
+}
+
+// postJSON posts body to the delivery's URL. Network errors, timeouts, 408,
+// 429 and 5xx responses are retried; if the last attempt fails too the
+// delivery fails temporarily. Other responses that are not 2xx reject the
+// message.
+func (d *localDelivery) postJSON(e *mail.Envelope, body []byte) error {
+	attempts := d.config.Attempts
+	if attempts == 0 {
+		attempts = defaultWebhookAttempts
+	}
+	client := &http.Client{Timeout: d.config.timeout(defaultWebhookTimeout)}
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		status, err := d.post(client, e, body)
+		switch {
+		case err == nil && status/100 == 2:
+			return nil
+		case err == nil && status/100 == 4 && status != http.StatusRequestTimeout &&
+			status != http.StatusTooManyRequests:
+			return fmt.Errorf("554 5.3.0 Webhook rejected message (status %d)", status)
+		case attempt >= attempts:
+			return errors.New("451 4.3.0 Webhook delivery failed, try again later")
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post makes a single attempt to post body to the webhook and returns the
+// response status.
+func (d *localDelivery) post(client *http.Client, e *mail.Envelope, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, d.target[0], bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mailrelay")
+	req.Header.Set(webhookRelayIDHeader, e.QueuedId)
+	if d.config.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(d.config.Secret, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		msgLog(e).WithError(err).Warn("posting to webhook")
+		return 0, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+	if err == nil && resp.StatusCode/100 != 2 {
+		msgLog(e).Warnf("webhook responded %s: %s", resp.Status, bytes.TrimSpace(out))
+	}
+	return resp.StatusCode, nil
+}
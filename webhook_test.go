@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startWebhook starts a webhook server that responds with the statuses in
+// turn, and then with 200. It returns the server and the requests received.
+func startWebhook(t *testing.T, statuses ...int) (*httptest.Server, *[]*http.Request, *[][]byte) {
+	t.Helper()
+	var requests []*http.Request
+	var bodies [][]byte
+	var n atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r)
+		bodies = append(bodies, body)
+		if i := int(n.Add(1)) - 1; i < len(statuses) {
+			w.WriteHeader(statuses[i])
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests, &bodies
+}
+
+func webhookRoutes(c *deliveryConfig) []*routeConfig {
+	return []*routeConfig{{Name: "events", Recipients: []string{"*@events.lan"}, Delivery: c}}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	setupTestLogger(t)
+	srv, requests, bodies := startWebhook(t)
+	e := deliverTestEnvelope("ups@events.lan", "x@example.com")
+	e.Data.Reset()
+	e.Data.WriteString("Subject: UPS on battery\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\n\r\nOn battery since 10:02\r\n" +
+		"--b\r\nContent-Type: text/csv; name=load.csv\r\n\r\nload,80\r\n--b--\r\n")
+	routes := webhookRoutes(&deliveryConfig{Type: deliveryWebhook, URL: srv.URL + "/events", Secret: "s3cret"})
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	relay, err := deliverLocally(e, routes, newMailboxWriter(false), newDestinationStatus(), now)
+	require.NoError(t, err)
+	assert.Equal(t, []mail.Address{{User: "x", Host: "example.com"}}, relay)
+
+	require.Len(t, *requests, 1)
+	req, body := (*requests)[0], (*bodies)[0]
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "/events", req.URL.Path)
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "0123456789ABCDEF", req.Header.Get(webhookRelayIDHeader))
+	assert.Equal(t, signWebhook("s3cret", body), req.Header.Get(webhookSignatureHeader))
+	assert.True(t, strings.HasPrefix(req.Header.Get(webhookSignatureHeader), "sha256="))
+
+	var payload map[string]any
+	require.NoError(t, json.Unmarshal(body, &payload))
+	assert.Equal(t, "0123456789ABCDEF", payload["relay_id"])
+	assert.Equal(t, map[string]any{"ip": "10.0.5.20", "helo": "printer.lan"}, payload["client"])
+	assert.Equal(t, "scanner@lan", payload["from"])
+	assert.Equal(t, []any{"ups@events.lan"}, payload["to"])
+	assert.Equal(t, "2024-03-01T12:00:00Z", payload["received"])
+	assert.Equal(t, "UPS on battery", payload["subject"])
+	assert.Equal(t, "On battery since 10:02\n", payload["text"])
+	assert.Equal(t, []any{map[string]any{"filename": "load.csv", "content_type": "text/csv", "size": float64(9)}},
+		payload["attachments"], "attachment content is omitted by default")
+
+	routes[0].Delivery.Attachments = true
+	routes[0].Delivery.Relay = true
+	relay, err = deliverLocally(e, routes, newMailboxWriter(false), newDestinationStatus(), now)
+	require.NoError(t, err)
+	assert.Len(t, relay, 2, "relay also relays the webhook's recipients")
+	require.NoError(t, json.Unmarshal((*bodies)[1], &payload))
+	attachment, ok := payload["attachments"].([]any)[0].(map[string]any)
+	require.True(t, ok)
+	assert.Equal(t, "bG9hZCw4MA0K", attachment["content"])
+}
+
+func TestWebhookDelivery_InFlight(t *testing.T) {
+	setupTestLogger(t)
+	var inFlight int64
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		inFlight = deliveriesInFlight.Load()
+	}))
+	t.Cleanup(srv.Close)
+	routes := webhookRoutes(&deliveryConfig{Type: deliveryWebhook, URL: srv.URL})
+
+	_, err := deliverLocally(deliverTestEnvelope("ups@events.lan"), routes, newMailboxWriter(false),
+		newDestinationStatus(), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), inFlight, "shutdown waits for local deliveries")
+	assert.Zero(t, deliveriesInFlight.Load())
+}
+
+func TestWebhookDelivery_Retries(t *testing.T) {
+	setupTestLogger(t)
+	delay := webhookRetryDelay
+	webhookRetryDelay = time.Millisecond
+	t.Cleanup(func() { webhookRetryDelay = delay })
+	deliver := func(c *deliveryConfig) error {
+		_, err := deliverLocally(deliverTestEnvelope("ups@events.lan"), webhookRoutes(c), newMailboxWriter(false),
+			newDestinationStatus(), time.Now())
+		return err
+	}
+
+	srv, requests, _ := startWebhook(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	require.NoError(t, deliver(&deliveryConfig{Type: deliveryWebhook, URL: srv.URL}))
+	assert.Len(t, *requests, 3)
+
+	srv, requests, _ = startWebhook(t, http.StatusBadGateway, http.StatusBadGateway)
+	err := deliver(&deliveryConfig{Type: deliveryWebhook, URL: srv.URL, Attempts: 2})
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "451 "), err.Error())
+	assert.Len(t, *requests, 2)
+
+	srv, requests, _ = startWebhook(t, http.StatusBadRequest)
+	err = deliver(&deliveryConfig{Type: deliveryWebhook, URL: srv.URL})
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "554 "), err.Error())
+	assert.Len(t, *requests, 1, "client errors are not retried")
+}
+
+func TestWebhookDelivery_Timeout(t *testing.T) {
+	setupTestLogger(t)
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(done) })
+
+	c := &deliveryConfig{Type: deliveryWebhook, URL: srv.URL, Attempts: 1, TimeoutSecs: 1}
+	start := time.Now()
+	_, err := deliverLocally(deliverTestEnvelope("ups@events.lan"), webhookRoutes(c), newMailboxWriter(false),
+		newDestinationStatus(), time.Now())
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "451 "), err.Error())
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestDeliveryConfig_ValidateWebhook(t *testing.T) {
+	assert.NoError(t, (&deliveryConfig{Type: deliveryWebhook, URL: "https://events.example.com/mail"}).validate())
+	assert.Error(t, (&deliveryConfig{Type: deliveryWebhook}).validate())
+	assert.Error(t, (&deliveryConfig{Type: deliveryWebhook, URL: "ftp://events.example.com"}).validate())
+	assert.Error(t, (&deliveryConfig{Type: deliveryWebhook, URL: "https://example.com", Attempts: -1}).validate())
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/smtp"
+	"slices"
+	"strings"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	// xclientExtension and xforwardExtension are advertised to trusted
+	// relays in reply to EHLO.
+	xclientExtension  = "XCLIENT ADDR HELO NAME PROTO"
+	xforwardExtension = "XFORWARD ADDR HELO NAME PROTO SOURCE"
+
+	// xclientUnixPeers is the trusted_peers entry for Unix socket clients.
+	xclientUnixPeers = "unix"
+
+	// xtextHexLength is the length of an escaped xtext character ("+XX").
+	xtextHexLength = 3
+)
+
+// xclientConfig lets relays in front of mailrelay, such as Postfix, identify
+// the original client with the XCLIENT and XFORWARD commands. TrustedPeers
+// lists the IP addresses and CIDR ranges of those relays; "unix" trusts Unix
+// socket clients.
+type xclientConfig struct {
+	TrustedPeers []string `json:"trusted_peers"`
+}
+
+func (c *xclientConfig) validate() error {
+	if len(c.TrustedPeers) == 0 {
+		return errors.New("xclient: trusted_peers is required")
+	}
+	for _, s := range c.TrustedPeers {
+		if s == xclientUnixPeers {
+			continue
+		}
+		if _, err := parsePrefix(s); err != nil {
+			return fmt.Errorf("xclient: %w", err)
+		}
+	}
+	return nil
+}
+
+// trusted returns true if the peer at addr may use XCLIENT and XFORWARD.
+func (c *xclientConfig) trusted(addr string) bool {
+	if strings.HasPrefix(addr, xclientUnixPeers) {
+		return slices.Contains(c.TrustedPeers, xclientUnixPeers)
+	}
+	return ipInList(addr, c.TrustedPeers)
+}
+
+// xclient replaces the session's peer with the client described by the
+// relay, and greets the relay again as the start of a new session.
+func (s *smtpSession) xclient(line string) error {
+	attrs, err := parseXAttributes(line)
+	if err != nil {
+		s.reply("501 5.5.4 " + err.Error() + "\r\n")
+		return nil
+	}
+	// abandon any transaction the relay started as itself
+	if _, err := s.command("RSET\r\n"); err != nil {
+		return err
+	}
+	peer := &peerInfo{addr: s.session.addr, helo: s.session.helo}
+	if addr, ok := attrs["ADDR"]; ok {
+		peer.addr = addr
+	}
+	if helo, ok := attrs["HELO"]; ok {
+		peer.helo = helo
+	}
+	Logger.Debugf("relay identified client %s with XCLIENT", peer.addr)
+	s.setTransaction(false)
+	s.session = peer
+	s.setPeer(peer)
+	s.reply(s.greeting)
+	return nil
+}
+
+// xforward records the client of the next transaction.
+func (s *smtpSession) xforward(line string) {
+	attrs, err := parseXAttributes(line)
+	if err != nil {
+		s.reply("501 5.5.4 " + err.Error() + "\r\n")
+		return
+	}
+	peer := *s.current
+	peer.via = s.session.addr
+	if addr, ok := attrs["ADDR"]; ok {
+		peer.addr = addr
+	}
+	if helo, ok := attrs["HELO"]; ok {
+		peer.helo = helo
+	}
+	s.setPeer(&peer)
+	s.reply("250 2.0.0 Ok\r\n")
+}
+
+// parseXAttributes parses the attributes of an XCLIENT or XFORWARD command.
+// Unavailable values are left out, as are attributes mailrelay has no use
+// for.
+func parseXAttributes(line string) (map[string]string, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("syntax: %s attribute=value...", fields[0])
+	}
+	attrs := make(map[string]string)
+	for _, f := range fields[1:] {
+		name, value, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad attribute %q", f)
+		}
+		value, err := xtextDecode(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s value: %w", name, err)
+		}
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			continue
+		}
+		switch name = strings.ToUpper(name); name {
+		case "ADDR":
+			addr, err := netip.ParseAddr(strings.TrimPrefix(strings.ToUpper(value), "IPV6:"))
+			if err != nil {
+				return nil, fmt.Errorf("bad ADDR value %q", value)
+			}
+			attrs[name] = addr.Unmap().String()
+		case "HELO":
+			attrs[name] = value
+		}
+	}
+	return attrs, nil
+}
+
+// xtextDecode decodes an RFC 3461 xtext value.
+func xtextDecode(s string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+xtextHexLength > len(s) {
+			return "", errors.New("truncated xtext escape")
+		}
+		b, err := hex.DecodeString(s[i+1 : i+xtextHexLength])
+		if err != nil {
+			return "", err
+		}
+		sb.Write(b)
+		i += xtextHexLength - 1
+	}
+	return sb.String(), nil
+}
+
+// xtextEncode encodes a value as RFC 3461 xtext.
+func xtextEncode(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&sb, "+%02X", c)
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// sendXForward passes the original client of the message to an upstream
+// server that supports XFORWARD, so it can be attributed along the chain.
+// Only the attributes the server advertises are sent.
+func sendXForward(client *smtp.Client, e *mail.Envelope) error {
+	ok, params := client.Extension("XFORWARD")
+	if !ok {
+		return nil
+	}
+	supported := strings.Fields(strings.ToUpper(params))
+	var attrs []string
+	add := func(name, value string) {
+		if value != "" && slices.Contains(supported, name) {
+			attrs = append(attrs, name+"="+xtextEncode(value))
+		}
+	}
+	if addr, err := netip.ParseAddr(e.RemoteIP); err == nil {
+		if addr.Is6() && !addr.Is4In6() {
+			add("ADDR", "IPV6:"+addr.String())
+		} else {
+			add("ADDR", addr.Unmap().String())
+		}
+	}
+	add("HELO", e.Helo)
+	proto := "SMTP"
+	if e.ESMTP {
+		proto = "ESMTP"
+	}
+	add("PROTO", proto)
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	id, err := client.Text.Cmd("XFORWARD %s", strings.Join(attrs, " "))
+	if err != nil {
+		return fmt.Errorf("xforward error: %w", err)
+	}
+	client.Text.StartResponse(id)
+	defer client.Text.EndResponse(id)
+	if _, _, err := client.Text.ReadResponse(250); err != nil {
+		return fmt.Errorf("xforward error: %w", err)
+	}
+	return nil
+}
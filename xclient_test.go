@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialXClient connects to a frontend listener that trusts the given relays.
+func dialXClient(t *testing.T, trusted []string) (*bufio.Reader, net.Conn, *peerRegistry) {
+	t.Helper()
+	setupTestLogger(t)
+	backendAddr, _ := startFakeSMTPServer(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	fe := newFrontend(backendAddr, newPeerRegistry(), time.Minute, DefaultMaxEmailSize)
+	fe.serve(&frontendListener{Listener: l, xclient: &xclientConfig{TrustedPeers: trusted}})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	_, err = readReply(r)
+	require.NoError(t, err)
+	return r, conn, fe.peers
+}
+
+// onlyPeer returns the single peer in the registry.
+func onlyPeer(t *testing.T, peers *peerRegistry) peerInfo {
+	t.Helper()
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+	require.Len(t, peers.peers, 1)
+	for _, p := range peers.peers {
+		return *p
+	}
+	return peerInfo{}
+}
+
+func TestFrontend_XClient(t *testing.T) {
+	r, conn, peers := dialXClient(t, []string{"127.0.0.1"})
+
+	ehlo := lmtpExchange(t, r, conn, "EHLO relay.example")
+	assert.Equal(t, "250-test.local Hello\r\n250-PIPELINING\r\n250-"+xclientExtension+"\r\n250 "+
+		xforwardExtension+"\r\n", ehlo)
+
+	assert.True(t, strings.HasPrefix(lmtpExchange(t, r, conn, "XCLIENT ADDR"), "501 "))
+	assert.Equal(t, "220 test.local SMTP\r\n",
+		lmtpExchange(t, r, conn, "XCLIENT ADDR=IPV6:2001:db8::5 HELO=client+2Eexample NAME=[UNAVAILABLE]"))
+	assert.Equal(t, peerInfo{addr: "2001:db8::5", helo: "client.example"}, onlyPeer(t, peers))
+
+	lmtpExchange(t, r, conn, "EHLO relay.example")
+	assert.Equal(t, "250 2.0.0 Ok\r\n", lmtpExchange(t, r, conn, "XFORWARD ADDR=203.0.113.7 PROTO=ESMTP"))
+	assert.Equal(t, peerInfo{addr: "203.0.113.7", helo: "client.example", via: "2001:db8::5"}, onlyPeer(t, peers))
+
+	lmtpExchange(t, r, conn, "MAIL FROM:<app@example.com>")
+	lmtpExchange(t, r, conn, "RCPT TO:<a@example.com>")
+	assert.Contains(t, lmtpExchange(t, r, conn, "DATA"), "354")
+	fmt.Fprint(conn, "Subject: test\r\n\r\nbody\r\n")
+	assert.Equal(t, "250 2.0.0 OK: queued as ABC\r\n", lmtpExchange(t, r, conn, "."))
+
+	// XFORWARD only applies to a single transaction
+	assert.Equal(t, peerInfo{addr: "2001:db8::5", helo: "client.example"}, onlyPeer(t, peers))
+}
+
+func TestFrontend_XClientUntrusted(t *testing.T) {
+	r, conn, peers := dialXClient(t, []string{"10.0.0.0/8"})
+
+	ehlo := lmtpExchange(t, r, conn, "EHLO relay.example")
+	assert.NotContains(t, ehlo, "XCLIENT")
+	assert.True(t, strings.HasPrefix(lmtpExchange(t, r, conn, "XCLIENT ADDR=192.0.2.1"), "550 "))
+	assert.True(t, strings.HasPrefix(lmtpExchange(t, r, conn, "XFORWARD ADDR=192.0.2.1"), "550 "))
+	assert.Equal(t, "127.0.0.1", onlyPeer(t, peers).addr)
+}
+
+func TestParseXAttributes(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{name: "ipv4", line: "XCLIENT ADDR=192.0.2.1 HELO=mx.example", expected: map[string]string{
+			"ADDR": "192.0.2.1", "HELO": "mx.example"}},
+		{name: "ipv6", line: "XFORWARD addr=IPV6:2001:DB8::1", expected: map[string]string{"ADDR": "2001:db8::1"}},
+		{name: "unavailable", line: "XCLIENT ADDR=[UNAVAILABLE] HELO=[TEMPUNAVAIL]", expected: map[string]string{}},
+		{name: "ignored attributes", line: "XFORWARD NAME=mx.example SOURCE=REMOTE", expected: map[string]string{}},
+		{name: "xtext", line: "XCLIENT HELO=a+20b", expected: map[string]string{"HELO": "a b"}},
+		{name: "no attributes", line: "XCLIENT", wantErr: true},
+		{name: "bad attribute", line: "XCLIENT ADDR", wantErr: true},
+		{name: "bad address", line: "XCLIENT ADDR=mx.example", wantErr: true},
+		{name: "bad xtext", line: "XCLIENT HELO=a+2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attrs, err := parseXAttributes(tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, attrs)
+		})
+	}
+}
+
+func TestXText(t *testing.T) {
+	assert.Equal(t, "a+20b+2Bc+3Dd", xtextEncode("a b+c=d"))
+	decoded, err := xtextDecode("a+20b+2Bc+3Dd")
+	require.NoError(t, err)
+	assert.Equal(t, "a b+c=d", decoded)
+}
+
+func TestXClientConfig(t *testing.T) {
+	cfg := &xclientConfig{TrustedPeers: []string{"10.0.0.0/8", "unix"}}
+	require.NoError(t, cfg.validate())
+	assert.True(t, cfg.trusted("10.1.2.3"))
+	assert.True(t, cfg.trusted("unix:0:0"))
+	assert.False(t, cfg.trusted("192.168.1.1"))
+	assert.False(t, (&xclientConfig{TrustedPeers: []string{"10.0.0.0/8"}}).trusted("unix"))
+
+	assert.Error(t, (&xclientConfig{}).validate())
+	assert.Error(t, (&xclientConfig{TrustedPeers: []string{"relay.example"}}).validate())
+}
+
+// xforwardServer accepts a single SMTP connection advertising XFORWARD with
+// the given attributes, and returns the XFORWARD command it receives.
+func xforwardServer(t *testing.T, attrs string) (string, chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	commands := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 upstream.local ESMTP\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "EHLO"):
+				fmt.Fprintf(conn, "250-upstream.local\r\n250 XFORWARD %s\r\n", attrs)
+			case strings.HasPrefix(line, "XFORWARD"):
+				commands <- strings.TrimSpace(line)
+				fmt.Fprint(conn, "250 2.0.0 Ok\r\n")
+			default:
+				fmt.Fprint(conn, "250 OK\r\n")
+			}
+		}
+	}()
+	return l.Addr().String(), commands
+}
+
+func TestSendXForward(t *testing.T) {
+	tests := []struct {
+		name     string
+		attrs    string
+		remoteIP string
+		expected string
+	}{
+		{name: "ipv4", attrs: "NAME ADDR PROTO HELO SOURCE", remoteIP: "192.0.2.1",
+			expected: "XFORWARD ADDR=192.0.2.1 HELO=client+20host PROTO=ESMTP"},
+		{name: "ipv6", attrs: "ADDR", remoteIP: "2001:db8::1", expected: "XFORWARD ADDR=IPV6:2001:db8::1"},
+		{name: "unix peer", attrs: "ADDR HELO", remoteIP: "unix:0:0", expected: "XFORWARD HELO=client+20host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, commands := xforwardServer(t, tt.attrs)
+			client, err := smtp.Dial(addr)
+			require.NoError(t, err)
+			defer client.Close()
+
+			e := mail.NewEnvelope(tt.remoteIP, 1)
+			e.Helo = "client host"
+			e.ESMTP = true
+			require.NoError(t, sendXForward(client, e))
+			assert.Equal(t, tt.expected, <-commands)
+		})
+	}
+}